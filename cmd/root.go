@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/Leosocy/IntelliProxy/config"
+	"github.com/Leosocy/IntelliProxy/log"
 	"github.com/spf13/cobra"
 )
 
@@ -26,7 +28,9 @@ to quickly create a Cobra application.`,
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
-func Execute() {
+// serve runs when called without any subcommands, after the config is loaded.
+func Execute(serve func()) {
+	rootCmd.Run = func(cmd *cobra.Command, args []string) { serve() }
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -34,9 +38,22 @@ func Execute() {
 }
 
 func init() {
-	cobra.OnInitialize()
+	cobra.OnInitialize(initConfig)
+
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "",
+		"config file in YAML or TOML, overridden by INTELLI_PROXY_* environment variables "+
+			"(default ./intelliproxy.yml or /etc/intelliproxy/intelliproxy.yml if exists)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	// rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
+
+// initConfig loads the config file, and exits with the problems if invalid.
+func initConfig() {
+	if err := config.Load(cfgFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	log.Configure(config.Config())
+}
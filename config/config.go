@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
@@ -9,6 +11,7 @@ import (
 // Provider defines a set of read-only methods for accessing the application
 // configuration params as defined in one of the config files.
 type Provider interface {
+	AllKeys() []string
 	ConfigFileUsed() string
 	Get(key string) interface{}
 	GetBool(key string) bool
@@ -41,15 +44,103 @@ func init() {
 	defaultConfig = readViperConfig("INTELLI_PROXY")
 }
 
+// Load reads the config file at path into the default config, where the
+// environment variables still override it, and validates the config.
+// If path is empty, it's the `config` key, e.g. INTELLI_PROXY_CONFIG,
+// otherwise the optional intelliproxy.{yml,yaml,toml,json} is searched in
+// the working directory and /etc/intelliproxy.
+func Load(path string) error {
+	return load(defaultConfig, path)
+}
+
+func load(v *viper.Viper, path string) error {
+	if path == "" {
+		path = v.GetString("config")
+	}
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("intelliproxy")
+		v.AddConfigPath(".")
+		v.AddConfigPath("/etc/intelliproxy")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		if _, notFound := err.(viper.ConfigFileNotFoundError); !notFound || path != "" {
+			return fmt.Errorf("failed to read config %s, %v", v.ConfigFileUsed(), err)
+		}
+	}
+	if err := Validate(v); err != nil {
+		if file := v.ConfigFileUsed(); file != "" {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		return err
+	}
+	return nil
+}
+
 func readViperConfig(appName string) *viper.Viper {
 	v := viper.New()
 	v.SetEnvPrefix(appName)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	v.AutomaticEnv()
 
 	// global defaults
 
 	v.SetDefault("json_logs", false)
 	v.SetDefault("loglevel", "debug")
+	v.SetDefault("shutdown.timeout", "30s") // of draining the requests and checks on SIGINT/SIGTERM
+	v.SetDefault("backend.type", "memory")
+	v.SetDefault("backend.bolt.path", "intelliproxy.db")
+	v.SetDefault("backend.snapshot.path", "") // empty disables snapshot
+	v.SetDefault("backend.snapshot.period", "5m")
+	v.SetDefault("backend.eviction.max_age", "0") // zero disables expiry
+	v.SetDefault("backend.eviction.max_size", 0)  // zero means unbounded
+	v.SetDefault("backend.eviction.policy", "lowest_score")
+	v.SetDefault("backend.eviction.period", "1m")
+	v.SetDefault("backend.low_water", 50)  // publishes backend.pool.low when size drops below it
+	v.SetDefault("spider.definitions", "") // file or directory of spider definitions, empty disables
+	v.SetDefault("spider.reload_period", "10s")
+	v.SetDefault("spider.dead_after", 6) // crawls finding nothing before a spider is dead, zero disables
+	v.SetDefault("spider.reprobe_period", "24h")
+	v.SetDefault("spider.through_pool", false) // crawls through the top-scored proxies, directly if none
+	v.SetDefault("spider.pool_size", 20)
+	v.SetDefault("spider.pool_retries", 3)
+	// spider.period, spider.cool_down and spider.limit.{parallelism,delay,random_delay}
+	// apply to the spiders which don't configure them
+	// crawls on demand when the proxies matching the filter drop below the low water,
+	// until they reach the high water
+	v.SetDefault("spider.demand.filter", "score >= 60")
+	v.SetDefault("spider.demand.low_water", 100)
+	v.SetDefault("spider.demand.high_water", 300)
+	v.SetDefault("spider.demand.interval", "1m") // of triggering spiders while on demand
+	v.SetDefault("spider.demand.batch", 3)       // spiders triggered each interval, by yield
+	v.SetDefault("checker.prior.base", 80)       // score of a new proxy listed by one source before scored
+	v.SetDefault("checker.prior.per_source", 10) // bonus of each other source listing it
+	v.SetDefault("checker.hosts", []string{})    // requested through proxies to score them, empty of the built-in ones
+	v.SetDefault("checker.anonymity.timeout", "5s")
+	v.SetDefault("checker.geoip.fetcher", "ip-api")
+	v.SetDefault("checker.detection_period", "15m")  // of detecting anonymity and geo info of the proxies in backend
+	v.SetDefault("checker.inspection_period", "30m") // of re-scoring them
+	v.SetDefault("scheduler.dedupe.capacity", 1048576)
+	v.SetDefault("scheduler.dedupe.false_positive", 1e-9) // of dropping a new proxy as a duplicate
+	v.SetDefault("scheduler.queue_size", 1024)            // proxies buffered before the spiders block
+	v.SetDefault("middleman.addr", "0.0.0.0:8081")
+	v.SetDefault("middleman.strategy", "weighted_round_robin")
+	v.SetDefault("middleman.good_score", 90) // minimum score of proxies used by sessions
+	v.SetDefault("middleman.failure_penalty", 10)
+	v.SetDefault("middleman.uses_flush_period", "1m") // of writing the uses of proxies counted to backend
+	v.SetDefault("api.addr", "0.0.0.0:8082")
+	v.SetDefault("submit.default_source", "manual")
+	v.SetDefault("submit.token", "")             // bearer token of the API submissions which skip dedupe, empty disables
+	v.SetDefault("submit.drop_dir", "")          // directory of proxy files dropped in, empty disables
+	v.SetDefault("submit.trust_drop_dir", false) // whether the proxies dropped in skip dedupe
+	v.SetDefault("submit.check_workers", 4)      // checking the trusted proxies at a time
+	v.SetDefault("submit.check_queue", 256)      // trusted proxies queued to check, the others are dropped
+	v.SetDefault("submit.drop_period", "10s")
+	v.SetDefault("webhook.retries", 3)
+	v.SetDefault("webhook.backoff", "1s")
+	v.SetDefault("webhook.timeout", "10s")
+	v.SetDefault("webhook.dead_letter", "webhook-dead-letter.jsonl")
 
 	return v
 }
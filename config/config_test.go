@@ -0,0 +1,137 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("INTELLI_PROXY_MIDDLEMAN_GOOD_SCORE", "95")
+	v := readViperConfig("INTELLI_PROXY")
+	path := writeConfig(t, "intelliproxy.yml", `
+loglevel: info
+backend:
+  type: bolt
+  eviction:
+    max_size: 1000
+checker:
+  hosts: [https://a.example, https://b.example]
+  detection_period: 1h
+spider:
+  limit:
+    delay: 2s
+  sources:
+    xici:
+      enable: false
+      options:
+        url: http://localhost/list
+middleman:
+  strategy: round_robin
+  good_score: 80
+webhook:
+  endpoints:
+    - url: http://localhost/hook
+`)
+	assert.Nil(t, load(v, path))
+	assert.Equal(t, path, v.ConfigFileUsed())
+	assert.Equal(t, "bolt", v.GetString("backend.type"))
+	assert.Equal(t, 1000, v.GetInt("backend.eviction.max_size"))
+	assert.Equal(t, time.Hour, v.GetDuration("checker.detection_period"))
+	assert.Equal(t, 30*time.Minute, v.GetDuration("checker.inspection_period"))
+	assert.Equal(t, []string{"https://a.example", "https://b.example"}, v.GetStringSlice("checker.hosts"))
+	assert.Equal(t, 95, v.GetInt("middleman.good_score"))
+	assert.False(t, v.GetBool("spider.sources.xici.enable"))
+
+	v = readViperConfig("INTELLI_PROXY")
+	assert.Nil(t, load(v, writeConfig(t, "intelliproxy.toml", `
+[scheduler]
+queue_size = 16
+[spider.demand]
+low_water = 10
+high_water = 20
+`)))
+	assert.Equal(t, 16, v.GetInt("scheduler.queue_size"))
+}
+
+func TestLoad_Example(t *testing.T) {
+	v := readViperConfig("INTELLI_PROXY")
+	assert.Nil(t, load(v, "intelliproxy.example.yml"))
+	for _, key := range readViperConfig("INTELLI_PROXY").AllKeys() {
+		assert.Equal(t, v.GetString(key), readViperConfig("INTELLI_PROXY").GetString(key), key)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	err := load(readViperConfig("INTELLI_PROXY"), filepath.Join(t.TempDir(), "missing.yml"))
+	assert.NotNil(t, err)
+
+	t.Setenv("INTELLI_PROXY_SPIDER_DEMAND_LOW_WATER", "500")
+	path := writeConfig(t, "intelliproxy.yml", `
+backend:
+  type: redis
+  snapshot:
+    period: soon
+checker:
+  hosts: [https://a.example]
+  prior:
+    base: 120
+spider:
+  sources:
+    xici:
+      limit:
+        parallelism: -1
+middleman:
+  addr: 8081
+  strategy: fastest
+shedular:
+  queue_size: 16
+`)
+	err = load(readViperConfig("INTELLI_PROXY"), path)
+	if assert.NotNil(t, err) {
+		for _, problem := range []string{
+			path,
+			`backend.type: "redis" is not one of memory, bolt`,
+			"backend.snapshot.period: want duration, got soon",
+			"checker.hosts: 1 hosts",
+			"checker.prior.base: 120 is out of 0..100",
+			"spider.sources.xici.limit.parallelism: -1 must not be negative",
+			"middleman.addr: address 8081: missing port in address",
+			"middleman.strategy: \"fastest\" is not one of",
+			"shedular.queue_size: unknown key",
+			"spider.demand.high_water: 300 is below low_water 500",
+		} {
+			assert.Contains(t, err.Error(), problem)
+		}
+	}
+}
+
+func TestLoad_Search(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	assert.Nil(t, os.Chdir(dir))
+
+	v := readViperConfig("INTELLI_PROXY")
+	assert.Nil(t, load(v, ""))
+	assert.Equal(t, "", v.ConfigFileUsed())
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "intelliproxy.yml"), []byte("api:\n  addr: 127.0.0.1:9000\n"), 0644))
+	v = readViperConfig("INTELLI_PROXY")
+	assert.Nil(t, load(v, ""))
+	assert.Equal(t, "127.0.0.1:9000", v.GetString("api.addr"))
+
+	t.Setenv("INTELLI_PROXY_CONFIG", filepath.Join(dir, "other.yml"))
+	assert.NotNil(t, load(readViperConfig("INTELLI_PROXY"), ""))
+}
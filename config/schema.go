@@ -0,0 +1,280 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+// kind is the type of a config value.
+type kind int
+
+const (
+	kindString kind = iota
+	kindBool
+	kindInt
+	kindFloat
+	kindDuration
+	kindStrings
+	kindAny
+)
+
+func (k kind) String() string {
+	return [...]string{"string", "bool", "int", "float", "duration", "list of strings", "any"}[k]
+}
+
+// cast converts value to the kind, or returns an error if it can't.
+func (k kind) cast(value interface{}) (interface{}, error) {
+	switch k {
+	case kindString:
+		return cast.ToStringE(value)
+	case kindBool:
+		return cast.ToBoolE(value)
+	case kindInt:
+		return cast.ToIntE(value)
+	case kindFloat:
+		return cast.ToFloat64E(value)
+	case kindDuration:
+		return cast.ToDurationE(value)
+	case kindStrings:
+		return cast.ToStringSliceE(value)
+	default:
+		return value, nil
+	}
+}
+
+// spec describes a config key, whose segments of `*` match any name,
+// e.g. the name of spider in `spider.sources.*.enable`.
+type spec struct {
+	key   string
+	kind  kind
+	check func(value interface{}) error // of the value cast to kind, nil if any
+}
+
+func (s spec) match(key string) bool {
+	segments, keySegments := strings.Split(s.key, "."), strings.Split(key, ".")
+	if len(segments) != len(keySegments) {
+		return false
+	}
+	for i, segment := range segments {
+		if segment != "*" && segment != keySegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// schema contains all keys of the config, see readViperConfig for the defaults.
+var schema = []spec{
+	{"config", kindString, nil},
+	{"json_logs", kindBool, nil},
+	{"loglevel", kindString, oneOf("debug", "info", "warning")},
+	{"shutdown.timeout", kindDuration, positive},
+
+	{"backend.type", kindString, oneOf("memory", "bolt")},
+	{"backend.bolt.path", kindString, nil},
+	{"backend.snapshot.path", kindString, nil},
+	{"backend.snapshot.period", kindDuration, positive},
+	{"backend.eviction.max_age", kindDuration, nonNegative},
+	{"backend.eviction.max_size", kindInt, nonNegative},
+	{"backend.eviction.policy", kindString, oneOf("lowest_score", "oldest_check", "least_used")},
+	{"backend.eviction.period", kindDuration, positive},
+	{"backend.low_water", kindInt, nonNegative},
+
+	{"scheduler.dedupe.capacity", kindInt, positive},
+	{"scheduler.dedupe.false_positive", kindFloat, probability},
+	{"scheduler.queue_size", kindInt, nonNegative},
+
+	{"checker.hosts", kindStrings, hosts},
+	{"checker.anonymity.timeout", kindDuration, positive},
+	{"checker.geoip.fetcher", kindString, oneOf("ip-api")},
+	{"checker.detection_period", kindDuration, positive},
+	{"checker.inspection_period", kindDuration, positive},
+	{"checker.prior.base", kindInt, score},
+	{"checker.prior.per_source", kindInt, score},
+
+	{"spider.definitions", kindString, nil},
+	{"spider.reload_period", kindDuration, positive},
+	{"spider.dead_after", kindInt, nonNegative},
+	{"spider.reprobe_period", kindDuration, positive},
+	{"spider.through_pool", kindBool, nil},
+	{"spider.pool_size", kindInt, positive},
+	{"spider.pool_retries", kindInt, nonNegative},
+	{"spider.period", kindDuration, nonNegative},
+	{"spider.cool_down", kindDuration, nonNegative},
+	{"spider.limit.parallelism", kindInt, nonNegative},
+	{"spider.limit.delay", kindDuration, nonNegative},
+	{"spider.limit.random_delay", kindDuration, nonNegative},
+	{"spider.demand.filter", kindString, nil},
+	{"spider.demand.low_water", kindInt, nonNegative},
+	{"spider.demand.high_water", kindInt, nonNegative},
+	{"spider.demand.interval", kindDuration, positive},
+	{"spider.demand.batch", kindInt, positive},
+	{"spider.sources.*.enable", kindBool, nil},
+	{"spider.sources.*.period", kindDuration, nonNegative},
+	{"spider.sources.*.cool_down", kindDuration, nonNegative},
+	{"spider.sources.*.limit.parallelism", kindInt, nonNegative},
+	{"spider.sources.*.limit.delay", kindDuration, nonNegative},
+	{"spider.sources.*.limit.random_delay", kindDuration, nonNegative},
+	{"spider.sources.*.options.*", kindString, nil},
+
+	{"middleman.addr", kindString, addr},
+	{"middleman.strategy", kindString, oneOf("random", "round_robin", "weighted_round_robin")},
+	{"middleman.good_score", kindInt, score},
+	{"middleman.failure_penalty", kindInt, score},
+	{"middleman.uses_flush_period", kindDuration, positive},
+
+	{"api.addr", kindString, addr},
+	{"submit.default_source", kindString, nil},
+	{"submit.token", kindString, nil},
+	{"submit.drop_dir", kindString, nil},
+	{"submit.trust_drop_dir", kindBool, nil},
+	{"submit.check_workers", kindInt, positive},
+	{"submit.check_queue", kindInt, nonNegative},
+	{"submit.drop_period", kindDuration, positive},
+
+	{"webhook.endpoints", kindAny, nil}, // validated by webhook.NewSinkFromConfig
+	{"webhook.retries", kindInt, nonNegative},
+	{"webhook.backoff", kindDuration, nonNegative},
+	{"webhook.timeout", kindDuration, positive},
+	{"webhook.dead_letter", kindString, nil},
+}
+
+func lookupSpec(key string) *spec {
+	for i := range schema {
+		if schema[i].match(key) {
+			return &schema[i]
+		}
+	}
+	return nil
+}
+
+// ValidationError contains the problems of the config, one per key.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks the values of cfg against the schema, including those
+// overridden by the environment, and rejects the keys not in the schema,
+// which are usually typos. It returns a ValidationError if invalid.
+func Validate(cfg Provider) error {
+	var errs ValidationError
+	values := make(map[string]interface{})
+	validate := func(s *spec, key string) {
+		raw := cfg.Get(key)
+		if raw == nil {
+			return
+		}
+		value, err := s.kind.cast(raw)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: want %s, got %v", key, s.kind, raw))
+			return
+		}
+		if s.check != nil {
+			if err := s.check(value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+				return
+			}
+		}
+		values[key] = value
+	}
+	for i := range schema {
+		if !strings.Contains(schema[i].key, "*") {
+			validate(&schema[i], schema[i].key)
+		}
+	}
+	for _, key := range cfg.AllKeys() {
+		if strings.HasPrefix(key, "webhook.endpoints.") {
+			continue
+		}
+		s := lookupSpec(key)
+		if s == nil {
+			errs = append(errs, fmt.Sprintf("%s: unknown key", key))
+		} else if strings.Contains(s.key, "*") {
+			validate(s, key)
+		}
+	}
+
+	low, lowOK := values["spider.demand.low_water"].(int)
+	high, highOK := values["spider.demand.high_water"].(int)
+	if lowOK && highOK && high < low {
+		errs = append(errs, fmt.Sprintf("spider.demand.high_water: %d is below low_water %d", high, low))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func oneOf(choices ...string) func(value interface{}) error {
+	return func(value interface{}) error {
+		for _, choice := range choices {
+			if value == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(choices, ", "))
+	}
+}
+
+func positive(value interface{}) error {
+	switch v := value.(type) {
+	case int:
+		if v <= 0 {
+			return fmt.Errorf("%d must be positive", v)
+		}
+	case time.Duration:
+		if v <= 0 {
+			return fmt.Errorf("%v must be positive", v)
+		}
+	}
+	return nil
+}
+
+func nonNegative(value interface{}) error {
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return fmt.Errorf("%d must not be negative", v)
+		}
+	case time.Duration:
+		if v < 0 {
+			return fmt.Errorf("%v must not be negative", v)
+		}
+	}
+	return nil
+}
+
+func score(value interface{}) error {
+	if v := value.(int); v < 0 || v > 100 {
+		return fmt.Errorf("%d is out of 0..100", v)
+	}
+	return nil
+}
+
+func probability(value interface{}) error {
+	if v := value.(float64); v <= 0 || v >= 1 {
+		return fmt.Errorf("%v is out of (0, 1)", v)
+	}
+	return nil
+}
+
+// hosts checks the hosts of scorer, which are at least 2, or empty of the built-in ones.
+func hosts(value interface{}) error {
+	if v := value.([]string); len(v) == 1 {
+		return fmt.Errorf("%d hosts, want at least 2 or none for the built-in ones", len(v))
+	}
+	return nil
+}
+
+func addr(value interface{}) error {
+	if _, _, err := net.SplitHostPort(value.(string)); err != nil {
+		return err
+	}
+	return nil
+}
@@ -42,6 +42,14 @@ func init() {
 	defaultLogger = newLogrusLogger(config.Config())
 }
 
+// Configure applies the format and level of cfg to the default logger,
+// e.g. after the config file is loaded.
+func Configure(cfg config.Provider) {
+	l := newLogrusLogger(cfg)
+	defaultLogger.Formatter = l.Formatter
+	defaultLogger.SetLevel(l.Level)
+}
+
 func NewLogger(cfg config.Provider) *logrus.Logger {
 	return newLogrusLogger(cfg)
 }
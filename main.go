@@ -1,16 +1,100 @@
 package main
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/Leosocy/IntelliProxy/cmd"
+	"github.com/Leosocy/IntelliProxy/config"
+	"github.com/Leosocy/IntelliProxy/log"
+	"github.com/Leosocy/IntelliProxy/pkg/loadbalancer"
 	"github.com/Leosocy/IntelliProxy/pkg/sched"
+	"github.com/Leosocy/IntelliProxy/service/api"
 	"github.com/Leosocy/IntelliProxy/service/middleman"
 )
 
 func main() {
-	scheduler := sched.NewScheduler()
-	go scheduler.Start()
+	// runs the command, e.g. `intelliproxy submit`, if any, otherwise serves
+	cmd.Execute(serve)
+}
+
+func serve() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	cfg := config.Config()
+	scheduler, err := sched.NewScheduler(cfg)
+	if err != nil {
+		log.Errorf("Failed to create scheduler, %v", err)
+		os.Exit(1)
+	}
+	strategy, err := loadbalancer.ParseStrategy(cfg.GetString("middleman.strategy"))
+	if err != nil {
+		log.Errorf("Invalid middleman.strategy, %v", err)
+		os.Exit(1)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		scheduler.Start(ctx)
+	}()
+
+	apiServer := &http.Server{
+		Addr: cfg.GetString("api.addr"),
+		Handler: api.NewServer(scheduler.GetBackend(), api.WithSpiderStats(scheduler.SpiderStats),
+			api.WithSubmitter(scheduler.GetSubmitter()), api.WithSubmitToken(cfg.GetString("submit.token"))),
+		// the event streams end when shutting down
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		if err := apiServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Errorf("API server stopped, %v", err)
+		}
+	}()
+
+	mm := middleman.NewServer(scheduler.GetBackend(), scheduler.GetBus(), strategy,
+		middleman.GoodScore(int8(cfg.GetInt("middleman.good_score"))),
+		middleman.FailurePenalty(int8(cfg.GetInt("middleman.failure_penalty"))),
+		middleman.FlushUsesEvery(cfg.GetDuration("middleman.uses_flush_period")))
+	middlemanServer := &http.Server{Addr: cfg.GetString("middleman.addr"), Handler: mm}
+	go func() {
+		if err := middlemanServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Errorf("Middleman server stopped, %v", err)
+			stop()
+		}
+	}()
 
-	middlemanServer := middleman.NewServer(scheduler.GetBackend())
-	http.ListenAndServe("0.0.0.0:8081", middlemanServer)
+	<-ctx.Done()
+	stop() // a second signal kills the process
+	log.Info("Shutting down")
+	timeout := cfg.GetDuration("shutdown.timeout")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// stops accepting, and drains the active requests
+	for _, srv := range []*http.Server{apiServer, middlemanServer} {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Warnf("Failed to drain the requests to %s, %v", srv.Addr, err)
+			srv.Close()
+		}
+	}
+	// the CONNECT tunnels are hijacked from the middleman server
+	if err := mm.Shutdown(shutdownCtx); err != nil {
+		log.Warnf("Failed to drain the tunnels of middleman, %v", err)
+	}
+	mm.Close()
+	// the spiders finish the pages crawling
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		log.Warnf("Scheduler not stopped in %v", timeout)
+	}
+	if err := scheduler.Shutdown(shutdownCtx); err != nil {
+		log.Errorf("Failed to shut down scheduler, %v", err)
+		os.Exit(1)
+	}
+	log.Info("Shut down")
 }
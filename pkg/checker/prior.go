@@ -0,0 +1,39 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package checker
+
+import "github.com/Leosocy/IntelliProxy/pkg/proxy"
+
+// Prior is the score of a proxy before it's scored, by the number of
+// independent sources listing it, since a proxy listed by more sources
+// is more likely to work.
+type Prior struct {
+	Base      int8 // score of a proxy listed by one source
+	PerSource int8 // bonus of each source else
+}
+
+// DefaultPrior gives the proxies listed by 3 sources the maximum score.
+var DefaultPrior = Prior{Base: 80, PerSource: 10}
+
+// Score returns the prior score of a proxy listed by sources, in [0, 100].
+func (p Prior) Score(sources int) int8 {
+	score := int(p.Base)
+	if sources > 1 {
+		score += (sources - 1) * int(p.PerSource)
+	}
+	switch {
+	case score > int(proxy.MaximumScore):
+		return proxy.MaximumScore
+	case score < 0:
+		return 0
+	}
+	return int8(score)
+}
+
+// Bonus returns the score added to a proxy when it's listed by one more source,
+// i.e. listed by sources now.
+func (p Prior) Bonus(sources int) int8 {
+	return p.Score(sources) - p.Score(sources-1)
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package checker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrior(t *testing.T) {
+	assert.Equal(t, int8(80), DefaultPrior.Score(0))
+	assert.Equal(t, int8(80), DefaultPrior.Score(1))
+	assert.Equal(t, int8(90), DefaultPrior.Score(2))
+	assert.Equal(t, int8(100), DefaultPrior.Score(3))
+	assert.Equal(t, int8(100), DefaultPrior.Score(30))
+	assert.Equal(t, int8(10), DefaultPrior.Bonus(2))
+	assert.Equal(t, int8(0), DefaultPrior.Bonus(4))
+	assert.Equal(t, int8(0), Prior{Base: 10, PerSource: -20}.Score(2))
+}
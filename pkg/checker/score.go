@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
 	"github.com/parnurzeal/gorequest"
 )
 
@@ -21,6 +22,34 @@ type Scorer interface {
 	Score(pxy *proxy.Proxy) int8
 }
 
+// TopicResult is the topic of the results published by PublishingScorer.
+const TopicResult = "checker.result"
+
+// Result is the result of scoring a proxy.
+type Result struct {
+	Pxy    *proxy.Proxy
+	Before int8 // score before scoring
+	After  int8 // score after scoring
+}
+
+// PublishingScorer publishes every result of the scorer to bus.
+type PublishingScorer struct {
+	Scorer
+	bus *pubsub.Bus
+}
+
+// NewPublishingScorer wraps the scorer to publish results to bus.
+func NewPublishingScorer(scorer Scorer, bus *pubsub.Bus) Scorer {
+	return &PublishingScorer{Scorer: scorer, bus: bus}
+}
+
+func (s *PublishingScorer) Score(pxy *proxy.Proxy) int8 {
+	before := pxy.Score
+	after := s.Scorer.Score(pxy)
+	s.bus.Publish(TopicResult, &Result{Pxy: pxy, Before: before, After: after})
+	return after
+}
+
 // BatchHTTPSScorer tryRequest visiting a batch of HTTPS websites
 // and grade the proxy by response time.
 type BatchHTTPSScorer struct {
@@ -74,6 +74,21 @@ const (
 	WeightedRoundRobin
 )
 
+// ParseStrategy returns the strategy with name, which is one of
+// random, round_robin and weighted_round_robin.
+func ParseStrategy(name string) (Strategy, error) {
+	switch name {
+	case "random":
+		return Random, nil
+	case "round_robin":
+		return RoundRobin, nil
+	case "weighted_round_robin":
+		return WeightedRoundRobin, nil
+	default:
+		return 0, fmt.Errorf("unknown load balance strategy %q", name)
+	}
+}
+
 type LoadBalancer interface {
 	Select() Endpoint
 	AddEndpoint(e Endpoint)
@@ -94,3 +94,11 @@ func BenchmarkLoadBalancerSelect(b *testing.B) {
 		fmt.Printf("%s %+v\n", name, stats)
 	}
 }
+
+func TestParseStrategy(t *testing.T) {
+	strategy, err := ParseStrategy("round_robin")
+	assert.Nil(t, err)
+	assert.Equal(t, RoundRobin, strategy)
+	_, err = ParseStrategy("least_conn")
+	assert.NotNil(t, err)
+}
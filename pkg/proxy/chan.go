@@ -12,20 +12,55 @@ import (
 
 // CachedChan provides a channel to transport proxies from spiders.
 type CachedChan interface {
+	// Send sends a proxy without the source, use SendProxy to keep it.
 	Send(ip, port string)
+	// SendProxy sends a proxy parsed by the sender, e.g. with protocol,
+	// and reports whether it is sent, false if it is a duplicate.
+	SendProxy(pxy *Proxy) bool
 	Recv() <-chan *Proxy
 }
 
+// OnDuplicate calls fn with the duplicates sent, which are not transported,
+// e.g. to record the other sources listing the proxy.
+func OnDuplicate(fn func(pxy *Proxy)) func(*BloomCachedChan) {
+	return func(cc *BloomCachedChan) {
+		cc.onDuplicate = fn
+	}
+}
+
+// Dedupe sizes the bloom filter to hold capacity proxies with the false
+// positive rate, 1048576 proxies of 1e-9 by default. A false positive drops
+// a new proxy as a duplicate.
+func Dedupe(capacity uint64, falsePositive float64) func(*BloomCachedChan) {
+	return func(cc *BloomCachedChan) {
+		cc.capacity, cc.falsePositive = capacity, falsePositive
+	}
+}
+
+// QueueSize sets the proxies buffered before the senders block, 1024 by default.
+func QueueSize(size int) func(*BloomCachedChan) {
+	return func(cc *BloomCachedChan) {
+		cc.queueSize = size
+	}
+}
+
 // NewBloomCachedChan returns a default bloom cached chan.
-func NewBloomCachedChan() CachedChan {
-	bf, err := bloomfilter.NewOptimal(1024*1024, 0.000000001)
+func NewBloomCachedChan(options ...func(*BloomCachedChan)) CachedChan {
+	cc := &BloomCachedChan{
+		capacity:      1024 * 1024,
+		falsePositive: 0.000000001,
+		queueSize:     1024,
+	}
+	for _, opt := range options {
+		opt(cc)
+	}
+	bf, err := bloomfilter.NewOptimal(cc.capacity, cc.falsePositive)
 	if err != nil {
 		panic(err)
 	}
-	return &BloomCachedChan{
-		entryBf: bf,
-		ch:      make(chan *Proxy, 1024),
-	}
+	cc.entryBf = bf
+	cc.ch = make(chan *Proxy, cc.queueSize)
+	return cc
 }
 
 // BloomCachedChan excludes proxy that are already sent to channel
@@ -36,19 +71,34 @@ type BloomCachedChan struct {
 	entryBf *bloomfilter.Filter
 	// ch transports proxies that crawled by spiders.
 	ch chan *Proxy
+	// onDuplicate is called with the proxies dropped, if not nil.
+	onDuplicate func(pxy *Proxy)
+
+	capacity      uint64
+	falsePositive float64
+	queueSize     int
 }
 
 func (cc *BloomCachedChan) Send(ip, port string) {
 	if pxy, err := NewProxy(ip, port); err == nil {
-		hasher := fnv.New64()
-		if _, err := hasher.Write(pxy.IP); err == nil &&
-			!cc.entryBf.Contains(hasher) {
-			// first add it to filter, since send to
-			// channel will block current goroutine.
-			cc.entryBf.Add(hasher)
-			cc.ch <- pxy
-		}
+		cc.SendProxy(pxy)
+	}
+}
+
+func (cc *BloomCachedChan) SendProxy(pxy *Proxy) bool {
+	hasher := fnv.New64()
+	if _, err := hasher.Write(pxy.IP); err == nil &&
+		!cc.entryBf.Contains(hasher) {
+		// first add it to filter, since send to
+		// channel will block current goroutine.
+		cc.entryBf.Add(hasher)
+		cc.ch <- pxy
+		return true
+	}
+	if cc.onDuplicate != nil {
+		cc.onDuplicate(pxy)
 	}
+	return false
 }
 
 func (cc *BloomCachedChan) Recv() <-chan *Proxy {
@@ -22,6 +22,30 @@ func TestBloomCachedChan(t *testing.T) {
 	assert.Equal(2, len(c.Recv()))
 }
 
+func TestBloomCachedChan_OnDuplicate(t *testing.T) {
+	var duplicates []string
+	c := NewBloomCachedChan(OnDuplicate(func(pxy *Proxy) {
+		duplicates = append(duplicates, pxy.Source)
+	}))
+	pxy, _ := NewProxy("1.2.3.4", "80")
+	pxy.Source = "xici"
+	assert.True(t, c.SendProxy(pxy))
+	dup, _ := NewProxy("1.2.3.4", "8080")
+	dup.Source = "kuai"
+	assert.False(t, c.SendProxy(dup))
+	assert.Equal(t, []string{"kuai"}, duplicates)
+	assert.Equal(t, 1, len(c.Recv()))
+}
+
+func TestBloomCachedChan_Options(t *testing.T) {
+	assert.Equal(t, 1024, cap(NewBloomCachedChan().Recv()))
+	c := NewBloomCachedChan(Dedupe(1000, 0.001), QueueSize(8))
+	assert.Equal(t, 8, cap(c.Recv()))
+	c.Send("1.2.3.4", "80")
+	c.Send("1.2.3.4", "80")
+	assert.Equal(t, 1, len(c.Recv()))
+}
+
 func BenchmarkBloomCachedChan(b *testing.B) {
 	c := NewBloomCachedChan()
 	for i := 0; i < b.N; i++ {
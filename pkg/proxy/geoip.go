@@ -28,6 +28,7 @@ type GeoInfo struct {
 	Lat         float32 `ip-api-json:"lat"`         // e.g. 32.0617
 	Lon         float32 `ip-api-json:"lon"`         // e.g. 118.7778
 	ISP         string  `ip-api-json:"isp"`         // e.g. Chinanet
+	ASN         string  `ip-api-json:"as"`          // e.g. AS4134 CHINANET-BACKBONE
 }
 
 const (
@@ -8,6 +8,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,20 +37,95 @@ const (
 	MaximumScore int8 = 100
 )
 
+// Protocol is the protocol used to talk with proxy server.
+type Protocol string
+
+const (
+	HTTP   Protocol = "http"
+	HTTPS  Protocol = "https"
+	SOCKS4 Protocol = "socks4"
+	SOCKS5 Protocol = "socks5"
+)
+
+// ParseProtocol returns the protocol named in s case-insensitively,
+// e.g. `HTTPS` or `socks5`, empty if unknown.
+func ParseProtocol(s string) Protocol {
+	switch p := Protocol(strings.ToLower(strings.TrimSpace(s))); p {
+	case HTTP, HTTPS, SOCKS4, SOCKS5:
+		return p
+	default:
+		return ""
+	}
+}
+
+// Capability is a set of flags that what the proxy supports.
+type Capability uint8
+
+const (
+	// CapHTTPS 支持通过CONNECT访问https网站
+	CapHTTPS Capability = 1 << iota
+	// CapPOST 支持转发POST请求
+	CapPOST
+)
+
+// Has reports whether all flags of c2 are set in c.
+func (c Capability) Has(c2 Capability) bool {
+	return c&c2 == c2
+}
+
 // Proxy IP Proxy data model.
 type Proxy struct {
-	IP        net.IP    `json:"ip"`
-	Port      uint32    `json:"port"`
-	GeoInfo   *GeoInfo  `json:"geo_info"`
-	Anon      Anonymity `json:"anonymity"`
-	Latency   uint32    `json:"latency"` // unit: ms
-	Speed     uint32    `json:"speed"`   // unit: kb/s
-	Score     int8      `json:"score"`   // [0-100]
-	CreatedAt time.Time `json:"created_at"`
-	CheckedAt time.Time `json:"checked_at"`
+	IP        net.IP     `json:"ip"`
+	Port      uint32     `json:"port"`
+	Protocol  Protocol   `json:"protocol"` // empty means http
+	Username  string     `json:"-"`        // left out of JSON, which is public, see Record
+	Password  string     `json:"-"`
+	GeoInfo   *GeoInfo   `json:"geo_info"`
+	Anon      Anonymity  `json:"anonymity"`
+	Caps      Capability `json:"capabilities"`
+	Latency   uint32     `json:"latency"` // unit: ms
+	Speed     uint32     `json:"speed"`   // unit: kb/s
+	Score     int8       `json:"score"`   // [0-100]
+	CreatedAt time.Time  `json:"created_at"`
+	CheckedAt time.Time  `json:"checked_at"`
+	Uses      uint64     `json:"uses"`             // times used by middleman
+	Version   uint64     `json:"version"`          // increased by backend on every write
+	Source    string     `json:"source,omitempty"` // name of the spider which found it first, or the submitter
+	// Labels are the metadata of submitted proxies, e.g. the vendor of paid ones.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Sightings are the times each source listed the proxy, by the name of source.
+	Sightings map[string]Sighting `json:"sightings,omitempty"`
 	lock      sync.RWMutex
 }
 
+// Record is the JSON of proxy for storage, e.g. bolt and snapshots,
+// which keeps the credentials left out of the public JSON of proxy.
+type Record struct {
+	*Proxy
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// NewRecord returns the record of p for storage.
+func NewRecord(p *Proxy) *Record {
+	return &Record{Proxy: p, Username: p.Username, Password: p.Password}
+}
+
+// Unwrap returns the proxy decoded, with the credentials.
+func (r *Record) Unwrap() *Proxy {
+	if r.Proxy == nil {
+		r.Proxy = &Proxy{}
+	}
+	r.Proxy.Username, r.Proxy.Password = r.Username, r.Password
+	return r.Proxy
+}
+
+// Sighting is when a source listed the proxy first and last.
+type Sighting struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
 // NewProxy passes in the ip, port, calculates the other field values,
 // and returns an initialized Proxy object
 func NewProxy(ip, port string) (*Proxy, error) {
@@ -72,6 +149,36 @@ func NewProxy(ip, port string) (*Proxy, error) {
 	}, nil
 }
 
+// ParseURL parses the proxy like `[protocol://][username:password@]ip:port`,
+// the protocol is empty if omitted.
+func ParseURL(raw string) (*Proxy, error) {
+	raw = strings.TrimSpace(raw)
+	var protocol Protocol
+	if i := strings.Index(raw, "://"); i >= 0 {
+		if protocol = ParseProtocol(raw[:i]); protocol == "" {
+			return nil, fmt.Errorf("unknown protocol %q", raw[:i])
+		}
+		raw = raw[i+3:]
+	}
+	u, err := url.Parse("//" + raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path != "" || u.RawQuery != "" {
+		return nil, fmt.Errorf("invalid proxy %q", raw)
+	}
+	pxy, err := NewProxy(u.Hostname(), u.Port())
+	if err != nil {
+		return nil, err
+	}
+	pxy.Protocol = protocol
+	if u.User != nil {
+		pxy.Username = u.User.Username()
+		pxy.Password, _ = u.User.Password()
+	}
+	return pxy, nil
+}
+
 // DetectGeoInfo set the GeoInfo field value by calling `NewGeoInfo`
 func (p *Proxy) DetectGeoInfo(f GeoInfoFetcher) (err error) {
 	p.GeoInfo, err = f.Do(p.IP.String())
@@ -144,12 +251,108 @@ func (p *Proxy) AddScore(delta int8) {
 	p.CheckedAt = time.Now()
 }
 
-// URL returns string like `ip:port`
+// Sight records that the source listed the proxy at the time,
+// and reports whether the source is new to the proxy.
+func (p *Proxy) Sight(source string, at time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if s, ok := p.Sightings[source]; ok {
+		if at.Before(s.FirstSeen) {
+			s.FirstSeen = at
+		}
+		if at.After(s.LastSeen) {
+			s.LastSeen = at
+		}
+		p.Sightings[source] = s
+		return false
+	}
+	if p.Sightings == nil {
+		p.Sightings = make(map[string]Sighting)
+	}
+	p.Sightings[source] = Sighting{FirstSeen: at, LastSeen: at}
+	return true
+}
+
+// Sources returns the sorted names of sources listing the proxy,
+// or the Source if it's never sighted, e.g. stored by old versions.
+func (p *Proxy) Sources() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if len(p.Sightings) == 0 {
+		if p.Source == "" {
+			return nil
+		}
+		return []string{p.Source}
+	}
+	sources := make([]string, 0, len(p.Sightings))
+	for source := range p.Sightings {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// SourceCount returns the number of independent sources listing the proxy.
+func (p *Proxy) SourceCount() int {
+	return len(p.Sources())
+}
+
+// Clone returns a deep copy of the proxy.
+func (p *Proxy) Clone() *Proxy {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	c := &Proxy{
+		IP:        append(net.IP(nil), p.IP...),
+		Port:      p.Port,
+		Protocol:  p.Protocol,
+		Username:  p.Username,
+		Password:  p.Password,
+		Anon:      p.Anon,
+		Caps:      p.Caps,
+		Latency:   p.Latency,
+		Speed:     p.Speed,
+		Score:     p.Score,
+		CreatedAt: p.CreatedAt,
+		CheckedAt: p.CheckedAt,
+		Uses:      p.Uses,
+		Version:   p.Version,
+		Source:    p.Source,
+	}
+	if p.GeoInfo != nil {
+		info := *p.GeoInfo
+		c.GeoInfo = &info
+	}
+	if p.Labels != nil {
+		c.Labels = make(map[string]string, len(p.Labels))
+		for k, v := range p.Labels {
+			c.Labels[k] = v
+		}
+	}
+	if p.Sightings != nil {
+		c.Sightings = make(map[string]Sighting, len(p.Sightings))
+		for k, v := range p.Sightings {
+			c.Sightings[k] = v
+		}
+	}
+	return c
+}
+
+// URL returns string like `socks5://ip:port` of the protocol, with the credentials
+// if any. The https proxies tunnel by CONNECT, so they are talked to over http.
 func (p *Proxy) URL() string {
 	if len(p.IP) == 0 || p.Port == 0 {
 		return ""
 	}
-	return fmt.Sprintf("http://%s:%d", p.IP.String(), p.Port)
+	scheme := p.Protocol
+	if scheme == "" || scheme == HTTPS {
+		scheme = HTTP
+	}
+	if p.Username != "" {
+		return fmt.Sprintf("%s://%s@%s:%d", scheme, url.UserPassword(p.Username, p.Password), p.IP.String(), p.Port)
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, p.IP.String(), p.Port)
 }
 
 func (p *Proxy) String() string {
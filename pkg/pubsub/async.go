@@ -0,0 +1,271 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"sync"
+	"time"
+)
+
+// OverflowPolicy decides what to do when the queue of a watcher is full.
+type OverflowPolicy uint8
+
+const (
+	// Block waits until the queue has room, it slows down the notifier
+	// but never loses objects.
+	Block OverflowPolicy = iota
+	// DropNewest discards the object being notified.
+	DropNewest
+	// DropOldest discards the oldest object in the queue to make room.
+	DropOldest
+)
+
+// QueueStats is the delivery statistics of a watcher.
+type QueueStats struct {
+	Watcher   Watcher
+	Queued    int           // objects waiting for delivery
+	Delivered uint64        // objects delivered
+	Dropped   uint64        // objects dropped because of overflow
+	Lag       time.Duration // time the latest delivered object waited in queue
+	MaxLag    time.Duration // max time an object waited in queue
+}
+
+type queueItem struct {
+	obj interface{}
+	at  time.Time
+}
+
+// queue delivers objects to a watcher in order on its own goroutine.
+type queue struct {
+	w     Watcher
+	items chan queueItem
+	mu    sync.Mutex
+	idle  *sync.Cond // broadcast when pending drops to zero
+	// pending is the number of objects enqueued but not delivered or dropped.
+	pending  int
+	counters QueueStats
+	quit     chan struct{} // closed when detached
+}
+
+func newQueue(w Watcher, size int) *queue {
+	q := &queue{
+		w:     w,
+		items: make(chan queueItem, size),
+		quit:  make(chan struct{}),
+	}
+	q.idle = sync.NewCond(&q.mu)
+	go q.loop()
+	return q
+}
+
+func (q *queue) loop() {
+	for {
+		select {
+		case item := <-q.items:
+			q.deliver(item)
+		case <-q.quit:
+			// deliver the objects queued before detached
+			for {
+				select {
+				case item := <-q.items:
+					q.deliver(item)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *queue) deliver(item queueItem) {
+	lag := time.Since(item.at)
+	q.w.Receipt(item.obj)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.counters.Delivered++
+	q.counters.Lag = lag
+	if lag > q.counters.MaxLag {
+		q.counters.MaxLag = lag
+	}
+	q.release()
+}
+
+// release must be called with q.mu held.
+func (q *queue) release() {
+	q.pending--
+	if q.pending == 0 {
+		q.idle.Broadcast()
+	}
+}
+
+func (q *queue) push(obj interface{}, policy OverflowPolicy) {
+	item := queueItem{obj: obj, at: time.Now()}
+	q.mu.Lock()
+	q.pending++
+	q.mu.Unlock()
+	switch policy {
+	case DropNewest:
+		select {
+		case q.items <- item:
+		default:
+			q.drop()
+		}
+	case DropOldest:
+		for {
+			select {
+			case q.items <- item:
+				return
+			default:
+			}
+			select {
+			case <-q.items:
+				q.drop()
+			default:
+			}
+		}
+	default:
+		select {
+		case q.items <- item:
+		case <-q.quit:
+			q.drop()
+		}
+	}
+}
+
+func (q *queue) drop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.counters.Dropped++
+	q.release()
+}
+
+// flush waits until all the objects enqueued are delivered or dropped.
+func (q *queue) flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.pending > 0 {
+		q.idle.Wait()
+	}
+}
+
+func (q *queue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.counters
+	stats.Watcher = q.w
+	stats.Queued = len(q.items)
+	return stats
+}
+
+// AsyncNotifier is a non-blocking Notifier, every watcher has its own
+// bounded queue and delivery goroutine, so a slow watcher never stalls
+// the notifier or other watchers unless its queue is full and the overflow
+// policy is Block. Objects are delivered to each watcher in the order notified.
+type AsyncNotifier struct {
+	queueConfig
+	queues map[Watcher]*queue
+	mu     sync.RWMutex
+}
+
+// queueConfig is the configuration of queues shared by AsyncNotifier and Bus.
+type queueConfig struct {
+	size   int
+	policy OverflowPolicy
+}
+
+func newQueueConfig(opts []AsyncOption) queueConfig {
+	c := queueConfig{size: 1024, policy: Block}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// AsyncOption configures the queues of AsyncNotifier and Bus.
+type AsyncOption func(c *queueConfig)
+
+// WithQueueSize sets the capacity of queue of each watcher, default is 1024.
+func WithQueueSize(size int) AsyncOption {
+	return func(c *queueConfig) {
+		c.size = size
+	}
+}
+
+// WithOverflowPolicy sets what to do when a queue is full, default is Block.
+func WithOverflowPolicy(policy OverflowPolicy) AsyncOption {
+	return func(c *queueConfig) {
+		c.policy = policy
+	}
+}
+
+// NewAsyncNotifier returns an AsyncNotifier with options.
+func NewAsyncNotifier(opts ...AsyncOption) *AsyncNotifier {
+	return &AsyncNotifier{
+		queueConfig: newQueueConfig(opts),
+		queues:      make(map[Watcher]*queue),
+	}
+}
+
+func (n *AsyncNotifier) Attach(w Watcher) {
+	if w == nil {
+		panic("nil watcher")
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, found := n.queues[w]; !found {
+		n.queues[w] = newQueue(w, n.size)
+	}
+}
+
+// Detach stops notifying w, the objects already queued are still delivered.
+func (n *AsyncNotifier) Detach(w Watcher) {
+	if w == nil {
+		panic("nil watcher")
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if q, found := n.queues[w]; found {
+		delete(n.queues, w)
+		close(q.quit)
+	}
+}
+
+// Notify enqueues obj to the queue of every watcher and returns immediately,
+// unless a queue is full and the overflow policy is Block.
+func (n *AsyncNotifier) Notify(obj interface{}) {
+	// don't hold the lock while pushing, which may block,
+	// so that the watchers can notify or attach in Receipt.
+	for _, q := range n.snapshot() {
+		q.push(obj, n.policy)
+	}
+}
+
+func (n *AsyncNotifier) snapshot() []*queue {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	queues := make([]*queue, 0, len(n.queues))
+	for _, q := range n.queues {
+		queues = append(queues, q)
+	}
+	return queues
+}
+
+// Flush blocks until all the objects notified before are delivered to watchers,
+// it is useful for tests which assert what the watchers received.
+func (n *AsyncNotifier) Flush() {
+	for _, q := range n.snapshot() {
+		q.flush()
+	}
+}
+
+// Stats returns the delivery statistics of every watcher.
+func (n *AsyncNotifier) Stats() []QueueStats {
+	queues := n.snapshot()
+	stats := make([]QueueStats, 0, len(queues))
+	for _, q := range queues {
+		stats = append(stats, q.stats())
+	}
+	return stats
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordWatcher struct {
+	mu      sync.Mutex
+	objs    []interface{}
+	release chan struct{} // Receipt blocks until release closed if not nil
+}
+
+func (w *recordWatcher) Receipt(obj interface{}) {
+	if w.release != nil {
+		<-w.release
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.objs = append(w.objs, obj)
+}
+
+func (w *recordWatcher) received() []interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]interface{}(nil), w.objs...)
+}
+
+func TestAsyncNotifierOrderedDelivery(t *testing.T) {
+	notifier := NewAsyncNotifier()
+	w1, w2 := &recordWatcher{}, &recordWatcher{}
+	notifier.Attach(w1)
+	notifier.Attach(w2)
+	var expected []interface{}
+	for i := 0; i < 100; i++ {
+		notifier.Notify(i)
+		expected = append(expected, i)
+	}
+	notifier.Flush()
+	assert.Equal(t, expected, w1.received())
+	assert.Equal(t, expected, w2.received())
+	// detach
+	notifier.Detach(w2)
+	notifier.Notify(100)
+	notifier.Flush()
+	assert.Len(t, w1.received(), 101)
+	assert.Len(t, w2.received(), 100)
+}
+
+// waitDelivering waits until the first object is taken from the queue.
+func waitDelivering(t *testing.T, notifier *AsyncNotifier) {
+	assert.Eventually(t, func() bool { return notifier.Stats()[0].Queued == 0 }, time.Second, time.Millisecond)
+}
+
+func TestAsyncNotifierSlowWatcher(t *testing.T) {
+	notifier := NewAsyncNotifier(WithQueueSize(2), WithOverflowPolicy(DropNewest))
+	slow := &recordWatcher{release: make(chan struct{})}
+	notifier.Attach(slow)
+	notifier.Notify(0)
+	waitDelivering(t, notifier)
+	done := make(chan struct{})
+	go func() {
+		for i := 1; i < 10; i++ {
+			notifier.Notify(i)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("notify is blocked by the slow watcher")
+	}
+	close(slow.release)
+	notifier.Flush()
+	// one is being delivered and two are queued when overflow
+	assert.Equal(t, []interface{}{0, 1, 2}, slow.received())
+	stats := notifier.Stats()[0]
+	assert.Equal(t, uint64(3), stats.Delivered)
+	assert.Equal(t, uint64(7), stats.Dropped)
+	assert.Equal(t, 0, stats.Queued)
+	assert.True(t, stats.MaxLag > 0)
+}
+
+func TestAsyncNotifierDropOldest(t *testing.T) {
+	notifier := NewAsyncNotifier(WithQueueSize(2), WithOverflowPolicy(DropOldest))
+	w := &recordWatcher{release: make(chan struct{})}
+	notifier.Attach(w)
+	notifier.Notify(0)
+	waitDelivering(t, notifier)
+	for i := 1; i < 10; i++ {
+		notifier.Notify(i)
+	}
+	close(w.release)
+	notifier.Flush()
+	assert.Equal(t, []interface{}{0, 8, 9}, w.received())
+}
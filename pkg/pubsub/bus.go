@@ -0,0 +1,153 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is published on the Bus under a topic.
+type Message struct {
+	// Topic is a hierarchical name separated by dots, e.g. backend.insert.
+	Topic   string
+	Payload interface{}
+	Time    time.Time
+}
+
+// Handler handles the messages of a subscription.
+type Handler func(msg *Message)
+
+// Typed returns a Handler which only handles the messages whose
+// payload is of type T, other messages are ignored.
+func Typed[T any](fn func(topic string, payload T)) Handler {
+	return func(msg *Message) {
+		if payload, ok := msg.Payload.(T); ok {
+			fn(msg.Topic, payload)
+		}
+	}
+}
+
+// Topic joins the parts to a topic, e.g. Topic("spider", "xici", "crawl") is spider.xici.crawl.
+func Topic(parts ...string) string {
+	return strings.Join(parts, ".")
+}
+
+// Bus is a topic-based pub/sub bus. Subscribers subscribe with patterns,
+// which are topics with wildcards: `*` matches exactly one part,
+// and `**` matches zero or more parts, e.g. `spider.*.crawl.**`.
+//
+// Like AsyncNotifier, every subscription has its own bounded queue and
+// delivery goroutine, so messages are delivered in the order published.
+//
+// A nil *Bus is valid and discards all messages,
+// so components can publish without checking whether a bus is set.
+type Bus struct {
+	queueConfig
+	subs map[*Subscription]struct{}
+	mu   sync.RWMutex
+}
+
+// NewBus returns a Bus, opts configure the queue of each subscription.
+func NewBus(opts ...AsyncOption) *Bus {
+	return &Bus{
+		queueConfig: newQueueConfig(opts),
+		subs:        make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription is returned by Subscribe, and used to unsubscribe.
+type Subscription struct {
+	bus     *Bus
+	pattern []string
+	handler Handler
+	q       *queue
+}
+
+// Receipt implements Watcher interface, which is used by the queue.
+func (s *Subscription) Receipt(obj interface{}) {
+	s.handler(obj.(*Message))
+}
+
+// Unsubscribe stops the subscription, the messages already queued are still delivered.
+func (s *Subscription) Unsubscribe() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, found := s.bus.subs[s]; found {
+		delete(s.bus.subs, s)
+		close(s.q.quit)
+	}
+}
+
+// Subscribe calls handler with the messages whose topic matches the pattern.
+func (b *Bus) Subscribe(pattern string, handler Handler) *Subscription {
+	s := &Subscription{bus: b, pattern: strings.Split(pattern, "."), handler: handler}
+	s.q = newQueue(s, b.size)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Publish publishes payload under the topic to the matched subscriptions.
+func (b *Bus) Publish(topic string, payload interface{}) {
+	if b == nil {
+		return
+	}
+	msg := &Message{Topic: topic, Payload: payload, Time: time.Now()}
+	parts := strings.Split(topic, ".")
+	for _, s := range b.matched(parts) {
+		s.q.push(msg, b.policy)
+	}
+}
+
+func (b *Bus) matched(parts []string) (subs []*Subscription) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if match(s.pattern, parts) {
+			subs = append(subs, s)
+		}
+	}
+	return
+}
+
+// Flush blocks until all the messages published before are delivered.
+func (b *Bus) Flush() {
+	b.mu.RLock()
+	queues := make([]*queue, 0, len(b.subs))
+	for s := range b.subs {
+		queues = append(queues, s.q)
+	}
+	b.mu.RUnlock()
+	for _, q := range queues {
+		q.flush()
+	}
+}
+
+// MatchTopic reports whether the topic matches the pattern, see Bus for the wildcards.
+func MatchTopic(pattern, topic string) bool {
+	return match(strings.Split(pattern, "."), strings.Split(topic, "."))
+}
+
+// match reports whether the topic parts match the pattern parts.
+func match(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if match(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 || (pattern[0] != "*" && pattern[0] != parts[0]) {
+		return false
+	}
+	return match(pattern[1:], parts[1:])
+}
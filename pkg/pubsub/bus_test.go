@@ -0,0 +1,75 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		topic   string
+		matched bool
+	}{
+		{"backend.insert", "backend.insert", true},
+		{"backend.insert", "backend.update", false},
+		{"backend.*", "backend.insert", true},
+		{"backend.*", "backend", false},
+		{"backend.*", "backend.insert.more", false},
+		{"spider.*.crawl.done", "spider.xici.crawl.done", true},
+		{"spider.*.crawl.done", "spider.xici.crawl.start", false},
+		{"spider.**", "spider", true},
+		{"spider.**", "spider.xici.crawl.done", true},
+		{"**.done", "spider.xici.crawl.done", true},
+		{"**.done", "checker.result", false},
+		{"**", "checker.result", true},
+		{"spider.**.done", "spider.done", true},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.matched, match(strings.Split(tc.pattern, "."), strings.Split(tc.topic, ".")),
+			"%s %s", tc.pattern, tc.topic)
+	}
+}
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	var (
+		mu      sync.Mutex
+		topics  []string
+		numbers []int
+	)
+	all := bus.Subscribe("**", func(msg *Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		topics = append(topics, msg.Topic)
+	})
+	bus.Subscribe("spider.*.found", Typed(func(topic string, n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		numbers = append(numbers, n)
+	}))
+	bus.Publish(Topic("spider", "xici", "found"), 1)
+	bus.Publish(Topic("spider", "kuai", "found"), 2)
+	bus.Publish(Topic("spider", "kuai", "found"), "not int")
+	bus.Publish(Topic("checker", "result"), 3)
+	bus.Flush()
+	assert.Equal(t, []string{"spider.xici.found", "spider.kuai.found", "spider.kuai.found", "checker.result"}, topics)
+	assert.Equal(t, []int{1, 2}, numbers)
+	// unsubscribe
+	all.Unsubscribe()
+	all.Unsubscribe()
+	bus.Publish(Topic("spider", "yun", "found"), 4)
+	bus.Flush()
+	assert.Len(t, topics, 4)
+	assert.Equal(t, []int{1, 2, 4}, numbers)
+	// nil bus discards messages
+	var nilBus *Bus
+	nilBus.Publish("any", 1)
+}
@@ -5,8 +5,16 @@
 package sched
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Leosocy/IntelliProxy/config"
 	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
 
 	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
@@ -14,76 +22,525 @@ import (
 	"github.com/Leosocy/IntelliProxy/pkg/checker"
 	"github.com/Leosocy/IntelliProxy/pkg/proxy"
 	"github.com/Leosocy/IntelliProxy/pkg/spider"
+	"github.com/Leosocy/IntelliProxy/pkg/storage"
+	"github.com/Leosocy/IntelliProxy/pkg/submit"
 	"github.com/Leosocy/IntelliProxy/pkg/utils"
+	"github.com/Leosocy/IntelliProxy/pkg/webhook"
 	"github.com/Sirupsen/logrus"
 )
 
+// Topics of the pool level events, the payload is *PoolLevel.
+const (
+	TopicPoolLow       = "backend.pool.low"
+	TopicPoolRecovered = "backend.pool.recovered"
+)
+
+// Topics of the demand of crawling, the payload is *PoolLevel whose size is
+// the number of proxies matching `spider.demand.filter`.
+const (
+	TopicDemandLow       = "scheduler.demand.low"
+	TopicDemandSatisfied = "scheduler.demand.satisfied"
+)
+
+// PoolLevel is the size of pool when it crosses the water mark.
+type PoolLevel struct {
+	Size      uint
+	Threshold uint
+}
+
 // Scheduler responsible for scheduling cooperation between Spider,Checker and Backend.
 type Scheduler struct {
+	cfg              config.Provider
 	spiders          []*spider.Spider
+	defined          map[string]bool // names of the spiders defined by files
+	crawlCtx         context.Context // of the spiders started, nil if not crawling
+	spidersWg        sync.WaitGroup  // spiders started
+	spidersMu        sync.Mutex
+	definitions      *spider.DefinitionWatcher
+	pool             *spider.Pool // proxies which spiders crawl through, nil if crawling directly
+	quality          *backend.QualityWatcher
+	demanded         int32         // 1 if the proxies of quality are below the low water
+	demandCh         chan struct{} // wakes up crawling on demand
 	cachedChan       proxy.CachedChan
+	checks           sync.WaitGroup // checks in flight, see Shutdown
+	checking         sync.Map       // proxies being checked for the first time, by ip
+	prior            checker.Prior  // score of new proxies by the sources listing them
+	submitter        *submit.Submitter
 	scoreChecker     checker.Scorer
 	reqHeadersGetter utils.RequestHeadersGetter
 	geoInfoFetcher   proxy.GeoInfoFetcher
 	backend          backend.NotifyBackend
+	store            backend.Backend // wrapped by backend, closed by Shutdown
+	notifier         *pubsub.AsyncNotifier
+	sink             *webhook.Sink
+	sinkSub          *pubsub.Subscription
+	snapshotter      *backend.Snapshotter
+	evictor          *backend.Evictor
+	bus              *pubsub.Bus
 	logger           *logrus.Logger
 }
 
-// NewScheduler returns a new scheduler instance with default configuration.
-func NewScheduler() *Scheduler {
+// NewScheduler returns a new scheduler instance configured by cfg,
+// or an error if the components configured can't be created.
+func NewScheduler(cfg config.Provider) (*Scheduler, error) {
+	hosts := cfg.GetStringSlice("checker.hosts")
+	if len(hosts) == 0 {
+		hosts = checker.HostsOfBatchHTTPSScorer
+	} else if len(hosts) < 2 {
+		return nil, fmt.Errorf("checker.hosts: %d hosts, want at least 2", len(hosts))
+	}
+	geoInfoFetcher := proxy.NewGeoInfoFetcher(cfg.GetString("checker.geoip.fetcher"))
+	if geoInfoFetcher == nil {
+		return nil, fmt.Errorf("checker.geoip.fetcher: unknown fetcher %q", cfg.GetString("checker.geoip.fetcher"))
+	}
+	b, err := backend.NewBackend(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("backend: %v", err)
+	}
+	bus := pubsub.NewBus()
+	notifier := pubsub.NewAsyncNotifier()
 	sc := &Scheduler{
-		spiders:          spider.BuildAndInitAll(),
-		cachedChan:       proxy.NewBloomCachedChan(),
-		scoreChecker:     checker.NewBatchHTTPSScorer(checker.HostsOfBatchHTTPSScorer),
-		reqHeadersGetter: utils.HTTPBinUtil{Timeout: 5 * time.Second},
-		geoInfoFetcher:   proxy.NewGeoInfoFetcher(proxy.NameOfIPAPIFetcher),
-		backend:          backend.WithNotifier(backend.NewInMemoryBackend(), &pubsub.BaseNotifier{}),
+		cfg:              cfg,
+		scoreChecker:     checker.NewPublishingScorer(checker.NewBatchHTTPSScorer(hosts), bus),
+		reqHeadersGetter: utils.HTTPBinUtil{Timeout: cfg.GetDuration("checker.anonymity.timeout")},
+		geoInfoFetcher:   geoInfoFetcher,
+		backend:          backend.WithNotifier(b, notifier),
+		store:            b,
+		notifier:         notifier,
+		demandCh:         make(chan struct{}, 1),
+		bus:              bus,
 		logger:           logrus.New(),
 	}
 	sc.logger.Formatter = &logrus.TextFormatter{FullTimestamp: true}
-	return sc
+	sc.cachedChan = proxy.NewBloomCachedChan(proxy.OnDuplicate(sc.sighted),
+		proxy.Dedupe(uint64(cfg.GetInt64("scheduler.dedupe.capacity")), cfg.GetFloat64("scheduler.dedupe.false_positive")),
+		proxy.QueueSize(cfg.GetInt("scheduler.queue_size")))
+	sc.prior = checker.Prior{
+		Base:      int8(cfg.GetInt("checker.prior.base")),
+		PerSource: int8(cfg.GetInt("checker.prior.per_source")),
+	}
+	sc.submitter = submit.NewSubmitter(sc.cachedChan,
+		submit.DefaultSource(cfg.GetString("submit.default_source")),
+		submit.Trust(func(pxy *proxy.Proxy) {
+			sc.checkNew(pxy, backend.SourceSubmit, backend.ReasonSubmitted)
+		}, cfg.GetInt("submit.check_workers"), cfg.GetInt("submit.check_queue")))
+	if cfg.GetBool("spider.through_pool") {
+		sc.pool = spider.NewPool(sc.backend, cfg.GetInt("spider.pool_size"), cfg.GetInt("spider.pool_retries"))
+	}
+	sources, err := spider.SourcesFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if sc.spiders, err = spider.BuildAll(sources, sc.spiderOptions()...); err != nil {
+		return nil, err
+	}
+	sc.backend.Attach(backend.NewBusPublisher(bus))
+	lowWater := uint(cfg.GetInt("backend.low_water"))
+	sc.backend.Attach(backend.NewSizeWatcher(sc.backend, lowWater, func(size uint, below bool) {
+		topic := TopicPoolRecovered
+		if below {
+			topic = TopicPoolLow
+		}
+		bus.Publish(topic, &PoolLevel{Size: size, Threshold: lowWater})
+	}))
+	filter, err := storage.ParseQuery(cfg.GetString("spider.demand.filter"))
+	if err != nil {
+		return nil, fmt.Errorf("spider.demand.filter: %v", err)
+	}
+	sc.quality = backend.NewQualityWatcher(sc.backend, filter,
+		uint(cfg.GetInt("spider.demand.low_water")),
+		uint(cfg.GetInt("spider.demand.high_water")), sc.onDemand)
+	sc.backend.Attach(sc.quality)
+	bus.Subscribe("**", func(msg *pubsub.Message) {
+		sc.logger.Debugf("Published %s: %+v", msg.Topic, msg.Payload)
+	})
+	if sc.sink, err = webhook.NewSinkFromConfig(cfg); err != nil {
+		return nil, err
+	}
+	if sc.sink != nil {
+		sc.sinkSub = sc.sink.Subscribe(bus)
+	}
+	if path := cfg.GetString("backend.snapshot.path"); path != "" {
+		sc.snapshotter = backend.NewSnapshotter(b, path)
+	}
+	policy, err := backend.ParseEvictionPolicy(cfg.GetString("backend.eviction.policy"))
+	if err != nil {
+		return nil, fmt.Errorf("backend.eviction.policy: %v", err)
+	}
+	sc.evictor = backend.NewEvictor(sc.backend,
+		backend.WithMaxAge(cfg.GetDuration("backend.eviction.max_age")),
+		backend.WithMaxSize(uint(cfg.GetInt("backend.eviction.max_size"))),
+		backend.WithEvictionPolicy(policy))
+	sc.backend.Attach(sc.evictor)
+	if path := cfg.GetString("spider.definitions"); path != "" {
+		sc.definitions = spider.NewDefinitionWatcher(path, sc.applyDefinitions)
+		sc.definitions.Check()
+	}
+	return sc, nil
+}
+
+// spiderOptions returns the options applied to all spiders.
+func (sc *Scheduler) spiderOptions() []func(*spider.Spider) {
+	options := []func(*spider.Spider){
+		spider.PublishTo(sc.bus),
+		spider.DeadAfter(sc.cfg.GetInt("spider.dead_after")),
+		spider.ReprobeEvery(sc.cfg.GetDuration("spider.reprobe_period")),
+	}
+	if sc.pool != nil {
+		options = append(options, spider.CrawlThrough(sc.pool))
+	}
+	return options
+}
+
+// SpiderStats returns the statistics of all spiders.
+func (sc *Scheduler) SpiderStats() []spider.Stats {
+	sc.spidersMu.Lock()
+	defer sc.spidersMu.Unlock()
+	stats := make([]spider.Stats, 0, len(sc.spiders))
+	for _, s := range sc.spiders {
+		stats = append(stats, s.Stats())
+	}
+	return stats
+}
+
+// applyDefinitions creates the spiders defined, or redefines them if exist,
+// including the built-in ones. The spiders no longer defined are disabled.
+func (sc *Scheduler) applyDefinitions(defs []*spider.Definition, err error) {
+	if err != nil {
+		sc.logger.Warnf("Failed to load spider definitions, %v", err)
+		return
+	}
+	sc.spidersMu.Lock()
+	defer sc.spidersMu.Unlock()
+	defined := make(map[string]bool, len(defs))
+	for _, def := range defs {
+		defined[def.Name] = true
+		if s := sc.findSpider(def.Name); s != nil {
+			if err := s.Redefine(def); err != nil {
+				sc.logger.Warnf("Failed to redefine spider %s, %v", def.Name, err)
+			}
+			continue
+		}
+		s, err := spider.NewSpiderFromDefinition(def, sc.spiderOptions()...)
+		if err != nil {
+			sc.logger.Warnf("Failed to define spider %s, %v", def.Name, err)
+			continue
+		}
+		sc.spiders = append(sc.spiders, s)
+		if sc.crawlCtx != nil {
+			sc.startSpider(s)
+		}
+	}
+	for name := range sc.defined {
+		if s := sc.findSpider(name); s != nil && !defined[name] {
+			s.Disable()
+			sc.logger.Infof("Disabled spider %s no longer defined", name)
+		}
+	}
+	sc.defined = defined
+	sc.logger.Infof("Loaded %d spider definitions", len(defs))
+}
+
+// spiderSurvived counts a proxy found by the spider named name, which survived scoring.
+func (sc *Scheduler) spiderSurvived(name string) {
+	sc.spidersMu.Lock()
+	defer sc.spidersMu.Unlock()
+	if s := sc.findSpider(name); s != nil {
+		s.Survived()
+	}
+}
+
+// findSpider returns the spider named name, nil if not found.
+// spidersMu must be held.
+func (sc *Scheduler) findSpider(name string) *spider.Spider {
+	for _, s := range sc.spiders {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
 }
 
 func (sc *Scheduler) GetBackend() backend.NotifyBackend {
 	return sc.backend
 }
 
+// GetSubmitter returns the submitter of proxies found by other than spiders.
+func (sc *Scheduler) GetSubmitter() *submit.Submitter {
+	return sc.submitter
+}
+
+// GetBus returns the bus which all the components publish lifecycle events to.
+func (sc *Scheduler) GetBus() *pubsub.Bus {
+	return sc.bus
+}
+
 // Start open the background crawling, detection, inspection tasks,
-// and receive the agent and process.
-func (sc *Scheduler) Start() {
-	// TODO: threshold从配置中加载
-	go sc.bgCrawling(100)
-	go sc.bgDetections(15 * time.Minute)
-	go sc.bgInspection(30 * time.Minute)
-	sc.loopRecv()
+// and receive the agent and process, until ctx is done.
+// It returns after the spiders finish the pages crawling,
+// the checks in flight are waited by Shutdown.
+func (sc *Scheduler) Start(ctx context.Context) {
+	var wg sync.WaitGroup
+	run := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+	if sc.snapshotter != nil {
+		sc.restore()
+		run(func() {
+			sc.snapshotter.Run(ctx, sc.cfg.GetDuration("backend.snapshot.period"), func(err error) {
+				sc.logger.Warnf("Failed to save snapshot, %v", err)
+			})
+		})
+	}
+	run(func() { sc.evictor.Run(ctx, sc.cfg.GetDuration("backend.eviction.period")) })
+	run(func() { sc.submitter.Run(ctx) })
+	if sc.definitions != nil {
+		run(func() { sc.definitions.Run(ctx, sc.cfg.GetDuration("spider.reload_period")) })
+	}
+	if dir := sc.cfg.GetString("submit.drop_dir"); dir != "" {
+		var options []func(*submit.DropDir)
+		if sc.cfg.GetBool("submit.trust_drop_dir") {
+			options = append(options, submit.TrustFiles())
+		}
+		dropDir := submit.NewDropDir(dir, sc.submitter, options...)
+		run(func() { dropDir.Run(ctx, sc.cfg.GetDuration("submit.drop_period"), sc.logDropped) })
+	}
+	sc.bus.Publish("scheduler.start", nil)
+	crawled := make(chan struct{})
+	go func() {
+		defer close(crawled)
+		sc.bgCrawling(ctx, sc.cfg.GetDuration("spider.demand.interval"), sc.cfg.GetInt("spider.demand.batch"))
+	}()
+	run(func() { sc.bgDetections(ctx, sc.cfg.GetDuration("checker.detection_period")) })
+	run(func() { sc.bgInspection(ctx, sc.cfg.GetDuration("checker.inspection_period")) })
+	// the spiders stopping may be blocked on sending, so receives until they stop
+	sc.loopRecv(crawled)
+	wg.Wait()
+	sc.logger.Info("Scheduler stopped")
+}
+
+// track runs fn in a goroutine, which Shutdown waits for.
+func (sc *Scheduler) track(fn func()) {
+	sc.checks.Add(1)
+	go func() {
+		defer sc.checks.Done()
+		fn()
+	}()
+}
+
+// Shutdown waits for the checks in flight after Start returned, then saves
+// a snapshot, delivers the events published and closes the backend.
+// The checks and events not finished when ctx is done are abandoned,
+// and the error of ctx is returned.
+func (sc *Scheduler) Shutdown(ctx context.Context) error {
+	err := waitOrDone(ctx, sc.checks.Wait)
+	if err != nil {
+		sc.logger.Warnf("Abandoned the checks in flight, %v", err)
+	}
+	if snapErr := sc.Snapshot(); snapErr != nil {
+		sc.logger.Errorf("Failed to save snapshot, %v", snapErr)
+		err = snapErr
+	}
+	sc.bus.Publish("scheduler.stop", nil)
+	if flushErr := waitOrDone(ctx, func() {
+		sc.notifier.Flush()
+		sc.bus.Flush()
+		if sc.sink != nil {
+			sc.sinkSub.Unsubscribe()
+			sc.sink.Close()
+		}
+	}); flushErr != nil {
+		sc.logger.Warnf("Abandoned the events not delivered, %v", flushErr)
+		err = flushErr
+	}
+	if closer, ok := sc.store.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil {
+			sc.logger.Errorf("Failed to close backend, %v", closeErr)
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// waitOrDone calls wait, and returns the error of ctx if it's done before wait returns.
+func waitOrDone(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// restore loads proxies from the latest snapshot, and re-validates them
+// before inserting to backend, so the middleman never uses stale proxies.
+func (sc *Scheduler) restore() {
+	proxies, err := sc.snapshotter.Load()
+	if err != nil {
+		sc.logger.Warnf("Failed to load snapshot, %v", err)
+		return
+	}
+	sc.logger.Infof("Restored %d proxies from snapshot", len(proxies))
+	for _, pxy := range proxies {
+		pxy := pxy
+		// not counted as found by the spiders again
+		sc.track(func() { sc.inspectProxy(pxy, backend.SourceSnapshot, backend.ReasonRestored) })
+	}
+}
+
+// logDropped logs the results of proxies submitted by the file dropped in.
+func (sc *Scheduler) logDropped(file string, results []submit.Result, err error) {
+	if err != nil {
+		sc.logger.Warnf("Failed to submit proxies in %s, %v", file, err)
+		return
+	}
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	sc.logger.Infof("Submitted proxies in %s, %d accepted, %d duplicate, %d invalid", file,
+		counts[submit.StatusAccepted], counts[submit.StatusDuplicate], counts[submit.StatusInvalid])
+}
+
+// Snapshot saves a snapshot of backend if snapshot enabled.
+func (sc *Scheduler) Snapshot() error {
+	if sc.snapshotter == nil {
+		return nil
+	}
+	if err := sc.snapshotter.Save(); err != nil {
+		return err
+	}
+	sc.bus.Publish("scheduler.snapshot", nil)
+	return nil
 }
 
-func (sc *Scheduler) loopRecv() {
+// loopRecv checks the proxies received until done is closed.
+func (sc *Scheduler) loopRecv(done <-chan struct{}) {
 	recvCh := sc.cachedChan.Recv()
 	for {
 		select {
 		case pxy := <-recvCh:
-			go sc.inspectProxy(pxy)
+			sc.track(func() { sc.checkNew(pxy, backend.SourceSpider, backend.ReasonCrawled) })
+		case <-done:
+			return
 		}
 	}
 }
 
-func (sc *Scheduler) inspectProxy(pxy *proxy.Proxy) {
+// checkNew checks the proxy sent by a source, whose score starts from the prior
+// of the sources listing it, and the sources listing it while checking raise it.
+// The proxy is inserted with the source and reason if it's good.
+func (sc *Scheduler) checkNew(pxy *proxy.Proxy, source backend.Source, reason backend.Reason) {
+	if pxy.Source != "" {
+		pxy.Sight(pxy.Source, time.Now())
+	}
+	pxy.Score = sc.prior.Score(pxy.SourceCount())
+	key := pxy.IP.String()
+	if _, loaded := sc.checking.LoadOrStore(key, pxy); !loaded {
+		defer sc.checking.Delete(key)
+	}
+	sc.inspectProxy(pxy, source, reason)
+}
+
+// sightingResolution is the resolution of the last seen of sightings, the
+// proxies listed again within it are not written, which is most of re-crawls.
+const sightingResolution = time.Hour
+
+// errSightingFresh discards the write of sighting which changes nothing new.
+var errSightingFresh = errors.New("sighting is fresh")
+
+// sighted records the source listing the proxy again, which is dropped
+// by the cachedChan as a duplicate. The stored proxy is written only if
+// the source is new or its last seen is older than sightingResolution,
+// and its score, which has been measured, is not changed by the prior.
+func (sc *Scheduler) sighted(pxy *proxy.Proxy) {
+	if pxy.Source == "" {
+		return
+	}
+	at := time.Now()
+	fresh := func(stored *proxy.Proxy) bool {
+		s, found := stored.Sightings[pxy.Source]
+		return found && at.Sub(s.LastSeen) < sightingResolution
+	}
+	if stored := sc.backend.Search(pxy.IP); stored != nil && fresh(stored) {
+		return
+	}
+	_, err := sc.backend.Tag(backend.SourceSpider, backend.ReasonSighted).Modify(pxy.IP, func(stored *proxy.Proxy) error {
+		if fresh(stored) {
+			return errSightingFresh
+		}
+		stored.Sight(pxy.Source, at)
+		return nil
+	})
+	if err == backend.ErrProxyDoesNotExists {
+		if checking, ok := sc.checking.Load(pxy.IP.String()); ok {
+			sc.sight(checking.(*proxy.Proxy), pxy.Source, at)
+		}
+	}
+}
+
+// sight records the source listing the proxy being checked at the time,
+// and adds the bonus of prior to its initial score if the source is new.
+func (sc *Scheduler) sight(pxy *proxy.Proxy, source string, at time.Time) {
+	if pxy.Sight(source, at) {
+		pxy.AddScore(sc.prior.Bonus(pxy.SourceCount()))
+	}
+}
+
+// inspectProxy scores the proxy, and applies the score delta to the stored one
+// atomically, so that it won't overwrite the changes made by others meanwhile.
+// The proxy not stored is inserted with the source and reason if it's good.
+func (sc *Scheduler) inspectProxy(pxy *proxy.Proxy, source backend.Source, reason backend.Reason) {
+	before := pxy.Score
+	sightings := pxy.Clone().Sightings
 	score := sc.scoreChecker.Score(pxy)
 	entry := sc.logger.WithFields(logrus.Fields{
-		"url":   pxy.URL(),
+		"proxy": pxy.String(),
 		"score": score,
 	})
-	if score > 0 {
-		if inserted, err := sc.backend.InsertOrUpdate(pxy); err == nil {
-			action := "Updated"
-			if inserted {
-				action = "Inserted"
+	nb := sc.backend.Tag(backend.SourceChecker, backend.ReasonInspected)
+	_, err := nb.Modify(pxy.IP, func(stored *proxy.Proxy) error {
+		stored.AddScore(score - before)
+		// a proxy submitted again may renew the credentials and labels
+		if pxy.Username != "" || pxy.Password != "" {
+			stored.Username, stored.Password = pxy.Username, pxy.Password
+		}
+		for k, v := range pxy.Labels {
+			if stored.Labels == nil {
+				stored.Labels = make(map[string]string)
+			}
+			stored.Labels[k] = v
+		}
+		// the score measured is not changed by the prior
+		for source, s := range sightings {
+			stored.Sight(source, s.FirstSeen)
+			stored.Sight(source, s.LastSeen)
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+		entry.Info("Updated proxy to backend")
+	case backend.ErrProxyDoesNotExists:
+		if score > 0 {
+			if err = sc.backend.Tag(source, reason).Insert(pxy); err == nil {
+				entry.Info("Inserted proxy to backend")
+				if source == backend.SourceSpider {
+					sc.spiderSurvived(pxy.Source)
+				}
 			}
-			entry.Infof("%s proxy to backend", action)
 		}
-	} else {
-		if err := sc.backend.Delete(pxy); err == nil {
+	case backend.ErrProxyInvalid:
+		if err = nb.Delete(pxy); err == nil {
 			entry.Info("Deleted proxy from backend")
 		}
 	}
@@ -91,13 +548,17 @@ func (sc *Scheduler) inspectProxy(pxy *proxy.Proxy) {
 
 func (sc *Scheduler) completeProxy(pxy *proxy.Proxy) {
 	entry := sc.logger.WithFields(logrus.Fields{
-		"url": pxy.URL(),
+		"proxy": pxy.String(),
 	})
+	nb := sc.backend.Tag(backend.SourceChecker, backend.ReasonDetected)
 	if pxy.Anon == proxy.Unknown {
 		if err := pxy.DetectAnonymity(sc.reqHeadersGetter); err != nil {
 			entry.Warnf("Failed to detect anonymity, %v", err)
 		} else {
-			if err := sc.backend.Update(pxy); err == nil {
+			if _, err := nb.Modify(pxy.IP, func(stored *proxy.Proxy) error {
+				stored.Anon = pxy.Anon
+				return nil
+			}); err == nil {
 				entry.Info("Updated anonymity")
 			}
 		}
@@ -106,21 +567,24 @@ func (sc *Scheduler) completeProxy(pxy *proxy.Proxy) {
 		if err := pxy.DetectGeoInfo(sc.geoInfoFetcher); err != nil {
 			entry.Warnf("Failed to detect geography information, %v", err)
 		} else {
-			if err := sc.backend.Update(pxy); err == nil {
+			if _, err := nb.Modify(pxy.IP, func(stored *proxy.Proxy) error {
+				stored.GeoInfo = pxy.GeoInfo
+				return nil
+			}); err == nil {
 				entry.Infof("Updated geography information")
 			}
 		}
 	}
 }
 
-func (sc *Scheduler) bgDetections(period time.Duration) {
+func (sc *Scheduler) bgDetections(ctx context.Context, period time.Duration) {
 	ticker := time.NewTicker(period)
 	defer ticker.Stop()
 	iterDetections := func() {
 		sc.logger.Info("Start iterating the proxies and detecting anonymity/geo info")
 		sc.backend.Iter(func(pxy *proxy.Proxy) bool {
-			go sc.completeProxy(pxy)
-			return true
+			sc.track(func() { sc.completeProxy(pxy) })
+			return ctx.Err() == nil
 		})
 		sc.logger.Info("Finish iterating the proxies and detecting anonymity/geo info")
 	}
@@ -128,37 +592,118 @@ func (sc *Scheduler) bgDetections(period time.Duration) {
 		select {
 		case <-ticker.C:
 			iterDetections()
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func (sc *Scheduler) bgInspection(period time.Duration) {
+func (sc *Scheduler) bgInspection(ctx context.Context, period time.Duration) {
 	ticker := time.NewTicker(period)
 	defer ticker.Stop()
 	iterInspection := func() {
 		sc.backend.Iter(func(pxy *proxy.Proxy) bool {
-			go sc.inspectProxy(pxy)
-			return true
+			sc.track(func() { sc.inspectProxy(pxy, backend.SourceChecker, backend.ReasonInspected) })
+			return ctx.Err() == nil
 		})
 	}
 	for {
 		select {
 		case <-ticker.C:
 			iterInspection()
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-// bgCrawling when the number of proxies in backend is less than threshold, start crawling.
-func (sc *Scheduler) bgCrawling(threshold uint) {
+// bgCrawling starts the spiders, which crawl periodically, and triggers batch
+// spiders by yield every interval while the proxies of quality are in demand.
+// It returns after the spiders stop when ctx is done.
+func (sc *Scheduler) bgCrawling(ctx context.Context, interval time.Duration, batch int) {
+	sc.spidersMu.Lock()
+	sc.crawlCtx = ctx
 	for _, s := range sc.spiders {
-		go s.Start(sc.cachedChan)
+		sc.startSpider(s)
 	}
-	// TODO: ProxyCountWatcher 监测当代理个数不足阈值时调度spider开启一次爬取
+	sc.spidersMu.Unlock()
+	defer func() {
+		sc.spidersMu.Lock()
+		sc.crawlCtx = nil
+		sc.spidersMu.Unlock()
+		sc.spidersWg.Wait()
+	}()
+	sc.quality.Check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		for _, s := range sc.spiders {
-			s.TryCrawl()
+		select {
+		case <-sc.demandCh:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if atomic.LoadInt32(&sc.demanded) == 1 {
+			sc.crawlByYield(batch)
+		}
+	}
+}
+
+// startSpider starts s crawling until crawlCtx is done, spidersMu must be held.
+func (sc *Scheduler) startSpider(s *spider.Spider) {
+	ctx := sc.crawlCtx
+	sc.spidersWg.Add(1)
+	go func() {
+		defer sc.spidersWg.Done()
+		s.Start(ctx, sc.cachedChan)
+	}()
+}
+
+// onDemand is called when the number of proxies of quality drops below
+// the low water mark, or recovers to the high water mark.
+func (sc *Scheduler) onDemand(count uint, low bool) {
+	level := &PoolLevel{Size: count, Threshold: uint(sc.cfg.GetInt("spider.demand.high_water"))}
+	if low {
+		atomic.StoreInt32(&sc.demanded, 1)
+		level.Threshold = uint(sc.cfg.GetInt("spider.demand.low_water"))
+		sc.logger.Infof("Only %d proxies of quality, start crawling on demand", count)
+		sc.bus.Publish(TopicDemandLow, level)
+		select {
+		case sc.demandCh <- struct{}{}:
+		default:
+		}
+		return
+	}
+	atomic.StoreInt32(&sc.demanded, 0)
+	sc.logger.Infof("Reached %d proxies of quality, stop crawling on demand", count)
+	sc.bus.Publish(TopicDemandSatisfied, level)
+}
+
+// crawlByYield triggers at most batch idle spiders, which are enabled and
+// alive, in the descending order of their yield.
+func (sc *Scheduler) crawlByYield(batch int) {
+	sc.spidersMu.Lock()
+	type ranked struct {
+		s     *spider.Spider
+		yield float64
+	}
+	var candidates []ranked
+	for _, s := range sc.spiders {
+		if stats := s.Stats(); stats.Enabled && !stats.Dead {
+			candidates = append(candidates, ranked{s: s, yield: stats.Yield()})
+		}
+	}
+	sc.spidersMu.Unlock()
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].yield > candidates[j].yield
+	})
+	triggered := 0
+	for _, c := range candidates {
+		if triggered >= batch || atomic.LoadInt32(&sc.demanded) == 0 {
+			return
+		}
+		if c.s.TryCrawl() {
+			triggered++
 		}
-		time.Sleep(20 * time.Minute)
 	}
 }
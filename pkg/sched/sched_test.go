@@ -0,0 +1,115 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package sched
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/checker"
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
+	"github.com/Leosocy/IntelliProxy/pkg/spider"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// updateCounter counts the Update events notified.
+type updateCounter int
+
+func (c *updateCounter) Receipt(obj interface{}) {
+	if e, ok := obj.(*backend.Event); ok && e.Op == backend.Update {
+		*c++
+	}
+}
+
+func TestScheduler_Sighted(t *testing.T) {
+	var updates updateCounter
+	nb := backend.WithNotifier(backend.NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	nb.Attach(&updates)
+	sc := &Scheduler{backend: nb, prior: checker.DefaultPrior}
+	ip := net.ParseIP("1.2.3.4")
+	stored := &proxy.Proxy{IP: ip, Port: 80, Score: 60}
+	stored.Sight("xici", time.Now())
+	nb.Insert(stored)
+
+	sighted := func(source string) {
+		pxy, _ := proxy.NewProxy("1.2.3.4", "80")
+		pxy.Source = source
+		sc.sighted(pxy)
+	}
+	sighted("xici") // seen just now
+	assert.Equal(t, updateCounter(0), updates)
+	sighted("kuai") // a new source
+	assert.Equal(t, updateCounter(1), updates)
+	sighted("kuai")
+	assert.Equal(t, updateCounter(1), updates)
+	got := nb.Search(ip)
+	assert.Equal(t, []string{"kuai", "xici"}, got.Sources())
+	assert.Equal(t, int8(60), got.Score) // measured, not raised by the prior
+
+	// the proxy being checked has the bonus
+	checking, _ := proxy.NewProxy("5.6.7.8", "80")
+	checking.Sight("xici", time.Now())
+	checking.Score = sc.prior.Score(checking.SourceCount())
+	sc.checking.Store("5.6.7.8", checking)
+	before := checking.Score
+	dup, _ := proxy.NewProxy("5.6.7.8", "80")
+	dup.Source = "kuai"
+	sc.sighted(dup)
+	assert.Equal(t, before+checker.DefaultPrior.PerSource, checking.Score)
+}
+
+type fixedScorer int8
+
+func (s fixedScorer) Score(pxy *proxy.Proxy) int8 {
+	return int8(s)
+}
+
+// insertRecorder records the Insert events notified.
+type insertRecorder struct {
+	mu     sync.Mutex
+	events []*backend.Event
+}
+
+func (r *insertRecorder) Receipt(obj interface{}) {
+	if e, ok := obj.(*backend.Event); ok && e.Op == backend.Insert {
+		r.mu.Lock()
+		r.events = append(r.events, e)
+		r.mu.Unlock()
+	}
+}
+
+func TestScheduler_Restore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	saved := backend.NewInMemoryBackend()
+	pxy, _ := proxy.NewProxy("1.2.3.4", "80")
+	pxy.Score, pxy.Source = 90, "xici"
+	saved.Insert(pxy)
+	assert.Nil(t, backend.NewSnapshotter(saved, path).Save())
+
+	var inserts insertRecorder
+	nb := backend.WithNotifier(backend.NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	nb.Attach(&inserts)
+	xici := spider.NewSpider("xici", nil)
+	sc := &Scheduler{
+		backend:      nb,
+		scoreChecker: fixedScorer(80),
+		snapshotter:  backend.NewSnapshotter(nb, path),
+		spiders:      []*spider.Spider{xici},
+		logger:       logrus.New(),
+	}
+	sc.restore()
+	sc.checks.Wait()
+	if assert.Len(t, inserts.events, 1) {
+		assert.Equal(t, backend.SourceSnapshot, inserts.events[0].Source)
+		assert.Equal(t, backend.ReasonRestored, inserts.events[0].Reason)
+	}
+	assert.Equal(t, uint64(0), xici.Stats().Survived)
+}
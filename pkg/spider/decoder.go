@@ -0,0 +1,239 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/antchfx/htmlquery"
+	"github.com/gocolly/colly"
+	"golang.org/x/net/html"
+	"gopkg.in/yaml.v3"
+)
+
+// Decoder decodes a value extracted from a record, e.g. an obfuscated port.
+type Decoder interface {
+	Decode(value string) (string, error)
+}
+
+// DecoderFunc is an adapter to use a function as Decoder.
+type DecoderFunc func(value string) (string, error)
+
+// Decode implements the Decoder interface.
+func (f DecoderFunc) Decode(value string) (string, error) {
+	return f(value)
+}
+
+// DecoderFactory returns a decoder configured by the options.
+type DecoderFactory func(options map[string]string) (Decoder, error)
+
+type decoderEntry struct {
+	html    bool
+	factory DecoderFactory
+}
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = make(map[string]decoderEntry)
+)
+
+// RegisterDecoder registers the decoder factory by name, which is used in the
+// decoders of extractors. A decoder decodes the HTML of the child element if
+// html is true, and the text otherwise; the HTML decoders of an extractor
+// must precede the text ones, and the HTML decoded is converted to text then.
+func RegisterDecoder(name string, html bool, factory DecoderFactory) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[name] = decoderEntry{html: html, factory: factory}
+}
+
+// Builtin decoders.
+const (
+	DecoderStripHidden = "strip_hidden"
+	DecoderCSSDigits   = "css_digits"
+	DecoderBase64      = "base64"
+	DecoderHex         = "hex"
+	DecoderJS          = "js"
+)
+
+func init() {
+	RegisterDecoder(DecoderStripHidden, true, newStripHiddenDecoder)
+	RegisterDecoder(DecoderCSSDigits, true, newCSSDigitsDecoder)
+	RegisterDecoder(DecoderBase64, false, func(map[string]string) (Decoder, error) {
+		return DecoderFunc(decodeBase64), nil
+	})
+	RegisterDecoder(DecoderHex, false, newHexDecoder)
+	RegisterDecoder(DecoderJS, false, func(map[string]string) (Decoder, error) {
+		return DecoderFunc(evalJS), nil
+	})
+}
+
+// DecoderDefinition declares a decoder of an extractor. It is either the name
+// of decoder, or a mapping of the name and options, e.g.
+//
+//	port:
+//	  path: td[2]
+//	  decoders:
+//	    - strip_hidden
+//	    - name: css_digits
+//	      options: {r0: 0, r1: 1, r8: 8}
+type DecoderDefinition struct {
+	Name    string            `yaml:"name"`
+	Options map[string]string `yaml:"options"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, so that a decoder can be a name only.
+func (dd *DecoderDefinition) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&dd.Name)
+	}
+	type plain DecoderDefinition
+	return node.Decode((*plain)(dd))
+}
+
+// NewDecoder returns the decoder registered by name, configured by options,
+// and whether it decodes HTML.
+func NewDecoder(name string, options map[string]string) (d Decoder, html bool, err error) {
+	decodersMu.RLock()
+	entry, found := decoders[name]
+	decodersMu.RUnlock()
+	if !found {
+		return nil, false, fmt.Errorf("unknown decoder %q", name)
+	}
+	d, err = entry.factory(options)
+	return d, entry.html, err
+}
+
+// childHTML returns the outer HTML of the first child element of e found by path.
+func childHTML(e Element, path string) string {
+	switch e := e.(type) {
+	case *colly.HTMLElement:
+		outer, _ := goquery.OuterHtml(e.DOM.Find(path).First())
+		return outer
+	case *colly.XMLElement:
+		node, ok := e.DOM.(*html.Node)
+		if !ok {
+			return ""
+		}
+		if child := htmlquery.FindOne(node, path); child != nil {
+			return htmlquery.OutputHTML(child, true)
+		}
+	}
+	return ""
+}
+
+// parseFragment parses the HTML fragment, whose nodes are children of the body.
+func parseFragment(fragment string) (*goquery.Selection, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(fragment))
+	if err != nil {
+		return nil, err
+	}
+	return doc.Find("body"), nil
+}
+
+// htmlText returns the text of the HTML fragment.
+func htmlText(fragment string) string {
+	body, err := parseFragment(fragment)
+	if err != nil {
+		return ""
+	}
+	return body.Text()
+}
+
+// hiddenStyles are the inline styles of the decoy elements.
+var hiddenStyles = []string{"display:none", "visibility:hidden"}
+
+// newStripHiddenDecoder returns the decoder removing the decoy elements hidden
+// by inline styles, or by the classes in the comma-separated option classes.
+func newStripHiddenDecoder(options map[string]string) (Decoder, error) {
+	var classes []string
+	for _, class := range strings.Split(options["classes"], ",") {
+		if class = strings.TrimSpace(class); class != "" {
+			classes = append(classes, class)
+		}
+	}
+	return DecoderFunc(func(value string) (string, error) {
+		body, err := parseFragment(value)
+		if err != nil {
+			return "", err
+		}
+		body.Find("*").Each(func(_ int, s *goquery.Selection) {
+			style := strings.ToLower(strings.ReplaceAll(s.AttrOr("style", ""), " ", ""))
+			hidden := false
+			for _, hs := range hiddenStyles {
+				hidden = hidden || strings.Contains(style, hs)
+			}
+			for _, class := range classes {
+				hidden = hidden || s.HasClass(class)
+			}
+			if hidden {
+				s.Remove()
+			}
+		})
+		return body.Html()
+	}), nil
+}
+
+// newCSSDigitsDecoder returns the decoder of the digits rendered by CSS classes,
+// e.g. `.r8:after { content: "8" }`. The options map the classes to the digits,
+// which are concatenated in document order of the elements.
+func newCSSDigitsDecoder(options map[string]string) (Decoder, error) {
+	if len(options) == 0 {
+		return nil, fmt.Errorf("options mapping classes to digits are required")
+	}
+	return DecoderFunc(func(value string) (string, error) {
+		body, err := parseFragment(value)
+		if err != nil {
+			return "", err
+		}
+		var digits strings.Builder
+		body.Find("*").Each(func(_ int, s *goquery.Selection) {
+			for _, class := range strings.Fields(s.AttrOr("class", "")) {
+				digits.WriteString(options[class])
+			}
+		})
+		return digits.String(), nil
+	}), nil
+}
+
+// decodeBase64 decodes the value in standard or url base64, padded or not.
+func decodeBase64(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		var decoded []byte
+		if decoded, err = enc.DecodeString(value); err == nil {
+			return string(decoded), nil
+		}
+	}
+	return "", err
+}
+
+// newHexDecoder returns the decoder of hex encoded strings, or of hex numbers
+// into decimal if the option number is true, e.g. 1F90 into 8080.
+func newHexDecoder(options map[string]string) (Decoder, error) {
+	number := false
+	if opt, found := options["number"]; found {
+		var err error
+		if number, err = strconv.ParseBool(opt); err != nil {
+			return nil, fmt.Errorf("invalid option number %q", opt)
+		}
+	}
+	return DecoderFunc(func(value string) (string, error) {
+		value = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(value), "0x"), "0X")
+		if number {
+			n, err := strconv.ParseUint(value, 16, 64)
+			return strconv.FormatUint(n, 10), err
+		}
+		decoded, err := hex.DecodeString(value)
+		return string(decoded), err
+	}), nil
+}
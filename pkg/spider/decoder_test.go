@@ -0,0 +1,183 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fixtureURL returns the file:// url of the saved page in testdata.
+func fixtureURL(t *testing.T, name string) string {
+	path, err := filepath.Abs(filepath.Join("testdata", name))
+	assert.Nil(t, err)
+	return "file://" + filepath.ToSlash(path)
+}
+
+func TestDecoders(t *testing.T) {
+	testCases := []struct {
+		fixture string
+		parser  string
+		expect  []string
+	}{
+		{
+			fixture: "strip_hidden.html",
+			parser: `
+    query: //table[@id="list"]//tr
+    ip:
+      path: td[@class="ip"]
+      decoders:
+        - name: strip_hidden
+          options: {classes: decoy}
+    port: td[@class="port"]`,
+			expect: []string{"http http://1.2.3.4:8080", "http http://5.6.7.8:3128"},
+		},
+		{
+			fixture: "css_digits.html",
+			parser: `
+    selector: css
+    query: '#list tr'
+    ip: td.ip
+    port:
+      path: td.port
+      decoders:
+        - name: css_digits
+          options: {r0: 0, r1: 1, r2: 2, r3: 3, r8: 8}`,
+			expect: []string{"http http://1.2.3.4:8080", "http http://5.6.7.8:3128"},
+		},
+		{
+			fixture: "base64.html",
+			parser: `
+    query: //table[@id="list"]//tr
+    ip:
+      path: td[@class="ip"]
+      attr: data-ip
+      decoders: [base64]
+    port:
+      path: td[@class="port"]
+      decoders: [base64]`,
+			expect: []string{"http http://1.2.3.4:8080", "http http://5.6.7.8:3128"},
+		},
+		{
+			fixture: "hex.html",
+			parser: `
+    query: //table[@id="list"]//tr
+    ip:
+      path: td[@class="ip"]
+      decoders: [hex]
+    port:
+      path: td[@class="port"]
+      decoders:
+        - name: hex
+          options: {number: true}`,
+			expect: []string{"http http://1.2.3.4:8080", "http http://5.6.7.8:3128"},
+		},
+		{
+			fixture: "js.html",
+			parser: `
+    query: //table[@id="list"]//tr
+    ip:
+      path: td[@class="ip"]/script
+      decoders: [js]
+    port:
+      path: td[@class="port"]/script
+      decoders: [js]`,
+			expect: []string{"http http://1.2.3.4:7080", "http http://5.6.7.8:3128", "http http://9.9.9.9:8080"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.fixture, func(t *testing.T) {
+			records := crawlDefinition(t, fmt.Sprintf(`
+- name: decoders
+  urls: [%s]
+  limit: {parallelism: 1}
+  parser:
+    default_protocol: http%s`, fixtureURL(t, filepath.Join("decoders", tc.fixture)), tc.parser))
+			assert.Equal(t, tc.expect, records)
+		})
+	}
+}
+
+func TestInvalidDecoders(t *testing.T) {
+	testCases := map[string]string{
+		"unknown decoder":        `ip: {path: td[1], decoders: [rot13]}`,
+		"html decoder of attr":   `ip: {path: td[1], attr: title, decoders: [strip_hidden]}`,
+		"html after text":        `ip: {path: td[1], decoders: [base64, strip_hidden]}`,
+		"css digits no mappings": `ip: {path: td[1], decoders: [css_digits]}`,
+		"invalid option":         `ip: {path: td[1], decoders: [{name: hex, options: {number: maybe}}]}`,
+	}
+	for name, ip := range testCases {
+		_, err := ParseDefinitions([]byte(fmt.Sprintf(`
+- name: invalid
+  urls: [http://localhost]
+  parser:
+    query: //tr
+    port: td[2]
+    %s`, ip)))
+		assert.NotNil(t, err, name)
+	}
+	_, err := ParseDefinitions([]byte(`
+- name: json
+  kind: json
+  urls: [http://localhost]
+  parser:
+    ip: {path: ip, decoders: [strip_hidden]}
+    port: {path: port, decoders: [base64]}`))
+	assert.NotNil(t, err)
+}
+
+func TestEvalJS(t *testing.T) {
+	testCases := []struct {
+		script string
+		expect string
+		err    bool
+	}{
+		{script: `1 + 2 * 3`, expect: "7"},
+		{script: `"80" + 80`, expect: "8080"},
+		{script: `(0x1F90 ^ 0xFF) ^ 255`, expect: "8080"},
+		{script: `1 << 4 | 1`, expect: "17"},
+		{script: `-~3 + 7 % 4`, expect: "7"},
+		{script: `10 / 4`, expect: "2.5"},
+		{script: `var a = 'x\x41B'; a`, expect: "xAB"},
+		{script: `document.write(1); document.write(":", 2)`, expect: "1:2"},
+		{script: `parseInt("1f90", 16)`, expect: "8080"},
+		{script: `parseInt("abc")`, expect: "NaN"},
+		{script: `undefinedVar + 1`, err: true},
+		{script: `window.location = "x"`, err: true},
+		{script: `fetch("http://evil")`, err: true},
+		{script: `(1 + 2`, err: true},
+		{script: `"unterminated`, err: true},
+		{script: `while (1) {}`, err: true},
+	}
+	for _, tc := range testCases {
+		out, err := evalJS(tc.script)
+		if tc.err {
+			assert.NotNil(t, err, tc.script)
+		} else if assert.Nil(t, err, tc.script) {
+			assert.Equal(t, tc.expect, out, tc.script)
+		}
+	}
+}
+
+func TestEvalJS_Limits(t *testing.T) {
+	// 16 bytes doubled 12 times is the 64KiB limit
+	doubled := `var a = "0123456789abcdef";` + strings.Repeat(`a = a + a;`, 12)
+	out, err := evalJS(doubled + `a`)
+	if assert.Nil(t, err) {
+		assert.Len(t, out, maxJSString)
+	}
+	_, err = evalJS(doubled + `a = a + a`)
+	assert.NotNil(t, err)
+	_, err = evalJS(doubled + `a + 1`)
+	assert.NotNil(t, err)
+	_, err = evalJS(doubled + `document.write(a); document.write("x")`)
+	assert.NotNil(t, err)
+	_, err = evalJS(`var a = "` + strings.Repeat("x", 2048) + `";` + strings.Repeat(`document.write(a, a);`, 20))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,507 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/andybalholm/cascadia"
+	"github.com/antchfx/xpath"
+	"github.com/gocolly/colly"
+	"gopkg.in/yaml.v3"
+)
+
+// Selectors of the queries in a definition.
+const (
+	SelectorXPath = "xpath"
+	SelectorCSS   = "css"
+)
+
+// Kinds of the sources.
+const (
+	KindHTML = "html" // tables in HTML pages, parsed by xpath or css selector
+	KindJSON = "json" // JSON APIs, parsed by gjson paths
+	KindText = "text" // plain text lists, parsed by regex
+)
+
+// Definition declares a spider which crawls the proxies listed in HTML pages, e.g.
+//
+//	# spiders.yml
+//	- name: xici
+//	  urls:
+//	    - https://www.xicidaili.com/{nn, nt}/{1...5}
+//	  parser:
+//	    query: //*[@id="ip_list"]/tbody/tr
+//	    ip: td[2]
+//	    port: td[3]
+//	    protocol: td[6]
+//	  limit:
+//	    delay: 10s
+//	  period: 30m
+//	  cool_down: 10s
+//
+// The url is a template, where `{a, b}` is expanded to each of the parameters,
+// and `{1...5}` to each of the pages in the range. Local files are crawled by
+// file:// urls, e.g. file:///var/lib/proxies/list.txt.
+//
+// The sources of other kinds are parsed as ParserDefinition describes, e.g.
+//
+//	# spiders.yml
+//	- name: geonode
+//	  kind: json
+//	  urls:
+//	    - https://proxylist.geonode.com/api/proxy-list?limit=500&page={1...3}
+//	  parser:
+//	    query: data
+//	    ip: ip
+//	    port: port
+//	    protocol: protocols.0
+//	- name: github-socks5
+//	  kind: text
+//	  urls:
+//	    - https://raw.githubusercontent.com/TheSpeedX/PROXY-List/master/socks5.txt
+//	  parser:
+//	    default_protocol: socks5
+type Definition struct {
+	Name string `yaml:"name"`
+	// Kind is the kind of source, html, json or text, default is html.
+	Kind string `yaml:"kind"`
+	// Enable is true if omitted.
+	Enable *bool            `yaml:"enable"`
+	URLs   []string         `yaml:"urls"`
+	Parser ParserDefinition `yaml:"parser"`
+	Limit  *LimitDefinition `yaml:"limit"`
+	// Pagination discovers the pages from the urls if set, which may
+	// have PagePlaceholder to increment the page number.
+	Pagination *Pagination   `yaml:"pagination"`
+	Period     time.Duration `yaml:"period"`
+	CoolDown   time.Duration `yaml:"cool_down"`
+}
+
+// ParserDefinition declares how to find the records and parse the fields of them.
+//
+// For html sources, Query is the xpath or css selector of the records, e.g. the
+// rows of a table, and the paths of fields are relative to the record.
+// For json sources, Query is the gjson path of the array of records, empty
+// means the whole document, and the paths of fields are relative to the record.
+// For text sources, Query is the regex matching the records, whose named
+// groups are the fields: ip, port, protocol, username and password. The
+// default regex matches the lines like `[protocol://][username:password@]ip:port`,
+// and the extractors of fields are ignored.
+type ParserDefinition struct {
+	// Selector is the language of queries of html sources, xpath or css, default is xpath.
+	Selector string `yaml:"selector"`
+	Query    string `yaml:"query"`
+	// DefaultProtocol is the protocol of records whose protocol is unknown.
+	DefaultProtocol string    `yaml:"default_protocol"`
+	IP              Extractor `yaml:"ip"`
+	Port            Extractor `yaml:"port"`
+	Protocol        Extractor `yaml:"protocol"`
+	Username        Extractor `yaml:"username"`
+	Password        Extractor `yaml:"password"`
+}
+
+// extractors returns the extractors of fields by name.
+func (pd *ParserDefinition) extractors() map[string]*Extractor {
+	return map[string]*Extractor{
+		"ip":       &pd.IP,
+		"port":     &pd.Port,
+		"protocol": &pd.Protocol,
+		"username": &pd.Username,
+		"password": &pd.Password,
+	}
+}
+
+// complete fills the fields of rec with the defaults.
+func (pd *ParserDefinition) complete(rec Record) Record {
+	if rec.Protocol == "" {
+		rec.Protocol = proxy.ParseProtocol(pd.DefaultProtocol)
+	}
+	return rec
+}
+
+// Extractor extracts a field from a record. It is either a query relative to
+// the record, or a mapping, e.g.
+//
+//	ip:
+//	  path: td[1]
+//	  regex: '^([\d.]+):\d+$'
+//
+// The decoders decode the obfuscated values in order before the regex, see DecoderDefinition.
+type Extractor struct {
+	// Path is the query of the child element relative to the record.
+	Path string `yaml:"path"`
+	// Attr is the attribute extracted, the text is extracted if empty.
+	Attr string `yaml:"attr"`
+	// Regex post-processes the extracted value, the first group is kept if any,
+	// otherwise the whole match. The field is empty if not matched.
+	Regex    string              `yaml:"regex"`
+	Decoders []DecoderDefinition `yaml:"decoders"`
+
+	re *regexp.Regexp
+	// htmlDecoders decode the HTML of child element, and textDecoders the text.
+	htmlDecoders []Decoder
+	textDecoders []Decoder
+}
+
+// LimitDefinition declares the colly.LimitRule of a spider.
+type LimitDefinition struct {
+	Parallelism int           `yaml:"parallelism"`
+	Delay       time.Duration `yaml:"delay"`
+	RandomDelay time.Duration `yaml:"random_delay"`
+}
+
+// rule returns the colly.LimitRule of all domains.
+func (ld *LimitDefinition) rule() *colly.LimitRule {
+	return &colly.LimitRule{
+		DomainGlob:  "*",
+		Parallelism: ld.Parallelism,
+		Delay:       ld.Delay,
+		RandomDelay: ld.RandomDelay,
+	}
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, so that an extractor can be a query only.
+func (x *Extractor) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&x.Path)
+	}
+	type plain Extractor
+	return node.Decode((*plain)(x))
+}
+
+// extract returns the field of record e.
+func (x *Extractor) extract(e Element) string {
+	if x.Path == "" {
+		return ""
+	}
+	var value string
+	switch {
+	case len(x.htmlDecoders) > 0:
+		value = childHTML(e, x.Path)
+		for _, d := range x.htmlDecoders {
+			var err error
+			if value, err = d.Decode(value); err != nil {
+				return ""
+			}
+		}
+		value = htmlText(value)
+	case x.Attr != "":
+		value = e.ChildAttr(x.Path, x.Attr)
+	default:
+		value = e.ChildText(x.Path)
+	}
+	return x.post(value)
+}
+
+// post post-processes the extracted value by the text decoders and regex.
+func (x *Extractor) post(value string) string {
+	for _, d := range x.textDecoders {
+		var err error
+		if value, err = d.Decode(strings.TrimSpace(value)); err != nil {
+			return ""
+		}
+	}
+	value = strings.TrimSpace(value)
+	if x.re == nil {
+		return value
+	}
+	match := x.re.FindStringSubmatch(value)
+	switch len(match) {
+	case 0:
+		return ""
+	case 1:
+		return match[0]
+	default:
+		return match[1]
+	}
+}
+
+// compile checks the path with compileQuery if not nil, and compiles the regex
+// and decoders. The HTML decoders are only allowed if compileQuery is not nil,
+// i.e. of html sources.
+func (x *Extractor) compile(field string, compileQuery func(string) error) error {
+	if x.Path != "" && compileQuery != nil {
+		if err := compileQuery(x.Path); err != nil {
+			return fmt.Errorf("invalid %s path %q, %v", field, x.Path, err)
+		}
+	}
+	x.htmlDecoders, x.textDecoders = nil, nil
+	for _, dd := range x.Decoders {
+		d, html, err := NewDecoder(dd.Name, dd.Options)
+		switch {
+		case err != nil:
+			return fmt.Errorf("invalid %s decoder, %v", field, err)
+		case html && (compileQuery == nil || x.Attr != ""):
+			return fmt.Errorf("%s decoder %s only decodes the html of elements", field, dd.Name)
+		case html && len(x.textDecoders) > 0:
+			return fmt.Errorf("%s decoder %s must precede the text decoders", field, dd.Name)
+		case html:
+			x.htmlDecoders = append(x.htmlDecoders, d)
+		default:
+			x.textDecoders = append(x.textDecoders, d)
+		}
+	}
+	if x.Regex != "" {
+		re, err := regexp.Compile(x.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid %s regex, %v", field, err)
+		}
+		x.re = re
+	}
+	return nil
+}
+
+// Enabled reports whether the spider is enabled.
+func (d *Definition) Enabled() bool {
+	return d.Enable == nil || *d.Enable
+}
+
+// compile validates the definition, and returns the parser.
+func (d *Definition) compile() (SourceParser, error) {
+	if d.Name == "" {
+		return nil, fmt.Errorf("spider name is required")
+	}
+	var urls []string
+	for _, tmpl := range d.URLs {
+		expanded, err := expandURL(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("spider %s: %v", d.Name, err)
+		}
+		urls = append(urls, expanded...)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("spider %s: urls are required", d.Name)
+	}
+	if d.Parser.DefaultProtocol != "" && proxy.ParseProtocol(d.Parser.DefaultProtocol) == "" {
+		return nil, fmt.Errorf("spider %s: unknown default protocol %q", d.Name, d.Parser.DefaultProtocol)
+	}
+	var (
+		parser SourceParser
+		err    error
+	)
+	switch d.Kind {
+	case "", KindHTML:
+		parser, err = newHTMLParser(urls, d.Parser)
+	case KindJSON:
+		parser, err = newJSONParser(urls, d.Parser)
+	case KindText:
+		parser, err = newTextParser(urls, d.Parser)
+	default:
+		err = fmt.Errorf("unknown kind %q", d.Kind)
+	}
+	if err == nil {
+		err = d.checkPagination(urls)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("spider %s: %v", d.Name, err)
+	}
+	return parser, nil
+}
+
+// checkPagination checks the pagination, and the page placeholder in urls.
+func (d *Definition) checkPagination(urls []string) error {
+	incremental := d.Pagination != nil && d.Pagination.Next == ""
+	for _, url := range urls {
+		if strings.Contains(url, PagePlaceholder) && !incremental {
+			return fmt.Errorf("%s in url %q requires pagination without next", PagePlaceholder, url)
+		}
+	}
+	if d.Pagination == nil || d.Pagination.Next == "" {
+		return nil
+	}
+	if d.Kind != "" && d.Kind != KindHTML {
+		return fmt.Errorf("next link of pagination requires html source")
+	}
+	var err error
+	if d.Parser.Selector == SelectorCSS {
+		_, err = cascadia.Compile(d.Pagination.Next)
+	} else {
+		_, err = xpath.Compile(d.Pagination.Next)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid next of pagination %q, %v", d.Pagination.Next, err)
+	}
+	return nil
+}
+
+// options returns the options configured by definition, with defaults if omitted.
+func (d *Definition) options() []func(*Spider) {
+	lr := defaultLimitRule
+	if d.Limit != nil {
+		lr = d.Limit.rule()
+	}
+	period, coolDown := defaultPeriod, defaultCoolDown
+	if d.Period > 0 {
+		period = d.Period
+	}
+	if d.CoolDown > 0 {
+		coolDown = d.CoolDown
+	}
+	options := []func(*Spider){Limit(lr), Period(period), CoolDownTime(coolDown)}
+	if d.Pagination != nil {
+		options = append(options, Paginate(*d.Pagination))
+	}
+	return options
+}
+
+// urlRange matches the page range in url template, e.g. `1...10`.
+var urlRange = regexp.MustCompile(`^\s*(\d+)\s*\.\.\.\s*(\d+)\s*$`)
+
+// expandURL returns the urls expanded from the template, see Definition.
+func expandURL(tmpl string) ([]string, error) {
+	start := strings.IndexByte(tmpl, '{')
+	if start < 0 {
+		if strings.IndexByte(tmpl, '}') >= 0 {
+			return nil, fmt.Errorf("unbalanced braces in url %q", tmpl)
+		}
+		return []string{tmpl}, nil
+	}
+	end := strings.IndexByte(tmpl[start:], '}')
+	if end < 0 {
+		return nil, fmt.Errorf("unbalanced braces in url %q", tmpl)
+	}
+	end += start
+	var values []string
+	if tmpl[start:end+1] == PagePlaceholder {
+		values = []string{PagePlaceholder}
+	} else if m := urlRange.FindStringSubmatch(tmpl[start+1 : end]); m != nil {
+		from, _ := strconv.Atoi(m[1])
+		to, _ := strconv.Atoi(m[2])
+		if from > to {
+			return nil, fmt.Errorf("invalid range {%s} in url %q", tmpl[start+1:end], tmpl)
+		}
+		for i := from; i <= to; i++ {
+			values = append(values, strconv.Itoa(i))
+		}
+	} else {
+		for _, v := range strings.Split(tmpl[start+1:end], ",") {
+			values = append(values, strings.TrimSpace(v))
+		}
+	}
+	rests, err := expandURL(tmpl[end+1:])
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, 0, len(values)*len(rests))
+	for _, v := range values {
+		for _, rest := range rests {
+			urls = append(urls, tmpl[:start]+v+rest)
+		}
+	}
+	return urls, nil
+}
+
+// ParseDefinitions parses the YAML list of definitions, and validates them.
+func ParseDefinitions(data []byte) ([]*Definition, error) {
+	var defs []*Definition
+	if err := yaml.Unmarshal(data, &defs); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(defs))
+	for _, d := range defs {
+		if _, err := d.compile(); err != nil {
+			return nil, err
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("spider %s is defined more than once", d.Name)
+		}
+		names[d.Name] = true
+	}
+	return defs, nil
+}
+
+// definitionFiles returns the files of definitions in path, which is
+// either a file, or a directory of *.yml and *.yaml files.
+func definitionFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		matches, _ := filepath.Glob(filepath.Join(path, pattern))
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// LoadDefinitions loads the definitions from path, which is either a file,
+// or a directory of *.yml and *.yaml files. A spider must not be defined more than once.
+func LoadDefinitions(path string) ([]*Definition, error) {
+	files, err := definitionFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var defs []*Definition
+	names := make(map[string]string)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := ParseDefinitions(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		for _, d := range parsed {
+			if prev, found := names[d.Name]; found {
+				return nil, fmt.Errorf("%s: spider %s is already defined in %s", file, d.Name, prev)
+			}
+			names[d.Name] = file
+		}
+		defs = append(defs, parsed...)
+	}
+	return defs, nil
+}
+
+// NewSpiderFromDefinition creates a new Spider by definition,
+// options are applied after the ones of definition.
+func NewSpiderFromDefinition(def *Definition, options ...func(*Spider)) (*Spider, error) {
+	parser, err := def.compile()
+	if err != nil {
+		return nil, err
+	}
+	s := newSpider(def.Name, parser, append(def.options(), options...)...)
+	if !def.Enabled() {
+		s.Disable()
+	}
+	return s, nil
+}
+
+// Redefine replaces the parser and configurations of the spider with def,
+// which takes effect from the next crawling. The spider is enabled or
+// disabled as def declares, and the name of def is ignored.
+func (s *Spider) Redefine(def *Definition) error {
+	parser, err := def.compile()
+	if err != nil {
+		return err
+	}
+	ns := &Spider{name: s.name, parser: parser, pool: s.pool}
+	ns.init()
+	for _, opt := range def.options() {
+		opt(ns)
+	}
+	ns.applyLimit()
+	s.redefine(ns)
+	if def.Enabled() {
+		s.Enable()
+	} else {
+		s.Disable()
+	}
+	return nil
+}
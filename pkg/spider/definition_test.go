@@ -0,0 +1,214 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingChan is a proxy.CachedChan recording the proxies sent.
+type recordingChan struct {
+	mu         sync.Mutex
+	proxies    []*proxy.Proxy
+	duplicates bool // whether the duplicates are sent
+}
+
+func (rc *recordingChan) Send(ip, port string) {
+	if pxy, err := proxy.NewProxy(ip, port); err == nil {
+		rc.SendProxy(pxy)
+	}
+}
+
+func (rc *recordingChan) SendProxy(pxy *proxy.Proxy) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, sent := range rc.proxies {
+		if sent.IP.Equal(pxy.IP) && !rc.duplicates {
+			return false
+		}
+	}
+	rc.proxies = append(rc.proxies, pxy)
+	return true
+}
+
+func (rc *recordingChan) Recv() <-chan *proxy.Proxy {
+	return nil
+}
+
+func (rc *recordingChan) records() (records []string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, pxy := range rc.proxies {
+		records = append(records, fmt.Sprintf("%s %s:%d", pxy.Protocol, pxy.IP, pxy.Port))
+	}
+	return
+}
+
+const proxyListPage = `<html><body><table id="list"><tbody>
+<tr><th>IP</th><th>PORT</th><th>TYPE</th></tr>
+<tr><td>1.2.3.4</td><td>80</td><td>HTTP</td></tr>
+<tr><td>5.6.7.8</td><td>1080</td><td>SOCKS5</td></tr>
+<tr><td>9.9.9.9:3128</td><td></td><td>https</td></tr>
+</tbody></table></body></html>`
+
+func TestExpandURL(t *testing.T) {
+	urls, err := expandURL("http://a.com/{nn, nt}/{1...3}.html")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"http://a.com/nn/1.html", "http://a.com/nn/2.html", "http://a.com/nn/3.html",
+		"http://a.com/nt/1.html", "http://a.com/nt/2.html", "http://a.com/nt/3.html",
+	}, urls)
+	urls, err = expandURL("http://a.com/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http://a.com/"}, urls)
+	for _, tmpl := range []string{"http://a.com/{1...3", "http://a.com/1}", "http://a.com/{3...1}"} {
+		_, err = expandURL(tmpl)
+		assert.NotNil(t, err, tmpl)
+	}
+}
+
+func TestParseDefinitions(t *testing.T) {
+	defs, err := ParseDefinitions([]byte(`
+- name: demo
+  enable: false
+  urls: ['http://a.com/{1...2}']
+  parser:
+    query: //tr
+    ip: td[1]
+    port: {path: 'td[1]', regex: ':(\d+)$'}
+  limit: {parallelism: 2, delay: 3s}
+  period: 1h
+`))
+	assert.Nil(t, err)
+	assert.Len(t, defs, 1)
+	assert.False(t, defs[0].Enabled())
+	assert.Equal(t, "td[1]", defs[0].Parser.IP.Path)
+	assert.Equal(t, `:(\d+)$`, defs[0].Parser.Port.Regex)
+	assert.Equal(t, 3*time.Second, defs[0].Limit.Delay)
+	assert.Equal(t, time.Hour, defs[0].Period)
+
+	for _, data := range []string{
+		`- {urls: [http://a.com], parser: {query: //tr, ip: 'td[1]', port: 'td[2]'}}`,
+		`- {name: demo, parser: {query: //tr, ip: 'td[1]', port: 'td[2]'}}`,
+		`- {name: demo, urls: [http://a.com], parser: {query: //tr, ip: 'td[1]'}}`,
+		`- {name: demo, urls: [http://a.com], parser: {query: "//tr[", ip: 'td[1]', port: 'td[2]'}}`,
+		`- {name: demo, urls: [http://a.com], parser: {selector: css, query: "tr >", ip: td, port: td}}`,
+		`- {name: demo, urls: [http://a.com], parser: {selector: regex, query: //tr, ip: 'td[1]', port: 'td[2]'}}`,
+		`- {name: demo, urls: [http://a.com], parser: {query: //tr, ip: {path: 'td[1]', regex: "("}, port: 'td[2]'}}`,
+		"- {name: demo, urls: [http://a.com], parser: {query: //tr, ip: 'td[1]', port: 'td[2]'}}\n" +
+			"- {name: demo, urls: [http://b.com], parser: {query: //tr, ip: 'td[1]', port: 'td[2]'}}",
+	} {
+		_, err = ParseDefinitions([]byte(data))
+		assert.NotNil(t, err, data)
+	}
+}
+
+func TestLoadDefinitions(t *testing.T) {
+	defs, err := LoadDefinitions("../../config/spiders.yml")
+	assert.Nil(t, err)
+	assert.Len(t, defs, 5)
+
+	dir := t.TempDir()
+	data := `- {name: demo, urls: [http://a.com], parser: {query: //tr, ip: 'td[1]', port: 'td[2]'}}`
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.yml"), []byte(data), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "b.yaml"), []byte(data), 0644))
+	_, err = LoadDefinitions(dir)
+	assert.Contains(t, err.Error(), "already defined")
+}
+
+func TestDefinitionSpider(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, proxyListPage)
+	}))
+	defer ts.Close()
+
+	for _, data := range []string{`
+- name: demo
+  urls: ['%s/{1...2}']
+  parser:
+    query: //table[@id="list"]/tbody/tr[position()>1]
+    ip: {path: 'td[1]', regex: '^([\d.]+)'}
+    port: 'td[2]'
+    protocol: 'td[3]'
+  limit: {parallelism: 1}
+`, `
+- name: demo
+  urls: ['%s/{1...2}']
+  parser:
+    selector: css
+    query: "#list tr:not(:first-child)"
+    ip: {path: td:nth-child(1), regex: '^([\d.]+)'}
+    port: td:nth-child(2)
+    protocol: td:nth-child(3)
+  limit: {parallelism: 1}
+`} {
+		defs, err := ParseDefinitions([]byte(fmt.Sprintf(data, ts.URL)))
+		assert.Nil(t, err)
+		s, err := NewSpiderFromDefinition(defs[0], CoolDownTime(0))
+		assert.Nil(t, err)
+		rc := &recordingChan{duplicates: true}
+		s.ch = rc
+		s.crawlOnce()
+		// the record without port is skipped
+		assert.Equal(t, []string{
+			"http 1.2.3.4:80", "socks5 5.6.7.8:1080",
+			"http 1.2.3.4:80", "socks5 5.6.7.8:1080",
+		}, rc.records())
+	}
+}
+
+func TestDefinitionWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spiders.yml")
+	write := func(name string) {
+		data := fmt.Sprintf(`- {name: %s, urls: [http://a.com], parser: {query: //tr, ip: 'td[1]', port: 'td[2]'}}`, name)
+		assert.Nil(t, os.WriteFile(path, []byte(data), 0644))
+	}
+	var loaded []string
+	var lastErr error
+	w := NewDefinitionWatcher(path, func(defs []*Definition, err error) {
+		lastErr = err
+		for _, d := range defs {
+			loaded = append(loaded, d.Name)
+		}
+	})
+	assert.True(t, w.Check())
+	assert.NotNil(t, lastErr)
+
+	write("first")
+	assert.True(t, w.Check())
+	assert.Nil(t, lastErr)
+	assert.False(t, w.Check())
+	write("second-one")
+	assert.True(t, w.Check())
+	assert.Equal(t, []string{"first", "second-one"}, loaded)
+}
+
+func TestRedefine(t *testing.T) {
+	defs, err := ParseDefinitions([]byte(`
+- {name: demo, urls: [http://a.com], parser: {query: //tr, ip: 'td[1]', port: 'td[2]'}}
+- {name: other, enable: false, urls: [http://b.com, http://c.com], parser: {query: //tr, ip: 'td[1]', port: 'td[2]'}, period: 1h}
+`))
+	assert.Nil(t, err)
+	s, err := NewSpiderFromDefinition(defs[0])
+	assert.Nil(t, err)
+	assert.True(t, s.Enabled())
+	assert.Equal(t, defaultPeriod, s.period)
+
+	assert.Nil(t, s.Redefine(defs[1]))
+	assert.Equal(t, "demo", s.Name())
+	assert.False(t, s.Enabled())
+	assert.Equal(t, time.Hour, s.period)
+	assert.Equal(t, []string{"http://b.com", "http://c.com"}, s.parser.Urls())
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gocolly/colly"
+	"github.com/stretchr/testify/assert"
+)
+
+// The fixture of spider is in testdata/<spider>: the pages saved from the
+// sites in pages/, and the proxies they list in golden.txt, one `ip:port`
+// per line. The pages are replayed to the spiders, built-in and declared in
+// config/spiders.yml, and the proxies parsed are asserted on the golden file.
+//
+// Run `go test ./pkg/spider -run TestSpiderFixtures -record` to record the
+// fixtures from the real sites, and with -update to update the golden
+// files after fixing the pages.
+var (
+	recordFixtures = flag.Bool("record", false, "record the pages and golden files of spiders from the real sites")
+	updateGolden   = flag.Bool("update", false, "update the golden files of spiders by the pages replayed")
+)
+
+const definitionsFile = "../../config/spiders.yml"
+
+// fixtureSpider builds a spider whose fixture is in testdata/<name>.
+type fixtureSpider struct {
+	name  string
+	build func(options ...func(*Spider)) (*Spider, error)
+}
+
+func fixtureSpiders(t *testing.T) map[string]fixtureSpider {
+	spiders := make(map[string]fixtureSpider)
+	for _, s := range BuildAndInitAll() {
+		name := s.Name()
+		spiders["builtin/"+name] = fixtureSpider{name: name, build: func(options ...func(*Spider)) (*Spider, error) {
+			return NewSpider(name, defaultLimitRule, options...), nil
+		}}
+	}
+	defs, err := LoadDefinitions(definitionsFile)
+	assert.Nil(t, err)
+	for _, def := range defs {
+		def := def
+		spiders["definition/"+def.Name] = fixtureSpider{name: def.Name, build: func(options ...func(*Spider)) (*Spider, error) {
+			s, err := NewSpiderFromDefinition(def, options...)
+			if err == nil {
+				s.Enable()
+			}
+			return s, err
+		}}
+	}
+	return spiders
+}
+
+// unsafeFixtureChars are replaced in the names of pages.
+var unsafeFixtureChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// fixturePage returns the name of page saved for the request uri, i.e. path and query.
+func fixturePage(requestURI string) string {
+	name := unsafeFixtureChars.ReplaceAllString(strings.TrimPrefix(requestURI, "/"), "_")
+	if name == "" {
+		return "index"
+	}
+	return name
+}
+
+// crawlFixture crawls once by the spider, and returns the sorted `ip:port` of proxies found.
+func crawlFixture(t *testing.T, fs fixtureSpider, options ...func(*Spider)) []string {
+	s, err := fs.build(append(options, CoolDownTime(0))...)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	rc := &recordingChan{}
+	s.ch = rc
+	s.crawlOnce()
+	found := make([]string, 0, len(rc.proxies))
+	for _, pxy := range rc.proxies {
+		found = append(found, fmt.Sprintf("%s:%d", pxy.IP, pxy.Port))
+	}
+	sort.Strings(found)
+	return found
+}
+
+// recordingTransport saves the pages responded successfully into dir.
+type recordingTransport struct {
+	base http.RoundTripper
+	dir  string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, os.WriteFile(filepath.Join(rt.dir, fixturePage(req.URL.RequestURI())), body, 0o644)
+}
+
+// recordFixture crawls the real site, and saves the pages and golden file into dir.
+func recordFixture(t *testing.T, fs fixtureSpider, dir string) {
+	pages := filepath.Join(dir, "pages")
+	assert.Nil(t, os.RemoveAll(pages))
+	assert.Nil(t, os.MkdirAll(pages, 0o755))
+	found := crawlFixture(t, fs, func(s *Spider) {
+		s.c.WithTransport(&recordingTransport{base: newTransport(), dir: pages})
+	})
+	writeGolden(t, dir, found)
+}
+
+// replayFixture crawls the pages saved in dir by a local server, and returns the proxies found.
+func replayFixture(t *testing.T, fs fixtureSpider, dir string) []string {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, err := os.ReadFile(filepath.Join(dir, "pages", fixturePage(r.URL.RequestURI())))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(page)
+	}))
+	defer ts.Close()
+	return crawlFixture(t, fs, Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: 1}), RewriteURLs(func(url string) string {
+		// keeps the path, which may have PagePlaceholder, and query of url
+		if i := strings.Index(url, "://"); i >= 0 {
+			url = url[i+3:]
+		}
+		if i := strings.IndexAny(url, "/?"); i >= 0 {
+			return ts.URL + "/" + strings.TrimPrefix(url[i:], "/")
+		}
+		return ts.URL + "/"
+	}))
+}
+
+func writeGolden(t *testing.T, dir string, found []string) {
+	data := strings.Join(found, "\n") + "\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "golden.txt"), []byte(data), 0o644))
+}
+
+func readGolden(t *testing.T, dir string) []string {
+	data, err := os.ReadFile(filepath.Join(dir, "golden.txt"))
+	assert.Nil(t, err)
+	return strings.Fields(string(data))
+}
+
+func TestSpiderFixtures(t *testing.T) {
+	spiders := fixtureSpiders(t)
+	labels := make([]string, 0, len(spiders))
+	for label := range spiders {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	recorded := make(map[string]bool)
+	for _, label := range labels {
+		fs := spiders[label]
+		t.Run(label, func(t *testing.T) {
+			dir := filepath.Join("testdata", fs.name)
+			// a definition replacing the built-in spider shares the fixture of it
+			if *recordFixtures && !recorded[fs.name] {
+				recordFixture(t, fs, dir)
+				recorded[fs.name] = true
+			}
+			if _, err := os.Stat(filepath.Join(dir, "pages")); err != nil {
+				t.Skipf("no fixture of %s, record it with -record", fs.name)
+			}
+			found := replayFixture(t, fs, dir)
+			if *updateGolden {
+				writeGolden(t, dir, found)
+			}
+			expected := readGolden(t, dir)
+			assert.NotEmpty(t, expected)
+			assert.Equal(t, expected, found)
+		})
+	}
+}
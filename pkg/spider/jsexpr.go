@@ -0,0 +1,473 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Limits of the JS evaluator, so that a hostile script can't exhaust resources.
+const (
+	maxJSLength = 4096
+	maxJSSteps  = 10000
+	maxJSString = 64 << 10 // of the strings concatenated and written
+)
+
+// evalJS evaluates a simple JS script, which is what listing sites use to
+// obfuscate the ports and IPs, e.g. `var a=7;document.write(":"+(a*1000+30))`.
+//
+// It is a sandbox rather than a JS engine: only the statements `var x = expr`,
+// `x = expr` and expressions of string and number literals, variables,
+// arithmetic and bitwise operators are supported, and the functions
+// document.write, String.fromCharCode, parseInt and atob. The result is
+// what document.write writes, or the value of the last statement if nothing written.
+func evalJS(src string) (string, error) {
+	if len(src) > maxJSLength {
+		return "", fmt.Errorf("script longer than %d", maxJSLength)
+	}
+	tokens, err := tokenizeJS(src)
+	if err != nil {
+		return "", err
+	}
+	e := &jsEvaluator{tokens: tokens, vars: make(map[string]jsValue)}
+	var last jsValue
+	for !e.done() {
+		if e.accept(";") {
+			continue
+		}
+		if last, err = e.statement(); err != nil {
+			return "", err
+		}
+		if !e.done() && !e.accept(";") {
+			return "", fmt.Errorf("unexpected %q", e.peek().text)
+		}
+	}
+	if e.wrote {
+		return e.out.String(), nil
+	}
+	return last.String(), nil
+}
+
+// jsValue is a string or a number.
+type jsValue struct {
+	str   string
+	num   float64
+	isStr bool
+}
+
+func jsString(s string) jsValue {
+	return jsValue{str: s, isStr: true}
+}
+
+func jsNumber(n float64) jsValue {
+	return jsValue{num: n}
+}
+
+func (v jsValue) String() string {
+	if v.isStr {
+		return v.str
+	}
+	switch {
+	case math.IsNaN(v.num):
+		return "NaN"
+	case v.num == math.Trunc(v.num) && math.Abs(v.num) < 1e21:
+		return strconv.FormatInt(int64(v.num), 10)
+	default:
+		return strconv.FormatFloat(v.num, 'g', -1, 64)
+	}
+}
+
+func (v jsValue) Number() float64 {
+	if !v.isStr {
+		return v.num
+	}
+	s := strings.TrimSpace(v.str)
+	if s == "" {
+		return 0
+	}
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return n
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		if n, err := strconv.ParseInt(s[2:], 16, 64); err == nil {
+			return float64(n)
+		}
+	}
+	return math.NaN()
+}
+
+// int32 converts the value like the JS bitwise operators.
+func (v jsValue) int32() int32 {
+	n := v.Number()
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0
+	}
+	return int32(uint32(int64(n)))
+}
+
+// Kinds of JS tokens.
+const (
+	jsNum = iota
+	jsStr
+	jsIdent
+	jsPunct
+)
+
+type jsToken struct {
+	kind int
+	text string
+}
+
+// jsPuncts are the punctuators, the longer ones first.
+var jsPuncts = []string{"<<", ">>", "+", "-", "*", "/", "%", "^", "&", "|", "~", "(", ")", ",", ";", "=", "."}
+
+func tokenizeJS(src string) (tokens []jsToken, err error) {
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i + 1
+			for j < len(src) && (isJSIdentChar(src[j]) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, jsToken{jsNum, src[i:j]})
+			i = j
+		case c == '\'' || c == '"':
+			s, n, err := unquoteJS(src[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, jsToken{jsStr, s})
+			i += n
+		case isJSIdentChar(c):
+			j := i + 1
+			for j < len(src) && isJSIdentChar(src[j]) {
+				j++
+			}
+			tokens = append(tokens, jsToken{jsIdent, src[i:j]})
+			i = j
+		default:
+			found := false
+			for _, p := range jsPuncts {
+				if strings.HasPrefix(src[i:], p) {
+					tokens = append(tokens, jsToken{jsPunct, p})
+					i += len(p)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+		}
+	}
+	return
+}
+
+func isJSIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// unquoteJS returns the string literal at the beginning of s, and its length in s.
+func unquoteJS(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'x', 'u':
+				size := 2
+				if s[i] == 'u' {
+					size = 4
+				}
+				if i+size >= len(s) {
+					return "", 0, fmt.Errorf("invalid escape in string")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+1+size], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid escape in string")
+				}
+				b.WriteRune(rune(r))
+				i += size
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// jsEvaluator evaluates the tokens while parsing them by recursive descent.
+type jsEvaluator struct {
+	tokens []jsToken
+	pos    int
+	steps  int
+	vars   map[string]jsValue
+	out    strings.Builder
+	wrote  bool
+}
+
+func (e *jsEvaluator) done() bool {
+	return e.pos >= len(e.tokens)
+}
+
+func (e *jsEvaluator) peek() jsToken {
+	if e.done() {
+		return jsToken{jsPunct, "end of script"}
+	}
+	return e.tokens[e.pos]
+}
+
+// accept consumes the next token if it is the punctuator p.
+func (e *jsEvaluator) accept(p string) bool {
+	if t := e.peek(); !e.done() && t.kind == jsPunct && t.text == p {
+		e.pos++
+		return true
+	}
+	return false
+}
+
+func (e *jsEvaluator) expect(p string) error {
+	if !e.accept(p) {
+		return fmt.Errorf("expected %q, got %q", p, e.peek().text)
+	}
+	return nil
+}
+
+func (e *jsEvaluator) ident() (string, error) {
+	t := e.peek()
+	if e.done() || t.kind != jsIdent {
+		return "", fmt.Errorf("expected identifier, got %q", t.text)
+	}
+	e.pos++
+	return t.text, nil
+}
+
+func (e *jsEvaluator) statement() (jsValue, error) {
+	t := e.peek()
+	assign := t.kind == jsIdent && e.pos+1 < len(e.tokens) && e.tokens[e.pos+1] == jsToken{jsPunct, "="}
+	if t.kind == jsIdent && t.text == "var" {
+		e.pos++
+		assign = true
+	}
+	if !assign {
+		return e.expr(0)
+	}
+	name, err := e.ident()
+	if err != nil {
+		return jsValue{}, err
+	}
+	if err = e.expect("="); err != nil {
+		return jsValue{}, err
+	}
+	v, err := e.expr(0)
+	if err == nil {
+		e.vars[name] = v
+	}
+	return v, err
+}
+
+// jsBinary are the binary operators by precedence, the lowest first.
+var jsBinary = [][]string{{"|"}, {"^"}, {"&"}, {"<<", ">>"}, {"+", "-"}, {"*", "/", "%"}}
+
+func (e *jsEvaluator) expr(level int) (jsValue, error) {
+	if level == len(jsBinary) {
+		return e.unary()
+	}
+	left, err := e.expr(level + 1)
+	if err != nil {
+		return left, err
+	}
+	for {
+		op := ""
+		for _, p := range jsBinary[level] {
+			if e.accept(p) {
+				op = p
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		right, err := e.expr(level + 1)
+		if err != nil {
+			return right, err
+		}
+		if left, err = binaryJS(op, left, right); err != nil {
+			return left, err
+		}
+	}
+}
+
+func binaryJS(op string, l, r jsValue) (jsValue, error) {
+	switch op {
+	case "+":
+		if l.isStr || r.isStr {
+			ls, rs := l.String(), r.String()
+			if len(ls)+len(rs) > maxJSString {
+				return jsValue{}, fmt.Errorf("string longer than %d", maxJSString)
+			}
+			return jsString(ls + rs), nil
+		}
+		return jsNumber(l.num + r.num), nil
+	case "-":
+		return jsNumber(l.Number() - r.Number()), nil
+	case "*":
+		return jsNumber(l.Number() * r.Number()), nil
+	case "/":
+		return jsNumber(l.Number() / r.Number()), nil
+	case "%":
+		return jsNumber(math.Mod(l.Number(), r.Number())), nil
+	case "|":
+		return jsNumber(float64(l.int32() | r.int32())), nil
+	case "^":
+		return jsNumber(float64(l.int32() ^ r.int32())), nil
+	case "&":
+		return jsNumber(float64(l.int32() & r.int32())), nil
+	case "<<":
+		return jsNumber(float64(l.int32() << (uint32(r.int32()) & 31))), nil
+	default: // ">>"
+		return jsNumber(float64(l.int32() >> (uint32(r.int32()) & 31))), nil
+	}
+}
+
+func (e *jsEvaluator) unary() (jsValue, error) {
+	for _, op := range []string{"-", "+", "~"} {
+		if e.accept(op) {
+			v, err := e.unary()
+			switch op {
+			case "-":
+				v = jsNumber(-v.Number())
+			case "+":
+				v = jsNumber(v.Number())
+			default:
+				v = jsNumber(float64(^v.int32()))
+			}
+			return v, err
+		}
+	}
+	return e.primary()
+}
+
+func (e *jsEvaluator) primary() (jsValue, error) {
+	if e.steps++; e.steps > maxJSSteps {
+		return jsValue{}, fmt.Errorf("script takes more than %d steps", maxJSSteps)
+	}
+	t := e.peek()
+	switch {
+	case e.done():
+		return jsValue{}, fmt.Errorf("unexpected end of script")
+	case t.kind == jsNum:
+		e.pos++
+		n := jsString(t.text).Number()
+		if math.IsNaN(n) {
+			return jsValue{}, fmt.Errorf("invalid number %q", t.text)
+		}
+		return jsNumber(n), nil
+	case t.kind == jsStr:
+		e.pos++
+		return jsString(t.text), nil
+	case e.accept("("):
+		v, err := e.expr(0)
+		if err == nil {
+			err = e.expect(")")
+		}
+		return v, err
+	case t.kind == jsIdent:
+		name, _ := e.ident()
+		for e.accept(".") {
+			part, err := e.ident()
+			if err != nil {
+				return jsValue{}, err
+			}
+			name += "." + part
+		}
+		if e.accept("(") {
+			return e.call(name)
+		}
+		v, found := e.vars[name]
+		if !found {
+			return v, fmt.Errorf("%s is not defined", name)
+		}
+		return v, nil
+	default:
+		return jsValue{}, fmt.Errorf("unexpected %q", t.text)
+	}
+}
+
+// call calls the function after the open parenthesis consumed.
+func (e *jsEvaluator) call(name string) (jsValue, error) {
+	var args []jsValue
+	for !e.accept(")") {
+		if len(args) > 0 {
+			if err := e.expect(","); err != nil {
+				return jsValue{}, err
+			}
+		}
+		v, err := e.expr(0)
+		if err != nil {
+			return v, err
+		}
+		args = append(args, v)
+	}
+	arg := func(i int) jsValue {
+		if i < len(args) {
+			return args[i]
+		}
+		return jsString("")
+	}
+	switch name {
+	case "document.write", "document.writeln":
+		for _, v := range args {
+			str := v.String()
+			if e.out.Len()+len(str) > maxJSString {
+				return jsValue{}, fmt.Errorf("output longer than %d", maxJSString)
+			}
+			e.out.WriteString(str)
+		}
+		e.wrote = true
+		return jsString(""), nil
+	case "String.fromCharCode":
+		var b strings.Builder
+		for _, v := range args {
+			b.WriteRune(rune(v.int32()))
+		}
+		return jsString(b.String()), nil
+	case "parseInt":
+		base := 10
+		if len(args) > 1 {
+			base = int(args[1].int32())
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(arg(0).String()), base, 64)
+		if err != nil {
+			return jsNumber(math.NaN()), nil
+		}
+		return jsNumber(float64(n)), nil
+	case "atob":
+		decoded, err := base64.StdEncoding.DecodeString(arg(0).String())
+		if err != nil {
+			return jsValue{}, fmt.Errorf("atob: %v", err)
+		}
+		return jsString(string(decoded)), nil
+	default:
+		return jsValue{}, fmt.Errorf("%s is not a function", name)
+	}
+}
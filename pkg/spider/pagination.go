@@ -0,0 +1,125 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/gocolly/colly"
+)
+
+// PagePlaceholder is replaced by the page number in the start urls of
+// a spider which paginates by incrementing the page.
+const PagePlaceholder = "{page}"
+
+// defaultMaxPages is the hard cap of pages crawled from a start url.
+const defaultMaxPages = 50
+
+// Pagination discovers the pages from each start url of spider, instead of
+// crawling a fixed list of urls. The spider either follows the link to the next
+// page, or increments the page number in the url, and stops when a page
+// yields no new proxy, i.e. no rows, or only the proxies already seen on
+// the previous pages, e.g. a site serving the last page for the pages after.
+type Pagination struct {
+	// Next is the query of the link to the next page, whose href is followed.
+	// It is in the same language as the query of records. The page number
+	// is incremented if empty.
+	Next string `yaml:"next"`
+	// Start is the first page number, default is 1.
+	Start int `yaml:"start"`
+	// MaxPages is the hard cap of pages crawled from a start url, default is 50.
+	MaxPages int `yaml:"max_pages"`
+}
+
+// Paginate lets the spider discover the pages by p.
+func Paginate(p Pagination) func(*Spider) {
+	return func(s *Spider) {
+		if p.Start == 0 {
+			p.Start = 1
+		}
+		if p.MaxPages <= 0 {
+			p.MaxPages = defaultMaxPages
+		}
+		s.pagination = &p
+	}
+}
+
+// registerPagination registers the callback finding the link to next page.
+func (s *Spider) registerPagination() {
+	if s.pagination == nil || s.pagination.Next == "" {
+		return
+	}
+	if rp, ok := s.parser.(RecordParser); ok && rp.CSS() {
+		s.c.OnHTML(s.pagination.Next, func(e *colly.HTMLElement) {
+			s.foundNext(e.Request, e.Attr("href"))
+		})
+	} else {
+		s.c.OnXML(s.pagination.Next, func(e *colly.XMLElement) {
+			s.foundNext(e.Request, e.Attr("href"))
+		})
+	}
+}
+
+// foundNext records the link to next page found on the page crawling, the first one wins.
+func (s *Spider) foundNext(r *colly.Request, href string) {
+	if s.nextPage == "" && href != "" {
+		s.nextPage = r.AbsoluteURL(href)
+	}
+}
+
+// crawlPages crawls the pages from the start url, and returns the number of pages failed.
+func (s *Spider) crawlPages(ctx context.Context, c *colly.Collector, p *Pagination, start string) (failed int) {
+	url, page := start, p.Start
+	visited, seen := make(map[string]bool), make(map[string]bool)
+	for n := 0; n < p.MaxPages && ctx.Err() == nil; n++ {
+		if p.Next == "" {
+			url = strings.ReplaceAll(start, PagePlaceholder, strconv.Itoa(page))
+			page++
+		}
+		if url == "" || visited[url] {
+			return
+		}
+		visited[url] = true
+		ips, err := s.visitPage(c, url)
+		if err != nil {
+			s.logger.Warnf("Failed to crawl %s, %v", url, err)
+			return failed + 1
+		}
+		fresh := 0
+		for _, ip := range ips {
+			if !seen[ip] {
+				seen[ip] = true
+				fresh++
+			}
+		}
+		if fresh == 0 {
+			s.logger.Infof("No new proxy in %s, stop paginating", url)
+			return
+		}
+		if p.Next != "" {
+			url = s.nextPage
+		} else if !strings.Contains(start, PagePlaceholder) {
+			return
+		}
+	}
+	s.logger.Infof("Stop paginating %s after %d pages", start, p.MaxPages)
+	return
+}
+
+// visitPage crawls the page, and returns the IPs found on it.
+func (s *Spider) visitPage(c *colly.Collector, url string) ([]string, error) {
+	s.nextPage = ""
+	s.statsMu.Lock()
+	s.pageIPs = []string{}
+	s.statsMu.Unlock()
+	err := c.Visit(url)
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	ips := s.pageIPs
+	s.pageIPs = nil
+	return ips, err
+}
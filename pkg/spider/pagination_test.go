@@ -0,0 +1,116 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pagedSite serves pages/<n>.html with the proxies 10.0.<n>.1 and 10.0.<n>.2
+// and a link to the next page, until the page lastPage. The pages after are empty,
+// or the same as lastPage if repeatLast.
+type pagedSite struct {
+	lastPage   int
+	repeatLast bool
+	mu         sync.Mutex
+	visited    []string
+}
+
+func (ps *pagedSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps.mu.Lock()
+	ps.visited = append(ps.visited, r.URL.Path)
+	ps.mu.Unlock()
+	n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/pages/"), ".html"))
+	fmt.Fprint(w, `<html><body><table><tbody>`)
+	if rows := n; rows <= ps.lastPage || ps.repeatLast {
+		if rows > ps.lastPage {
+			rows = ps.lastPage
+		}
+		fmt.Fprintf(w, `<tr><td>10.0.%d.1</td><td>80</td></tr><tr><td>10.0.%d.2</td><td>80</td></tr>`, rows, rows)
+	}
+	fmt.Fprintf(w, `</tbody></table><a class="next" href="%d.html">next</a></body></html>`, n+1)
+}
+
+func (ps *pagedSite) pages() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	visited := ps.visited
+	ps.visited = nil
+	return visited
+}
+
+func TestPagination(t *testing.T) {
+	site := &pagedSite{lastPage: 3}
+	ts := httptest.NewServer(site)
+	defer ts.Close()
+
+	for _, pagination := range []string{
+		`{max_pages: 10}`,
+		`{next: '//a[@class="next"]'}`,
+	} {
+		url := ts.URL + "/pages/{page}.html"
+		if strings.Contains(pagination, "next") {
+			url = ts.URL + "/pages/1.html"
+		}
+		defs, err := ParseDefinitions([]byte(fmt.Sprintf(`
+- name: paged
+  urls: ['%s']
+  parser: {query: //tbody/tr, ip: 'td[1]', port: 'td[2]'}
+  pagination: %s
+  limit: {parallelism: 1}
+`, url, pagination)))
+		assert.Nil(t, err)
+		s, err := NewSpiderFromDefinition(defs[0], CoolDownTime(0))
+		assert.Nil(t, err)
+		rc := &recordingChan{}
+		s.ch = rc
+
+		// stops at the empty page
+		s.crawlOnce()
+		assert.Equal(t, []string{"/pages/1.html", "/pages/2.html", "/pages/3.html", "/pages/4.html"}, site.pages())
+		assert.Len(t, rc.records(), 6)
+		// the proxies seen by the previous crawls don't stop paginating
+		s.crawlOnce()
+		assert.Equal(t, []string{"/pages/1.html", "/pages/2.html", "/pages/3.html", "/pages/4.html"}, site.pages())
+		// stops at the page whose proxies are all seen in this crawl
+		site.repeatLast = true
+		s.crawlOnce()
+		assert.Equal(t, []string{"/pages/1.html", "/pages/2.html", "/pages/3.html", "/pages/4.html"}, site.pages())
+		site.repeatLast = false
+	}
+
+	// stops at the hard cap
+	site.lastPage = 100
+	defs, err := ParseDefinitions([]byte(fmt.Sprintf(`
+- name: paged
+  urls: ['%s/pages/{page}.html']
+  parser: {query: //tbody/tr, ip: 'td[1]', port: 'td[2]'}
+  pagination: {start: 5, max_pages: 3}
+  limit: {parallelism: 1}
+`, ts.URL)))
+	assert.Nil(t, err)
+	s, _ := NewSpiderFromDefinition(defs[0], CoolDownTime(0))
+	s.ch = &recordingChan{}
+	s.crawlOnce()
+	assert.Equal(t, []string{"/pages/5.html", "/pages/6.html", "/pages/7.html"}, site.pages())
+
+	for _, data := range []string{
+		`- {name: paged, urls: ['http://a.com/{page}'], parser: {query: //tr, ip: 'td[1]', port: 'td[2]'}}`,
+		`- {name: paged, urls: ['http://a.com/{page}'], parser: {query: //tr, ip: 'td[1]', port: 'td[2]'}, pagination: {next: //a}}`,
+		`- {name: paged, kind: text, urls: ['http://a.com/'], pagination: {next: //a}}`,
+		`- {name: paged, urls: ['http://a.com/'], parser: {query: //tr, ip: 'td[1]', port: 'td[2]'}, pagination: {next: '//a['}}`,
+	} {
+		_, err = ParseDefinitions([]byte(data))
+		assert.NotNil(t, err, data)
+	}
+}
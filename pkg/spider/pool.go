@@ -0,0 +1,183 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/loadbalancer"
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+)
+
+const defaultPoolRefresh = time.Minute
+
+var (
+	// poolRefresh is the interval of reloading the top-scored proxies.
+	poolRefresh = defaultPoolRefresh
+	// banDuration is how long a proxy banned by a site is not used by spiders.
+	banDuration = 30 * time.Minute
+)
+
+// poolEndpoint is a proxy balanced by the Pool.
+type poolEndpoint struct {
+	pxy *proxy.Proxy
+	url *url.URL
+}
+
+// Weight implements the loadbalancer.Endpoint interface.
+func (e *poolEndpoint) Weight() int {
+	return int(e.pxy.Score)
+}
+
+func (e *poolEndpoint) String() string {
+	return e.pxy.String()
+}
+
+// Pool balances the crawling requests of spiders over the top-scored proxies
+// in backend, so that the listing sites don't ban the crawl host. A request
+// banned or failed is retried on a different proxy, and the requests connect
+// directly when the pool is empty, e.g. on bootstrap.
+type Pool struct {
+	b           backend.Backend
+	size        int
+	retries     int
+	mu          sync.Mutex
+	lb          loadbalancer.LoadBalancer
+	endpoints   map[string]*poolEndpoint
+	banned      map[string]time.Time
+	refreshedAt time.Time
+}
+
+// NewPool returns a pool of the size top-scored proxies in b,
+// a request is retried on at most retries different proxies.
+func NewPool(b backend.Backend, size, retries int) *Pool {
+	return &Pool{
+		b:       b,
+		size:    size,
+		retries: retries,
+		banned:  make(map[string]time.Time),
+	}
+}
+
+// pick returns a proxy to crawl through, nil if the pool is empty.
+func (p *Pool) pick() *poolEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lb == nil || time.Since(p.refreshedAt) >= poolRefresh {
+		p.refresh()
+	}
+	if e := p.lb.Select(); e != nil {
+		return e.(*poolEndpoint)
+	}
+	return nil
+}
+
+// refresh reloads the top-scored proxies which are not banned, p.mu must be held.
+func (p *Pool) refresh() {
+	p.refreshedAt = time.Now()
+	for ip, at := range p.banned {
+		if time.Since(at) >= banDuration {
+			delete(p.banned, ip)
+		}
+	}
+	p.lb = loadbalancer.NewLoadBalancer(loadbalancer.WeightedRoundRobin)
+	p.endpoints = make(map[string]*poolEndpoint)
+	// iterates by score descend, and stops once the pool is full
+	p.b.Iter(func(pxy *proxy.Proxy) bool {
+		if pxy.Protocol == proxy.SOCKS4 {
+			return true // unsupported by net/http
+		}
+		if _, found := p.banned[pxy.String()]; found {
+			return true
+		}
+		u, err := url.Parse(pxy.URL())
+		if err != nil {
+			return true
+		}
+		e := &poolEndpoint{pxy: pxy, url: u}
+		p.endpoints[pxy.String()] = e
+		p.lb.AddEndpoint(e)
+		return len(p.endpoints) < p.size
+	})
+}
+
+// ban stops using the proxy for a while.
+func (p *Pool) ban(e *poolEndpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ip := e.pxy.String()
+	p.banned[ip] = time.Now()
+	if found, ok := p.endpoints[ip]; ok {
+		delete(p.endpoints, ip)
+		p.lb.DelEndpoint(found)
+	}
+}
+
+// transport returns a transport which sends the requests through the pool by base.
+func (p *Pool) transport(base *http.Transport) http.RoundTripper {
+	base.Proxy = func(req *http.Request) (*url.URL, error) {
+		if e, ok := req.Context().Value(poolEndpointKey{}).(*poolEndpoint); ok {
+			return e.url, nil
+		}
+		return nil, nil
+	}
+	return &poolTransport{pool: p, base: base}
+}
+
+type poolEndpointKey struct{}
+
+// poolTransport retries the request on a different proxy when it is banned or failed.
+type poolTransport struct {
+	pool *Pool
+	base *http.Transport
+}
+
+func (t *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "file" {
+		return t.base.RoundTrip(req)
+	}
+	for attempt := 0; ; attempt++ {
+		e := t.pool.pick()
+		if e == nil {
+			return t.base.RoundTrip(req)
+		}
+		resp, err := t.base.RoundTrip(req.WithContext(context.WithValue(req.Context(), poolEndpointKey{}, e)))
+		if !banned(resp, err) || attempt >= t.pool.retries {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		t.pool.ban(e)
+	}
+}
+
+// banned reports whether the request is failed or banned, so it should be retried.
+func banned(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch {
+	case resp.StatusCode == http.StatusForbidden,
+		resp.StatusCode == http.StatusProxyAuthRequired,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= http.StatusInternalServerError:
+		return true
+	}
+	return false
+}
+
+// CrawlThrough lets the spider crawl through the proxies in pool.
+func CrawlThrough(pool *Pool) func(*Spider) {
+	return func(s *Spider) {
+		s.pool = pool
+		s.c.WithTransport(pool.transport(newTransport()))
+	}
+}
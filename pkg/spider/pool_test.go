@@ -0,0 +1,127 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+// newProxyServer starts a fake proxy server listening on ip, which responds
+// the requests with status and body, and counts the requests.
+func newProxyServer(t *testing.T, ip string, status int, body string, hits *int32) (*httptest.Server, *proxy.Proxy) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	l, err := net.Listen("tcp", ip+":0")
+	if err != nil {
+		t.Skipf("can't listen on %s, %v", ip, err)
+	}
+	ts.Listener = l
+	ts.Start()
+	pxy, _ := proxy.NewProxy(ip, strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+	return ts, pxy
+}
+
+func TestCrawlThroughPool(t *testing.T) {
+	var directHits, bannedHits, goodHits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&directHits, 1)
+		fmt.Fprint(w, "5.6.7.8:80")
+	}))
+	defer target.Close()
+	bannedServer, bannedPxy := newProxyServer(t, "127.0.0.1", http.StatusForbidden, "", &bannedHits)
+	defer bannedServer.Close()
+	goodServer, goodPxy := newProxyServer(t, "127.0.0.2", http.StatusOK, "1.2.3.4:80", &goodHits)
+	defer goodServer.Close()
+
+	b := backend.NewInMemoryBackend()
+	defs, err := ParseDefinitions([]byte(fmt.Sprintf(`
+- name: list
+  kind: text
+  urls: ['%s/list.txt']
+  limit: {parallelism: 1}
+`, target.URL)))
+	assert.Nil(t, err)
+	s, err := NewSpiderFromDefinition(defs[0], CoolDownTime(0), CrawlThrough(NewPool(b, 10, 3)))
+	assert.Nil(t, err)
+	rc := &recordingChan{duplicates: true}
+	s.ch = rc
+
+	// bootstrap: connects directly when the pool is empty
+	s.crawlOnce()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&directHits))
+	assert.Equal(t, []string{" 5.6.7.8:80"}, rc.records())
+
+	bannedPxy.Score, goodPxy.Score = 100, 50
+	assert.Nil(t, b.Insert(bannedPxy))
+	assert.Nil(t, b.Insert(goodPxy))
+	poolRefresh = 0
+	defer func() { poolRefresh = defaultPoolRefresh }()
+	s.crawlOnce()
+	s.crawlOnce()
+	// retried through the good one after banned, and the banned one is not used again
+	assert.Equal(t, int32(1), atomic.LoadInt32(&directHits))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&bannedHits))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&goodHits))
+	assert.Equal(t, []string{" 5.6.7.8:80", " 1.2.3.4:80", " 1.2.3.4:80"}, rc.records())
+}
+
+// countingBackend counts the proxies iterated.
+type countingBackend struct {
+	backend.Backend
+	iterated int
+}
+
+func (b *countingBackend) Iter(iter backend.Iterator) {
+	b.Backend.Iter(func(pxy *proxy.Proxy) bool {
+		b.iterated++
+		return iter(pxy)
+	})
+}
+
+func TestPoolRefresh(t *testing.T) {
+	b := &countingBackend{Backend: backend.NewInMemoryBackend()}
+	for i := 1; i <= 20; i++ {
+		pxy, _ := proxy.NewProxy(fmt.Sprintf("10.0.0.%d", i), "80")
+		pxy.Score = int8(i + 50)
+		if i == 19 {
+			pxy.Protocol = proxy.SOCKS4
+		}
+		assert.Nil(t, b.Insert(pxy))
+	}
+	p := NewPool(b, 3, 0)
+	p.banned["10.0.0.20"] = time.Now()
+	p.refresh()
+	// the top-scored ones except the banned and SOCKS4 one, without iterating the rest
+	assert.Len(t, p.endpoints, 3)
+	for _, ip := range []string{"10.0.0.18", "10.0.0.17", "10.0.0.16"} {
+		assert.Contains(t, p.endpoints, ip)
+	}
+	assert.Equal(t, 5, b.iterated)
+
+	// fills up with the tied ones
+	tied := backend.NewInMemoryBackend()
+	for i := 1; i <= 20; i++ {
+		pxy, _ := proxy.NewProxy(fmt.Sprintf("10.0.1.%d", i), "80")
+		pxy.Score = 100
+		assert.Nil(t, tied.Insert(pxy))
+	}
+	p = NewPool(tied, 10, 0)
+	p.refresh()
+	assert.Len(t, p.endpoints, 10)
+}
@@ -7,8 +7,10 @@ package spider
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Leosocy/IntelliProxy/config"
 	"github.com/gocolly/colly"
 )
 
@@ -41,40 +43,237 @@ var (
 	defaultCoolDown = 10 * time.Second
 )
 
-// BuildAndInitAll returns all of the enable spider.
-func BuildAndInitAll() (spiders []*Spider) {
-	for _, name := range []string{
-		NameOfXici, NameOfKuai, NameOfYun,
-		NameOfIphai, NameOfXila, NameOfNima,
-		NameOfEightnine, NameOfHappy,
-	} {
-		spiders = append(spiders, NewSpider(name, defaultLimitRule))
-	}
-	return
-}
-
-// NewSpider creates a new Spider with name and default configurations.
-func NewSpider(name string, lr *colly.LimitRule) *Spider {
-	switch name {
-	case NameOfXici:
-		return newSpider(name, xiciSpider{}, Limit(lr), Period(defaultPeriod), CoolDownTime(defaultCoolDown))
-	case NameOfKuai:
-		return newSpider(name, kuaiSpider{}, Limit(lr), Period(defaultPeriod), CoolDownTime(defaultCoolDown))
-	case NameOfYun:
-		return newSpider(name, yunSpider{}, Limit(lr), Period(defaultPeriod), CoolDownTime(defaultCoolDown))
-	case NameOfIphai:
-		return newSpider(name, iphaiSpider{}, Limit(lr), Period(defaultPeriod), CoolDownTime(defaultCoolDown))
-	case NameOfXila:
-		return newSpider(name, xilaSpider{}, Limit(lr), Period(defaultPeriod), CoolDownTime(defaultCoolDown))
-	case NameOfNima:
-		return newSpider(name, nimaSpider{}, Limit(lr), Period(defaultPeriod), CoolDownTime(defaultCoolDown))
-	case NameOfEightnine:
-		return newSpider(name, eightnineSpider{}, Limit(lr), Period(defaultPeriod), CoolDownTime(defaultCoolDown))
-	case NameOfHappy:
-		return newSpider(name, happySpider{}, Limit(lr), Period(defaultPeriod), CoolDownTime(defaultCoolDown))
+// Factory creates the parser of a registered spider, by the options configured
+// in `spider.sources.<name>.options`, which is nil if not configured.
+// The parser is a Parser, a RecordParser, e.g. of the records found by CSS
+// selector with protocol and credentials, or a BodyParser of JSON or text.
+type Factory func(options map[string]string) (SourceParser, error)
+
+type registration struct {
+	name    string
+	factory Factory
+	options []func(*Spider)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   []*registration // in the order of registration
+)
+
+// Register makes a spider available by name, whose parser is created by factory.
+// The options are applied to the spider before the configured ones, e.g. Paginate.
+// It is usually called in the init function of the package of source, and panics
+// if the name is registered twice or factory is nil.
+func Register(name string, factory Factory, options ...func(*Spider)) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("spider: Register factory is nil")
+	}
+	for _, r := range registry {
+		if r.name == name {
+			panic("spider: Register called twice for spider " + name)
+		}
+	}
+	registry = append(registry, &registration{name: name, factory: factory, options: options})
+}
+
+// Registered returns the names of the spiders registered, in the order of registration.
+func Registered() (names []string) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, r := range registry {
+		names = append(names, r.name)
+	}
+	return
+}
+
+func lookup(name string) *registration {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, r := range registry {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// parserOf returns the factory of a parser without options.
+func parserOf(p Parser) Factory {
+	return func(map[string]string) (SourceParser, error) {
+		return p, nil
+	}
+}
+
+func init() {
+	Register(NameOfXici, parserOf(xiciSpider{}))
+	Register(NameOfKuai, parserOf(kuaiSpider{}))
+	Register(NameOfYun, parserOf(yunSpider{}))
+	Register(NameOfIphai, parserOf(iphaiSpider{}))
+	Register(NameOfXila, parserOf(xilaSpider{}))
+	Register(NameOfNima, parserOf(nimaSpider{}), Paginate(Pagination{}))
+	Register(NameOfEightnine, parserOf(eightnineSpider{}), Paginate(Pagination{}))
+	Register(NameOfHappy, parserOf(happySpider{}))
+}
+
+// SourceConfig configures a registered spider under `spider.sources.<name>`, e.g.
+//
+//	spider:
+//	  sources:
+//	    xici:
+//	      enable: false
+//	    internal:
+//	      period: 10m
+//	      cool_down: 5s
+//	      limit: {parallelism: 2, delay: 1s}
+//	      options: {token: secret}
+//
+// The keys of options are lower case, since the config keys are case insensitive.
+type SourceConfig struct {
+	// Enable is true if omitted.
+	Enable   *bool
+	Period   time.Duration
+	CoolDown time.Duration
+	Limit    *LimitDefinition
+	// Options are passed to the factory of spider.
+	Options map[string]string
+}
+
+// Enabled reports whether the spider is enabled.
+func (sc SourceConfig) Enabled() bool {
+	return sc.Enable == nil || *sc.Enable
+}
+
+// spiderOptions returns the options of spider configured.
+func (sc SourceConfig) spiderOptions() (options []func(*Spider)) {
+	if sc.Limit != nil {
+		options = append(options, Limit(sc.Limit.rule()))
+	}
+	if sc.Period > 0 {
+		options = append(options, Period(sc.Period))
+	}
+	if sc.CoolDown > 0 {
+		options = append(options, CoolDownTime(sc.CoolDown))
+	}
+	return
+}
+
+// SourcesFromConfig returns the configs of the registered spiders under `spider.sources`,
+// which are read key by key, so that they can be set by environment variables too,
+// e.g. INTELLI_PROXY_SPIDER_SOURCES_XICI_ENABLE=false disables xici.
+// The period, cool down and limit under `spider` apply to the spiders
+// which don't configure them.
+func SourcesFromConfig(cfg config.Provider) (map[string]SourceConfig, error) {
+	names := Registered()
+	for name := range cfg.GetStringMap("spider.sources") {
+		if lookup(name) == nil {
+			return nil, fmt.Errorf("spider %s in spider.sources is not registered, registered: %s",
+				name, strings.Join(names, ", "))
+		}
+	}
+	sources := make(map[string]SourceConfig, len(names))
+	for _, name := range names {
+		key := "spider.sources." + name
+		var sc SourceConfig
+		if cfg.IsSet(key + ".enable") {
+			enable := cfg.GetBool(key + ".enable")
+			sc.Enable = &enable
+		}
+		if sc.Period = cfg.GetDuration(key + ".period"); sc.Period == 0 {
+			sc.Period = cfg.GetDuration("spider.period")
+		}
+		if sc.CoolDown = cfg.GetDuration(key + ".cool_down"); sc.CoolDown == 0 {
+			sc.CoolDown = cfg.GetDuration("spider.cool_down")
+		}
+		if sc.Limit = limitFromConfig(cfg, key+".limit"); sc.Limit == nil {
+			sc.Limit = limitFromConfig(cfg, "spider.limit")
+		}
+		if options := cfg.GetStringMapString(key + ".options"); len(options) > 0 {
+			sc.Options = options
+		}
+		sources[name] = sc
+	}
+	return sources, nil
+}
+
+// limitFromConfig returns the limit under key, nil if not set.
+func limitFromConfig(cfg config.Provider, key string) *LimitDefinition {
+	if !cfg.IsSet(key+".parallelism") && !cfg.IsSet(key+".delay") && !cfg.IsSet(key+".random_delay") {
+		return nil
+	}
+	return &LimitDefinition{
+		Parallelism: cfg.GetInt(key + ".parallelism"),
+		Delay:       cfg.GetDuration(key + ".delay"),
+		RandomDelay: cfg.GetDuration(key + ".random_delay"),
+	}
+}
+
+// Build creates the registered spider named name, configured by cfg, options
+// are applied after the registered and configured ones.
+func Build(name string, cfg SourceConfig, options ...func(*Spider)) (*Spider, error) {
+	r := lookup(name)
+	if r == nil {
+		return nil, fmt.Errorf("spider %s is not registered", name)
+	}
+	parser, err := r.factory(cfg.Options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spider %s, %v", name, err)
+	}
+	switch parser.(type) {
+	case Parser, BodyParser:
 	default:
+		return nil, fmt.Errorf("failed to create spider %s, %T is neither Parser nor BodyParser", name, parser)
+	}
+	all := []func(*Spider){Limit(defaultLimitRule), Period(defaultPeriod), CoolDownTime(defaultCoolDown)}
+	all = append(all, r.options...)
+	all = append(all, cfg.spiderOptions()...)
+	s := newSpider(name, parser, append(all, options...)...)
+	if !cfg.Enabled() {
+		s.Disable()
+	}
+	return s, nil
+}
+
+// BuildAll creates all of the registered spiders configured by configs, the ones
+// disabled by config are created too, but never crawl until enabled. Options are
+// applied to each spider. It returns the spiders created even if some failed.
+func BuildAll(configs map[string]SourceConfig, options ...func(*Spider)) (spiders []*Spider, err error) {
+	names := Registered()
+	for name := range configs {
+		if lookup(name) == nil {
+			return nil, fmt.Errorf("spider %s configured is not registered, registered: %s",
+				name, strings.Join(names, ", "))
+		}
+	}
+	for _, name := range names {
+		s, buildErr := Build(name, configs[name], options...)
+		if buildErr != nil {
+			if err == nil {
+				err = buildErr
+			}
+			continue
+		}
+		spiders = append(spiders, s)
+	}
+	return
+}
+
+// BuildAndInitAll returns all of the registered spiders without config,
+// options are applied to each spider.
+func BuildAndInitAll(options ...func(*Spider)) []*Spider {
+	spiders, _ := BuildAll(nil, options...)
+	return spiders
+}
+
+// NewSpider creates a new registered Spider with name and default configurations,
+// options are applied after the default configurations. It returns nil if failed.
+func NewSpider(name string, lr *colly.LimitRule, options ...func(*Spider)) *Spider {
+	s, err := Build(name, SourceConfig{}, append([]func(*Spider){Limit(lr)}, options...)...)
+	if err != nil {
 		return nil
 	}
+	return s
 }
 
 type xiciSpider struct{}
@@ -178,12 +377,9 @@ func (s xilaSpider) Parse(e *colly.XMLElement) (ip, port string) {
 type nimaSpider struct{}
 
 func (s nimaSpider) Urls() (urls []string) {
-	urls = append(urls, "http://www.nimadaili.com/")
 	baseURL := "http://www.nimadaili.com"
-	for page := 1; page <= 20; page++ {
-		for _, domain := range []string{"gaoni", "http", "https"} {
-			urls = append(urls, fmt.Sprintf("%s/%s/%d", baseURL, domain, page))
-		}
+	for _, domain := range []string{"gaoni", "http", "https"} {
+		urls = append(urls, fmt.Sprintf("%s/%s/%s", baseURL, domain, PagePlaceholder))
 	}
 	return
 }
@@ -202,11 +398,7 @@ func (s nimaSpider) Parse(e *colly.XMLElement) (ip, port string) {
 type eightnineSpider struct{}
 
 func (s eightnineSpider) Urls() (urls []string) {
-	baseURL := "http://www.89ip.cn"
-	for page := 1; page <= 15; page++ {
-		urls = append(urls, fmt.Sprintf("%s/index_%d.html", baseURL, page))
-	}
-	return
+	return []string{"http://www.89ip.cn/index_" + PagePlaceholder + ".html"}
 }
 func (s eightnineSpider) Query() string {
 	return `//tbody/tr`
@@ -0,0 +1,229 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/gocolly/colly"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// listingParser is a Parser of proxyListPage, whose url is an option.
+type listingParser struct {
+	url string
+}
+
+func (p listingParser) Urls() []string {
+	return []string{p.url}
+}
+
+func (p listingParser) Query() string {
+	return `//table[@id="list"]/tbody/tr[td]`
+}
+
+func (p listingParser) Parse(e *colly.XMLElement) (ip, port string) {
+	return e.ChildText("td[1]"), e.ChildText("td[2]")
+}
+
+func newListingParser(options map[string]string) (SourceParser, error) {
+	if options["url"] == "" {
+		return nil, errors.New("option url is required")
+	}
+	return listingParser{url: options["url"]}, nil
+}
+
+// feedParser is a BodyParser of the lines `<protocol> <ip> <port> <username> <password>`.
+type feedParser struct {
+	url string
+}
+
+func (p feedParser) Urls() []string {
+	return []string{p.url}
+}
+
+func (p feedParser) ParseBody(body []byte) (records []Record) {
+	for _, line := range strings.Split(string(body), "\n") {
+		if fields := strings.Fields(line); len(fields) == 5 {
+			records = append(records, Record{
+				Protocol: proxy.ParseProtocol(fields[0]),
+				IP:       fields[1],
+				Port:     fields[2],
+				Username: fields[3],
+				Password: fields[4],
+			})
+		}
+	}
+	return
+}
+
+// urlsOnly is a SourceParser which parses nothing.
+type urlsOnly []string
+
+func (u urlsOnly) Urls() []string {
+	return u
+}
+
+// unregister removes the spider registered by tests.
+func unregister(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for i, r := range registry {
+		if r.name == name {
+			registry = append(registry[:i], registry[i+1:]...)
+			return
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, proxyListPage)
+	}))
+	defer ts.Close()
+
+	Register("listing", newListingParser, CoolDownTime(0))
+	defer unregister("listing")
+	assert.Equal(t, "listing", Registered()[len(Registered())-1])
+	assert.Panics(t, func() { Register("listing", newListingParser) })
+	assert.Panics(t, func() { Register("nil", nil) })
+
+	_, err := Build("listing", SourceConfig{})
+	assert.NotNil(t, err)
+	_, err = Build("unregistered", SourceConfig{})
+	assert.NotNil(t, err)
+
+	s, err := Build("listing", SourceConfig{
+		Limit:   &LimitDefinition{Parallelism: 1},
+		Options: map[string]string{"url": ts.URL},
+	})
+	if assert.Nil(t, err) {
+		rc := &recordingChan{}
+		s.ch = rc
+		s.crawlOnce()
+		assert.Equal(t, []string{" 1.2.3.4:80", " 5.6.7.8:1080"}, rc.records())
+	}
+
+	disabled := false
+	spiders, err := BuildAll(map[string]SourceConfig{
+		NameOfXici: {Enable: &disabled},
+		"listing":  {Options: map[string]string{"url": ts.URL}},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, spiders, len(Registered()))
+	for _, s := range spiders {
+		assert.Equal(t, s.Name() != NameOfXici, s.Enabled(), s.Name())
+	}
+	spiders, err = BuildAll(nil)
+	assert.NotNil(t, err)
+	assert.Len(t, spiders, len(Registered())-1)
+	_, err = BuildAll(map[string]SourceConfig{"unregistered": {}})
+	assert.NotNil(t, err)
+}
+
+func TestRegisterBodyParser(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "socks5 1.2.3.4 1080 user secret\n")
+	}))
+	defer ts.Close()
+	Register("feed", func(map[string]string) (SourceParser, error) {
+		return feedParser{url: ts.URL}, nil
+	}, CoolDownTime(0))
+	defer unregister("feed")
+	Register("unparsable", func(map[string]string) (SourceParser, error) {
+		return urlsOnly{"http://localhost"}, nil
+	})
+	defer unregister("unparsable")
+
+	s, err := Build("feed", SourceConfig{Limit: &LimitDefinition{Parallelism: 1}})
+	if assert.Nil(t, err) {
+		rc := &recordingChan{}
+		s.ch = rc
+		s.crawlOnce()
+		if assert.Len(t, rc.proxies, 1) {
+			pxy := rc.proxies[0]
+			assert.Equal(t, "1.2.3.4", pxy.IP.String())
+			assert.Equal(t, proxy.SOCKS5, pxy.Protocol)
+			assert.Equal(t, "user", pxy.Username)
+			assert.Equal(t, "secret", pxy.Password)
+		}
+	}
+	_, err = Build("unparsable", SourceConfig{})
+	assert.NotNil(t, err)
+}
+
+func TestSourcesFromConfig(t *testing.T) {
+	Register("listing", newListingParser)
+	defer unregister("listing")
+	t.Setenv("INTELLI_PROXY_SPIDER_SOURCES_KUAI_ENABLE", "false")
+
+	newConfig := func(data string) *viper.Viper {
+		v := viper.New()
+		v.SetEnvPrefix("INTELLI_PROXY")
+		v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+		v.AutomaticEnv()
+		v.SetConfigType("yaml")
+		assert.Nil(t, v.ReadConfig(bytes.NewBufferString(data)))
+		return v
+	}
+	sources, err := SourcesFromConfig(newConfig(`
+spider:
+  sources:
+    xici:
+      enable: false
+    listing:
+      period: 10m
+      cool_down: 5s
+      limit:
+        delay: 1s
+      options:
+        url: http://localhost/list
+`))
+	assert.Nil(t, err)
+	assert.Len(t, sources, len(Registered()))
+	assert.False(t, sources[NameOfXici].Enabled())
+	assert.False(t, sources[NameOfKuai].Enabled())
+	assert.True(t, sources[NameOfYun].Enabled())
+	listing := sources["listing"]
+	assert.True(t, listing.Enabled())
+	assert.Equal(t, 10*time.Minute, listing.Period)
+	assert.Equal(t, 5*time.Second, listing.CoolDown)
+	assert.Equal(t, &LimitDefinition{Delay: time.Second}, listing.Limit)
+	assert.Equal(t, map[string]string{"url": "http://localhost/list"}, listing.Options)
+
+	sources, err = SourcesFromConfig(newConfig(`
+spider:
+  period: 1h
+  limit:
+    parallelism: 2
+  sources:
+    listing:
+      period: 10m
+      limit:
+        delay: 1s
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, 10*time.Minute, sources["listing"].Period)
+	assert.Equal(t, &LimitDefinition{Delay: time.Second}, sources["listing"].Limit)
+	assert.Equal(t, time.Hour, sources[NameOfYun].Period)
+	assert.Equal(t, &LimitDefinition{Parallelism: 2}, sources[NameOfYun].Limit)
+
+	_, err = SourcesFromConfig(newConfig(`
+spider:
+  sources:
+    unregistered:
+      enable: true
+`))
+	assert.NotNil(t, err)
+}
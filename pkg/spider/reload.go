@@ -0,0 +1,69 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefinitionWatcher reloads the definitions when the files of them change.
+type DefinitionWatcher struct {
+	path  string
+	fn    func(defs []*Definition, err error)
+	stamp string
+}
+
+// NewDefinitionWatcher returns a watcher of the definitions in path, see LoadDefinitions.
+// fn is called with the definitions loaded, or the error if failed to load them.
+func NewDefinitionWatcher(path string, fn func(defs []*Definition, err error)) *DefinitionWatcher {
+	return &DefinitionWatcher{path: path, fn: fn}
+}
+
+// Check loads the definitions if any file is added, removed or modified
+// since the last check, and reports whether they are loaded.
+// The first check always loads them.
+func (w *DefinitionWatcher) Check() bool {
+	stamp := w.currentStamp()
+	if stamp == w.stamp {
+		return false
+	}
+	w.stamp = stamp
+	w.fn(LoadDefinitions(w.path))
+	return true
+}
+
+// Run checks the definitions every period until ctx is done.
+func (w *DefinitionWatcher) Run(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// currentStamp returns the names, sizes and modification times of the files,
+// which changes when the definitions change.
+func (w *DefinitionWatcher) currentStamp() string {
+	files, err := definitionFiles(w.path)
+	if err != nil {
+		return err.Error()
+	}
+	var b strings.Builder
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			fmt.Fprintf(&b, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/andybalholm/cascadia"
+	"github.com/antchfx/xpath"
+	"github.com/gocolly/colly"
+	"github.com/tidwall/gjson"
+)
+
+// htmlParser is the RecordParser of html sources.
+type htmlParser struct {
+	urls []string
+	def  ParserDefinition
+}
+
+func newHTMLParser(urls []string, def ParserDefinition) (*htmlParser, error) {
+	var compileQuery func(string) error
+	switch def.Selector {
+	case "", SelectorXPath:
+		compileQuery = func(q string) error {
+			_, err := xpath.Compile(q)
+			return err
+		}
+	case SelectorCSS:
+		compileQuery = func(q string) error {
+			_, err := cascadia.Compile(q)
+			return err
+		}
+	default:
+		return nil, fmt.Errorf("unknown selector %q", def.Selector)
+	}
+	if def.Query == "" || def.IP.Path == "" || def.Port.Path == "" {
+		return nil, fmt.Errorf("query, ip and port of parser are required")
+	}
+	if err := compileQuery(def.Query); err != nil {
+		return nil, fmt.Errorf("invalid query %q, %v", def.Query, err)
+	}
+	p := &htmlParser{urls: urls, def: def}
+	for field, x := range p.def.extractors() {
+		if err := x.compile(field, compileQuery); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *htmlParser) Urls() []string {
+	return p.urls
+}
+
+func (p *htmlParser) Query() string {
+	return p.def.Query
+}
+
+func (p *htmlParser) Parse(e *colly.XMLElement) (ip, port string) {
+	rec := p.ParseRecord(e)
+	return rec.IP, rec.Port
+}
+
+func (p *htmlParser) CSS() bool {
+	return p.def.Selector == SelectorCSS
+}
+
+func (p *htmlParser) ParseRecord(e Element) Record {
+	return p.def.complete(Record{
+		IP:       p.def.IP.extract(e),
+		Port:     p.def.Port.extract(e),
+		Protocol: proxy.ParseProtocol(p.def.Protocol.extract(e)),
+		Username: p.def.Username.extract(e),
+		Password: p.def.Password.extract(e),
+	})
+}
+
+// jsonParser is the BodyParser of json sources.
+type jsonParser struct {
+	urls []string
+	def  ParserDefinition
+}
+
+func newJSONParser(urls []string, def ParserDefinition) (*jsonParser, error) {
+	if def.IP.Path == "" || def.Port.Path == "" {
+		return nil, fmt.Errorf("ip and port of parser are required")
+	}
+	p := &jsonParser{urls: urls, def: def}
+	for field, x := range p.def.extractors() {
+		if err := x.compile(field, nil); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *jsonParser) Urls() []string {
+	return p.urls
+}
+
+// ParseBody parses the records in the array found by query,
+// or the record itself if an object found.
+func (p *jsonParser) ParseBody(body []byte) (records []Record) {
+	if !gjson.ValidBytes(body) {
+		return nil
+	}
+	found := gjson.ParseBytes(body)
+	if p.def.Query != "" {
+		found = found.Get(p.def.Query)
+	}
+	parse := func(r gjson.Result) {
+		field := func(x *Extractor) string {
+			if x.Path == "" {
+				return ""
+			}
+			return x.post(r.Get(x.Path).String())
+		}
+		records = append(records, p.def.complete(Record{
+			IP:       field(&p.def.IP),
+			Port:     field(&p.def.Port),
+			Protocol: proxy.ParseProtocol(field(&p.def.Protocol)),
+			Username: field(&p.def.Username),
+			Password: field(&p.def.Password),
+		}))
+	}
+	switch {
+	case found.IsArray():
+		found.ForEach(func(_, r gjson.Result) bool {
+			parse(r)
+			return true
+		})
+	case found.IsObject():
+		parse(found)
+	}
+	return
+}
+
+// defaultTextPattern matches the lines like `[protocol://][username:password@]ip:port`.
+const defaultTextPattern = `(?m)^\s*(?:(?P<protocol>[a-zA-Z0-9]+)://)?(?:(?P<username>[^:@\s]+):(?P<password>[^@\s]*)@)?` +
+	`(?P<ip>\d{1,3}(?:\.\d{1,3}){3}):(?P<port>\d{1,5})\b`
+
+// textParser is the BodyParser of text sources.
+type textParser struct {
+	urls []string
+	re   *regexp.Regexp
+	def  ParserDefinition
+}
+
+func newTextParser(urls []string, def ParserDefinition) (*textParser, error) {
+	pattern := def.Query
+	if pattern == "" {
+		pattern = defaultTextPattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query, %v", err)
+	}
+	if re.SubexpIndex("ip") < 0 || re.SubexpIndex("port") < 0 {
+		return nil, fmt.Errorf("query must have the groups named ip and port")
+	}
+	return &textParser{urls: urls, re: re, def: def}, nil
+}
+
+func (p *textParser) Urls() []string {
+	return p.urls
+}
+
+func (p *textParser) ParseBody(body []byte) (records []Record) {
+	for _, match := range p.re.FindAllSubmatch(body, -1) {
+		group := func(name string) string {
+			if i := p.re.SubexpIndex(name); i >= 0 {
+				return string(match[i])
+			}
+			return ""
+		}
+		records = append(records, p.def.complete(Record{
+			IP:       group("ip"),
+			Port:     group("port"),
+			Protocol: proxy.ParseProtocol(group("protocol")),
+			Username: group("username"),
+			Password: group("password"),
+		}))
+	}
+	return
+}
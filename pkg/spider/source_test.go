@@ -0,0 +1,96 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// crawlDefinition crawls once by the spider defined by data, and returns the records sent.
+func crawlDefinition(t *testing.T, data string) []string {
+	defs, err := ParseDefinitions([]byte(data))
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	s, err := NewSpiderFromDefinition(defs[0], CoolDownTime(0))
+	assert.Nil(t, err)
+	rc := &recordingChan{}
+	s.ch = rc
+	s.crawlOnce()
+	var records []string
+	for _, pxy := range rc.proxies {
+		records = append(records, fmt.Sprintf("%s %s", pxy.Protocol, pxy.URL()))
+	}
+	return records
+}
+
+func TestJSONSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"data": [
+			{"ip": "1.2.3.4", "port": 80, "protocols": ["https"]},
+			{"ip": "5.6.7.8", "port": "1080", "protocols": ["socks5"], "auth": {"user": "u", "pass": "p"}},
+			{"ip": "invalid", "port": 80}
+		]}`)
+	}))
+	defer ts.Close()
+
+	records := crawlDefinition(t, fmt.Sprintf(`
+- name: api
+  kind: json
+  urls: ['%s']
+  parser:
+    query: data
+    ip: ip
+    port: port
+    protocol: protocols.0
+    username: auth.user
+    password: auth.pass
+  limit: {parallelism: 1}
+`, ts.URL))
+	assert.Equal(t, []string{"https http://1.2.3.4:80", "socks5 socks5://u:p@5.6.7.8:1080"}, records)
+}
+
+func TestTextSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "list.txt")
+	assert.Nil(t, os.WriteFile(path, []byte(
+		"# free proxies\n1.2.3.4:80\nsocks4://5.6.7.8:1080\nhttp://u:p@9.9.9.9:3128\nnot a proxy\n"), 0644))
+
+	records := crawlDefinition(t, fmt.Sprintf(`
+- name: list
+  kind: text
+  urls: ['file://%s']
+  parser:
+    default_protocol: https
+  limit: {parallelism: 1}
+`, path))
+	assert.Equal(t, []string{
+		"https http://1.2.3.4:80", "socks4 socks4://5.6.7.8:1080", "http http://u:p@9.9.9.9:3128",
+	}, records)
+
+	assert.Nil(t, os.WriteFile(path, []byte("1.2.3.4 80 socks5\n5.6.7.8 8080 http\n"), 0644))
+	records = crawlDefinition(t, fmt.Sprintf(`
+- name: list
+  kind: text
+  urls: ['file://%s']
+  parser:
+    query: '(?P<ip>[\d.]+) (?P<port>\d+) (?P<protocol>\w+)'
+  limit: {parallelism: 1}
+`, path))
+	assert.Equal(t, []string{"socks5 socks5://1.2.3.4:80", "http http://5.6.7.8:8080"}, records)
+
+	_, err := ParseDefinitions([]byte(`- {name: list, kind: text, urls: [http://a.com], parser: {query: '(\d+)'}}`))
+	assert.NotNil(t, err)
+	_, err = ParseDefinitions([]byte(`- {name: list, kind: csv, urls: [http://a.com]}`))
+	assert.NotNil(t, err)
+}
@@ -5,18 +5,31 @@
 package spider
 
 import (
+	"context"
+	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	browser "github.com/EDDYCJY/fake-useragent"
 	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
 	"github.com/Sirupsen/logrus"
 	"github.com/gocolly/colly"
 )
 
-type spiderCoreParser interface {
+// SourceParser is the common method of all parsers, a registered spider's
+// parser is also a Parser, a RecordParser or a BodyParser.
+type SourceParser interface {
 	// Urls 返回spider要爬取的所有url
 	Urls() []string
+}
+
+// Parser parses the proxies listed in the HTML pages of a source,
+// which is implemented by the spiders registered by Register.
+type Parser interface {
+	// Urls 返回spider要爬取的所有url，分页的url可以包含PagePlaceholder
+	Urls() []string
 	// Query 用于找到爬取的XML中一条代理记录tr(子节点有td存储ip和port)，是一个xpath表达式，
 	// 会注册到OnXML回调
 	Query() string
@@ -24,6 +37,37 @@ type spiderCoreParser interface {
 	Parse(e *colly.XMLElement) (ip, port string)
 }
 
+// Record is a proxy parsed from the source, the fields except IP and Port may be empty.
+type Record struct {
+	IP, Port           string
+	Protocol           proxy.Protocol
+	Username, Password string
+}
+
+// Element is the common methods of colly.XMLElement and colly.HTMLElement.
+type Element interface {
+	ChildText(query string) string
+	ChildAttr(query, attr string) string
+}
+
+// RecordParser is implemented by the parsers which may find the records by CSS
+// selector instead of xpath, and parse the protocol and credentials of a record too.
+type RecordParser interface {
+	Parser
+	// CSS reports whether Query is a CSS selector.
+	CSS() bool
+	// ParseRecord parses a record found by Query.
+	ParseRecord(e Element) Record
+}
+
+// BodyParser is implemented by the parsers of the sources which are not HTML,
+// e.g. JSON APIs and plain text lists.
+type BodyParser interface {
+	SourceParser
+	// ParseBody parses all the records in the body of a response.
+	ParseBody(body []byte) []Record
+}
+
 const (
 	Idle = iota
 	Crawling
@@ -32,36 +76,90 @@ const (
 
 // Spider provides the instance for crawling jobs.
 type Spider struct {
-	name      string
-	parser    spiderCoreParser
-	c         *colly.Collector
-	ch        proxy.CachedChan
-	logger    *logrus.Entry
-	period    time.Duration
-	coolDown  time.Duration
-	state     uint32
-	needCrawl chan bool
-}
-
-func newSpider(name string, parser spiderCoreParser, options ...func(*Spider)) *Spider {
-	s := &Spider{name: name, parser: parser, state: Idle, needCrawl: make(chan bool)}
+	name string
+	// mu guards parser, c, period, coolDown and pagination, which are replaced by Redefine,
+	// and ctx which is set by Start.
+	mu       sync.RWMutex
+	ctx      context.Context // done when the spider is stopped
+	parser   SourceParser
+	c        *colly.Collector
+	limit    *colly.LimitRule
+	ch       proxy.CachedChan
+	logger   *logrus.Entry
+	period   time.Duration
+	coolDown time.Duration
+	// pagination discovers the pages from the urls of parser if not nil
+	pagination *Pagination
+	nextPage   string   // the link to next page found on the page crawling
+	pageIPs    []string // the IPs found on the page crawling if paginating, guarded by statsMu
+	state      uint32
+	disabled   int32
+	needCrawl  chan bool
+	bus        *pubsub.Bus
+	pool       *Pool         // crawls through the proxies in pool if not nil
+	deadAfter  int           // barren crawls after which the spider is dead, zero disables
+	reprobe    time.Duration // interval of crawls when dead
+	rewrite    func(url string) string
+	statsMu    sync.Mutex
+	stats      Stats
+}
+
+// failingThreshold is the number of consecutive crawls which found no valid proxy,
+// after which the spider publishes `spider.<name>.crawl.failing` for every crawl.
+const failingThreshold = 3
+
+// CrawlEvent is published when a spider starts or finishes crawling, under topic
+// `spider.<name>.crawl.start` and `spider.<name>.crawl.done`, and also
+// `spider.<name>.crawl.failing` when it found no valid proxy repeatedly.
+type CrawlEvent struct {
+	Spider  string
+	Found   int           // records found, only set when done
+	Valid   int           // valid proxies found, only set when done
+	New     int           // proxies not found before, only set when done
+	Failed  int           // urls failed to crawl, only set when done
+	Elapsed time.Duration // only set when done
+	// Failures is the number of consecutive crawls which found no valid proxy.
+	Failures int
+}
+
+func newSpider(name string, parser SourceParser, options ...func(*Spider)) *Spider {
+	s := &Spider{
+		name:      name,
+		ctx:       context.Background(),
+		parser:    parser,
+		state:     Idle,
+		needCrawl: make(chan bool),
+		deadAfter: defaultDeadAfter,
+		reprobe:   defaultReprobe,
+		stats:     Stats{Spider: name},
+	}
 	s.init()
 
 	for _, opt := range options {
 		opt(s)
 	}
 
+	s.applyLimit()
 	s.registerCallbacks()
 
 	return s
 }
 
-// Limit sets the rule used by the Collector.
+// Limit sets the rule used by the Collector, the last one wins.
 func Limit(rule *colly.LimitRule) func(*Spider) {
 	return func(s *Spider) {
-		if err := s.c.Limit(rule); err != nil {
-			panic(err)
-		}
+		s.limit = rule
+	}
+}
+
+// applyLimit applies the limit rule to the Collector after options,
+// since the rules of Collector can only be appended, the first matched wins.
+func (s *Spider) applyLimit() {
+	if s.limit == nil {
+		return
+	}
+	if err := s.c.Limit(s.limit); err != nil {
+		panic(err)
 	}
 }
 
@@ -81,6 +179,21 @@ func CoolDownTime(d time.Duration) func(*Spider) {
 	}
 }
 
+// PublishTo sets the bus which the spider publishes crawling events to.
+func PublishTo(bus *pubsub.Bus) func(*Spider) {
+	return func(s *Spider) {
+		s.bus = bus
+	}
+}
+
+// RewriteURLs rewrites the urls of spider before crawling, e.g. to crawl a mirror,
+// or to replay the pages saved from the site.
+func RewriteURLs(rewrite func(url string) string) func(*Spider) {
+	return func(s *Spider) {
+		s.rewrite = rewrite
+	}
+}
+
 // Init initializes the Spider's private variables
 // and sets default configuration for the Spider
 func (s *Spider) init() {
@@ -90,6 +203,11 @@ func (s *Spider) init() {
 		colly.MaxDepth(1),
 		colly.AllowURLRevisit(),
 	)
+	if s.pool != nil {
+		s.c.WithTransport(s.pool.transport(newTransport()))
+	} else {
+		s.c.WithTransport(newTransport())
+	}
 	logger := logrus.New()
 	logger.Formatter = &logrus.TextFormatter{FullTimestamp: true}
 	s.logger = logger.WithFields(logrus.Fields{
@@ -97,6 +215,14 @@ func (s *Spider) init() {
 	})
 }
 
+// newTransport returns the transport of collectors.
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// local files are crawled by file:// urls
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return transport
+}
+
 // registerCallbacks registers some callbacks after option spider.
 func (s *Spider) registerCallbacks() {
 	s.c.OnRequest(func(r *colly.Request) {
@@ -107,43 +233,160 @@ func (s *Spider) registerCallbacks() {
 		s.logger.Infof("Crawl %s done", r.Request.URL)
 	})
 
-	s.c.OnXML(s.parser.Query(), func(e *colly.XMLElement) {
-		ip, port := s.parser.Parse(e)
-		if s.ch != nil {
-			s.ch.Send(ip, port)
+	switch parser := s.parser.(type) {
+	case BodyParser:
+		s.c.OnResponse(func(r *colly.Response) {
+			for _, rec := range parser.ParseBody(r.Body) {
+				s.send(rec)
+			}
+		})
+	case RecordParser:
+		if parser.CSS() {
+			s.c.OnHTML(parser.Query(), func(e *colly.HTMLElement) {
+				s.send(parser.ParseRecord(e))
+			})
 		} else {
-			s.logger.Infof("%s:%s\n", ip, port)
+			s.c.OnXML(parser.Query(), func(e *colly.XMLElement) {
+				s.send(parser.ParseRecord(e))
+			})
 		}
-	})
+	case Parser:
+		s.c.OnXML(parser.Query(), func(e *colly.XMLElement) {
+			ip, port := parser.Parse(e)
+			s.send(Record{IP: ip, Port: port})
+		})
+	}
+	s.registerPagination()
+}
+
+// send sends a record found to the cached channel.
+func (s *Spider) send(rec Record) {
+	pxy, err := proxy.NewProxy(rec.IP, rec.Port)
+	if err == nil {
+		pxy.Protocol = rec.Protocol
+		pxy.Username, pxy.Password = rec.Username, rec.Password
+		pxy.Source = s.name
+	}
+	fresh := false
+	switch {
+	case s.ch == nil:
+		s.logger.Infof("%s:%s\n", rec.IP, rec.Port)
+	case err == nil:
+		fresh = s.ch.SendProxy(pxy)
+	}
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.stats.Rows++
+	if err == nil {
+		s.stats.Valid++
+		if s.pageIPs != nil {
+			s.pageIPs = append(s.pageIPs, pxy.IP.String())
+		}
+	}
+	if fresh {
+		s.stats.New++
+	}
+}
+
+// Name returns the name of spider.
+func (s *Spider) Name() string {
+	return s.name
+}
+
+// Enable lets the spider crawl again after disabled, and revives it if dead.
+func (s *Spider) Enable() {
+	atomic.StoreInt32(&s.disabled, 0)
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.stats.Dead, s.stats.BarrenCrawls = false, 0
+}
+
+// Disable stops the spider crawling, until it is enabled again.
+func (s *Spider) Disable() {
+	atomic.StoreInt32(&s.disabled, 1)
+}
+
+// Enabled reports whether the spider crawls.
+func (s *Spider) Enabled() bool {
+	return atomic.LoadInt32(&s.disabled) == 0
+}
+
+// redefine replaces the parser and configurations of the spider with the ones of ns,
+// the crawling in progress finishes with the old ones.
+func (s *Spider) redefine(ns *Spider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parser, s.c, s.period, s.coolDown, s.pagination = ns.parser, ns.c, ns.period, ns.coolDown, ns.pagination
+	s.registerCallbacks()
 }
 
 // crawlOnce traverses urls and visit for each url and send it to cached channel.
 func (s *Spider) crawlOnce() {
-	if !atomic.CompareAndSwapUint32(&s.state, Idle, Crawling) {
+	if !s.Enabled() || !s.due() || !atomic.CompareAndSwapUint32(&s.state, Idle, Crawling) {
 		return
 	}
+	s.mu.RLock()
+	ctx, parser, c, coolDown, pagination := s.ctx, s.parser, s.c, s.coolDown, s.pagination
+	s.mu.RUnlock()
 	s.logger.Info("Start crawling once")
-	for _, url := range s.parser.Urls() {
-		if err := s.c.Visit(url); err != nil {
+	s.bus.Publish(pubsub.Topic("spider", s.name, "crawl", "start"), &CrawlEvent{Spider: s.name})
+	start, failed, before := time.Now(), 0, s.Stats()
+	for _, url := range parser.Urls() {
+		// finishes the page crawling only when stopped
+		if ctx.Err() != nil {
+			break
+		}
+		if s.rewrite != nil {
+			url = s.rewrite(url)
+		}
+		if pagination != nil {
+			failed += s.crawlPages(ctx, c, pagination, url)
+		} else if err := c.Visit(url); err != nil {
+			failed++
 			s.logger.Warnf("Failed to crawl %s, %v", url, err)
 		}
 	}
 	s.logger.Info("Finish crawling once")
+	event, transition := s.record(before, failed, time.Since(start))
+	s.bus.Publish(pubsub.Topic("spider", s.name, "crawl", "done"), event)
+	if event.Failures >= failingThreshold {
+		s.bus.Publish(pubsub.Topic("spider", s.name, "crawl", "failing"), event)
+	}
+	if transition != "" {
+		s.logger.Warnf("Spider is %s, %d consecutive crawls found no valid proxy", transition, event.Failures)
+		s.bus.Publish(pubsub.Topic("spider", s.name, transition), s.Stats())
+	}
 	atomic.CompareAndSwapUint32(&s.state, Crawling, CoolDown)
-	s.logger.Infof("Enter %f s cool down time", s.coolDown.Seconds())
-	time.Sleep(s.coolDown)
+	s.logger.Infof("Enter %f s cool down time", coolDown.Seconds())
+	select {
+	case <-time.After(coolDown):
+	case <-ctx.Done():
+	}
 	atomic.CompareAndSwapUint32(&s.state, CoolDown, Idle)
 }
 
-// TryCrawl sends object to needCrawl chan when this spider id IDLE.
-func (s *Spider) TryCrawl() {
+// TryCrawl sends object to needCrawl chan when this spider id IDLE,
+// and reports whether it is sent, false if the spider is busy or stopped.
+func (s *Spider) TryCrawl() bool {
 	if atomic.LoadUint32(&s.state) == Idle {
-		s.needCrawl <- true
+		s.mu.RLock()
+		ctx := s.ctx
+		s.mu.RUnlock()
+		select {
+		case s.needCrawl <- true:
+			return true
+		case <-ctx.Done():
+		}
 	}
+	return false
 }
 
-// Start calls crawlOnce after sleeping the period duration or when receiving a re-crawl chan.
-func (s *Spider) Start(ch proxy.CachedChan) {
+// Start calls crawlOnce after sleeping the period duration or when receiving a re-crawl chan,
+// until ctx is done. The page crawling when ctx is done is finished before returning.
+func (s *Spider) Start(ctx context.Context, ch proxy.CachedChan) {
+	s.mu.Lock()
+	s.ctx = ctx
+	s.mu.Unlock()
 	s.ch = ch
 	ticker := time.NewTicker(s.period)
 	defer ticker.Stop()
@@ -153,6 +396,12 @@ func (s *Spider) Start(ch proxy.CachedChan) {
 			s.crawlOnce()
 		case <-ticker.C:
 			s.crawlOnce()
+		case <-ctx.Done():
+			return
 		}
+		// the period may be changed by Redefine
+		s.mu.RLock()
+		ticker.Reset(s.period)
+		s.mu.RUnlock()
 	}
 }
@@ -0,0 +1,60 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpiderStop(t *testing.T) {
+	var requests int32
+	crawling, release := make(chan struct{}), make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			close(crawling)
+			<-release
+		}
+		fmt.Fprint(w, proxyListPage)
+	}))
+	defer ts.Close()
+
+	defs, err := ParseDefinitions([]byte(fmt.Sprintf(`
+- name: demo
+  urls: ['%s/{1...3}']
+  parser: {query: '//table[@id="list"]/tbody/tr[position()>1]', ip: 'td[1]', port: 'td[2]'}
+  limit: {parallelism: 1}
+`, ts.URL)))
+	assert.Nil(t, err)
+	s, err := NewSpiderFromDefinition(defs[0], CoolDownTime(time.Hour))
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := &recordingChan{}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.Start(ctx, rc)
+	}()
+	assert.True(t, s.TryCrawl())
+	<-crawling
+	cancel()
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("spider not stopped")
+	}
+	// the page crawling is finished, and the others are skipped
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, []string{" 1.2.3.4:80", " 5.6.7.8:1080"}, rc.records())
+	assert.False(t, s.TryCrawl())
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"math"
+	"time"
+)
+
+// Transitions of dead spiders, published under `spider.<name>.<transition>`
+// with the *Stats of spider.
+const (
+	TransitionDead    = "dead"
+	TransitionRevived = "revived"
+)
+
+var (
+	defaultDeadAfter = 6
+	defaultReprobe   = 24 * time.Hour
+)
+
+// Stats is the yield statistics of a spider.
+type Stats struct {
+	Spider     string `json:"spider"`
+	Crawls     uint64 `json:"crawls"`
+	HTTPErrors uint64 `json:"http_errors"` // urls failed to crawl
+	Rows       uint64 `json:"rows"`        // records parsed
+	Valid      uint64 `json:"valid"`       // valid proxies in the records
+	New        uint64 `json:"new"`         // valid proxies not found before by any spider
+	Survived   uint64 `json:"survived"`    // new proxies inserted to backend after scoring
+	Enabled    bool   `json:"enabled"`
+	// Dead is true when the spider found no valid proxy in DeadAfter crawls,
+	// it is re-probed rarely until it finds some again.
+	Dead bool `json:"dead"`
+	// BarrenCrawls is the number of consecutive crawls which found no valid proxy.
+	BarrenCrawls int       `json:"barren_crawls"`
+	LastCrawlAt  time.Time `json:"last_crawl_at"`
+}
+
+// Yield is the number of proxies survived per crawl, which ranks the spiders
+// crawling on demand. It is +Inf if never crawled, so new spiders are tried first.
+func (st Stats) Yield() float64 {
+	if st.Crawls == 0 {
+		return math.Inf(1)
+	}
+	return float64(st.Survived) / float64(st.Crawls)
+}
+
+// DeadAfter sets the number of consecutive crawls finding no valid proxy,
+// after which the spider is dead, zero means never. Default is 6.
+func DeadAfter(crawls int) func(*Spider) {
+	return func(s *Spider) {
+		s.deadAfter = crawls
+	}
+}
+
+// ReprobeEvery sets the interval of crawls when the spider is dead, default is 24h.
+func ReprobeEvery(d time.Duration) func(*Spider) {
+	return func(s *Spider) {
+		s.reprobe = d
+	}
+}
+
+// Stats returns the statistics of spider.
+func (s *Spider) Stats() Stats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	stats := s.stats
+	stats.Enabled = s.Enabled()
+	return stats
+}
+
+// Survived counts a proxy found by the spider, which is inserted to backend after scoring.
+func (s *Spider) Survived() {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.stats.Survived++
+}
+
+// due reports whether the spider should crawl, a dead spider only crawls once per reprobe.
+func (s *Spider) due() bool {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return !s.stats.Dead || time.Since(s.stats.LastCrawlAt) >= s.reprobe
+}
+
+// record records a crawl given the stats before it, and returns the event of
+// crawl, and the transition of the spider if dead or revived.
+func (s *Spider) record(before Stats, failed int, elapsed time.Duration) (event *CrawlEvent, transition string) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.stats.Crawls++
+	s.stats.HTTPErrors += uint64(failed)
+	s.stats.LastCrawlAt = time.Now()
+	event = &CrawlEvent{
+		Spider:  s.name,
+		Found:   int(s.stats.Rows - before.Rows),
+		Valid:   int(s.stats.Valid - before.Valid),
+		New:     int(s.stats.New - before.New),
+		Failed:  failed,
+		Elapsed: elapsed,
+	}
+	if event.Valid == 0 {
+		s.stats.BarrenCrawls++
+	} else {
+		s.stats.BarrenCrawls = 0
+	}
+	event.Failures = s.stats.BarrenCrawls
+	switch {
+	case s.stats.Dead && event.Valid > 0:
+		s.stats.Dead = false
+		transition = TransitionRevived
+	case !s.stats.Dead && s.deadAfter > 0 && s.stats.BarrenCrawls >= s.deadAfter:
+		s.stats.Dead = true
+		transition = TransitionDead
+	}
+	return
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package spider
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsAndDeadSpider(t *testing.T) {
+	var alive int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if atomic.LoadInt32(&alive) == 1 {
+			fmt.Fprint(w, "1.2.3.4:80\n1.2.3.4:80\n5.6.7.8:8080\n999.1.1.1:80\n")
+		}
+	}))
+	defer ts.Close()
+
+	bus := pubsub.NewBus()
+	var mu sync.Mutex
+	var transitions []string
+	bus.Subscribe("spider.*.*", func(msg *pubsub.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		transitions = append(transitions, msg.Topic)
+	})
+	defs, err := ParseDefinitions([]byte(fmt.Sprintf(`
+- name: list
+  kind: text
+  urls: ['%[1]s/list.txt', '%[1]s/missing']
+  parser:
+    query: '(?P<ip>\d+\.\d+\.\d+\.\d+):(?P<port>\d+)'
+  limit: {parallelism: 1}
+`, ts.URL)))
+	assert.Nil(t, err)
+	s, err := NewSpiderFromDefinition(defs[0], CoolDownTime(0), DeadAfter(2), ReprobeEvery(time.Hour), PublishTo(bus))
+	assert.Nil(t, err)
+	s.ch = &recordingChan{}
+
+	s.crawlOnce()
+	s.crawlOnce()
+	stats := s.Stats()
+	assert.True(t, stats.Dead)
+	assert.Equal(t, uint64(2), stats.Crawls)
+	assert.Equal(t, uint64(2), stats.HTTPErrors)
+	assert.Equal(t, 2, stats.BarrenCrawls)
+	// not due until re-probed
+	s.crawlOnce()
+	assert.Equal(t, uint64(2), s.Stats().Crawls)
+
+	atomic.StoreInt32(&alive, 1)
+	ReprobeEvery(0)(s)
+	s.crawlOnce()
+	s.Survived()
+	stats = s.Stats()
+	assert.False(t, stats.Dead)
+	assert.True(t, stats.Enabled)
+	assert.Equal(t, uint64(3), stats.Crawls)
+	assert.Equal(t, uint64(4), stats.Rows)
+	assert.Equal(t, uint64(3), stats.Valid)
+	assert.Equal(t, uint64(2), stats.New)
+	assert.Equal(t, uint64(1), stats.Survived)
+
+	bus.Flush()
+	assert.Equal(t, []string{"spider.list.dead", "spider.list.revived"}, transitions)
+}
+
+func TestStatsYield(t *testing.T) {
+	assert.True(t, math.IsInf(Stats{}.Yield(), 1))
+	assert.Equal(t, 0.0, Stats{Crawls: 4}.Yield())
+	assert.Equal(t, 2.5, Stats{Crawls: 4, Survived: 10}.Yield())
+}
@@ -15,21 +15,35 @@ import (
 
 // Errors occur when using backend.
 var (
-	ErrProxyInvalid       = errors.New("proxy is nil or score <= 0")
-	ErrProxyDuplicated    = errors.New("proxy is already in backend")
-	ErrProxyDoesNotExists = errors.New("proxy doesn't exists")
-	ErrProxyNoneAvailable = errors.New("proxy none available")
+	ErrProxyInvalid         = errors.New("proxy is nil or score <= 0")
+	ErrProxyDuplicated      = errors.New("proxy is already in backend")
+	ErrProxyDoesNotExists   = errors.New("proxy doesn't exists")
+	ErrProxyNoneAvailable   = errors.New("proxy none available")
+	ErrProxyVersionConflict = errors.New("proxy has been modified by others")
 )
 
 // Iterator is the function which will be call for each proxy in backend.
 // It will stop when the iterator returns false.
 type Iterator func(pxy *proxy.Proxy) bool
 
-// Backend is an interface that store and manipulate proxies
+// Modifier is the function which changes the proxy in Backend.Modify,
+// the change is discarded if it returns error. fn must not retain pxy.
+type Modifier func(pxy *proxy.Proxy) error
+
+// Backend is an interface that store and manipulate proxies.
+//
+// Proxies returned by backend are copies, changing them never affects
+// the backend until they are written back by Update or Modify.
+// Every write increases the proxy's Version, and Update fails with
+// ErrProxyVersionConflict if the version of newP is not zero and doesn't
+// equal to the stored one, which means it has been modified by others.
 type Backend interface {
 	Insert(p *proxy.Proxy) error
 	Update(newP *proxy.Proxy) error
 	InsertOrUpdate(p *proxy.Proxy) (inserted bool, err error)
+	// Modify applies fn to the proxy with ip atomically and re-indexes it,
+	// returns the modified proxy.
+	Modify(ip net.IP, fn Modifier) (*proxy.Proxy, error)
 	Delete(p *proxy.Proxy) error
 	Search(ip net.IP) *proxy.Proxy
 	// Select returns proxies after filter with options
@@ -39,4 +53,7 @@ type Backend interface {
 	// If k is equal to 0, return all proxies in the backend
 	TopK(k int) []*proxy.Proxy
 	Iter(iter Iterator)
+	// All returns all proxies in no particular order, by enumerating the storage
+	// rather than walking the scores, e.g. for snapshots.
+	All() []*proxy.Proxy
 }
@@ -6,6 +6,8 @@ package backend
 
 import (
 	"net"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/Leosocy/IntelliProxy/pkg/proxy"
@@ -19,13 +21,16 @@ type BackendTestSuite struct {
 }
 
 func (suite *BackendTestSuite) SetupTest() {
+	boltBackend, err := NewBoltBackend(filepath.Join(suite.T().TempDir(), "test.db"))
+	suite.Require().Nil(err)
 	suite.backends = []Backend{
 		NewInMemoryBackend(),
+		boltBackend,
 	}
 	// insert and assert some proxies
 	for _, s := range suite.backends {
 		// insert invalid proxy
-		err := s.Insert(nil)
+		err = s.Insert(nil)
 		suite.Equal(err, ErrProxyInvalid)
 		// insert two proxy
 		err = s.Insert(&proxy.Proxy{IP: net.ParseIP("1.2.3.4"), Port: 80, Score: 50})
@@ -42,6 +47,14 @@ func (suite *BackendTestSuite) SetupTest() {
 	}
 }
 
+func (suite *BackendTestSuite) TearDownTest() {
+	for _, s := range suite.backends {
+		if b, ok := s.(*BoltBackend); ok {
+			b.Close()
+		}
+	}
+}
+
 func (suite *BackendTestSuite) TestSelect() {
 	for _, s := range suite.backends {
 		// no options
@@ -69,6 +82,38 @@ func (suite *BackendTestSuite) TestSelect() {
 		// filter and offset out of range
 		pxys, err = s.Select(storage.WithFilter(storage.FilterScore(50)), storage.WithOffset(10))
 		suite.NotNil(err)
+		// indexable conditions
+		pxys, err = s.Select(storage.WithCondition(storage.ScoreBetween(40, 60)))
+		suite.Equal(1, len(pxys))
+		suite.Equal(int8(50), pxys[0].Score)
+		pxys, err = s.Select(storage.WithCondition(storage.ScoreBetween(0, 100), storage.CountryIn("CN")))
+		suite.Equal(ErrProxyNoneAvailable, err)
+		// query planned over indexes
+		pxys, err = s.Select(storage.WithQuery(storage.MustParseQuery("protocol = http and anon = unknown and score > 40")))
+		suite.Nil(err)
+		suite.Equal(2, len(pxys))
+		suite.Equal(int8(80), pxys[0].Score)
+	}
+}
+
+func (suite *BackendTestSuite) TestSelectOrderByAndCursor() {
+	for _, s := range suite.backends {
+		// order by score ascend
+		pxys, err := s.Select(storage.WithOrderBy(storage.OrderByScore, storage.Asc))
+		suite.Nil(err)
+		suite.Equal(int8(30), pxys[0].Score)
+		// paging with cursor while rescoring
+		opts := []storage.SelectOption{storage.WithLimit(1)}
+		pxys, err = s.Select(opts...)
+		suite.Equal("5.6.7.8", pxys[0].IP.String())
+		// offset paging would return 5.6.7.8 again
+		s.Update(&proxy.Proxy{IP: net.ParseIP("9.10.11.12"), Port: 80, Score: 100})
+		pxys, err = s.Select(storage.WithCursor(storage.NextCursor(pxys, opts...)), storage.WithLimit(1))
+		suite.Nil(err)
+		suite.Equal("1.2.3.4", pxys[0].IP.String())
+		// invalid cursor
+		_, err = s.Select(storage.WithCursor("invalid"))
+		suite.Equal(storage.ErrInvalidCursor, err)
 	}
 }
 
@@ -79,6 +124,9 @@ func (suite *BackendTestSuite) TestSearch() {
 		// not found
 		pxy = s.Search(net.ParseIP("8.8.8.8"))
 		suite.Nil(pxy)
+		// credentials are stored
+		s.Insert(&proxy.Proxy{IP: net.ParseIP("8.8.8.8"), Port: 80, Score: 50, Username: "user", Password: "secret"})
+		suite.Equal("secret", s.Search(net.ParseIP("8.8.8.8")).Password)
 	}
 }
 
@@ -106,6 +154,72 @@ func (suite *BackendTestSuite) TestTopK() {
 	}
 }
 
+func (suite *BackendTestSuite) TestTiedScores() {
+	for _, s := range suite.backends {
+		for i := 1; i <= 20; i++ {
+			suite.Nil(s.Insert(&proxy.Proxy{IP: net.IPv4(10, 0, 0, byte(i)), Port: 80, Score: 100}))
+		}
+		// scores change back and forth, and tie again
+		for i := 1; i <= 20; i += 2 {
+			ip := net.IPv4(10, 0, 0, byte(i))
+			s.Modify(ip, func(pxy *proxy.Proxy) error { pxy.Score = 90; return nil })
+			s.Modify(ip, func(pxy *proxy.Proxy) error { pxy.Score = 100; return nil })
+		}
+		suite.Equal(uint(23), s.Len())
+		suite.Len(s.TopK(0), 23)
+		suite.Len(s.All(), 23)
+		iterated := 0
+		s.Iter(func(pxy *proxy.Proxy) bool {
+			iterated++
+			return true
+		})
+		suite.Equal(23, iterated)
+		proxies, err := s.Select(storage.WithFilter(storage.FilterFunc(func(pxy *proxy.Proxy) bool { return pxy.Score == 100 })))
+		suite.Nil(err)
+		suite.Len(proxies, 20)
+		for i := 1; i <= 20; i++ {
+			suite.Nil(s.Delete(&proxy.Proxy{IP: net.IPv4(10, 0, 0, byte(i))}))
+		}
+		suite.Len(s.TopK(0), 3)
+	}
+}
+
+func (suite *BackendTestSuite) TestPageTiedScores() {
+	for _, s := range suite.backends {
+		for i := 1; i <= 6; i++ {
+			suite.Nil(s.Insert(&proxy.Proxy{IP: net.IPv4(1, 1, 1, byte(i)), Port: 80, Score: 60}))
+		}
+		all, err := s.Select()
+		suite.Nil(err)
+		var paged []*proxy.Proxy
+		for offset := 0; offset < len(all); offset += 2 {
+			page, err := s.Select(storage.WithOffset(offset), storage.WithLimit(2))
+			suite.Nil(err)
+			paged = append(paged, page...)
+		}
+		suite.Equal(ipsOf(all), ipsOf(paged))
+		paged = nil
+		opts := []storage.SelectOption{storage.WithLimit(2)}
+		for {
+			page, err := s.Select(opts...)
+			if err == ErrProxyNoneAvailable {
+				break
+			}
+			suite.Require().Nil(err)
+			paged = append(paged, page...)
+			opts = []storage.SelectOption{storage.WithLimit(2), storage.WithCursor(storage.NextCursor(page, opts...))}
+		}
+		suite.Equal(ipsOf(all), ipsOf(paged))
+	}
+}
+
+func ipsOf(proxies []*proxy.Proxy) (ips []string) {
+	for _, pxy := range proxies {
+		ips = append(ips, pxy.IP.String())
+	}
+	return
+}
+
 func (suite *BackendTestSuite) TestUpdate() {
 	for _, s := range suite.backends {
 		// does not exists
@@ -121,6 +235,90 @@ func (suite *BackendTestSuite) TestUpdate() {
 	}
 }
 
+func (suite *BackendTestSuite) TestUpdateVersionConflict() {
+	for _, s := range suite.backends {
+		p1 := s.Search(net.ParseIP("1.2.3.4"))
+		p2 := s.Search(net.ParseIP("1.2.3.4"))
+		suite.Equal(uint64(1), p1.Version)
+		p1.Score = 60
+		suite.Nil(s.Update(p1))
+		suite.Equal(uint64(2), p1.Version)
+		// p2 is stale since p1 updated
+		p2.Score = 70
+		suite.Equal(ErrProxyVersionConflict, s.Update(p2))
+		suite.Equal(int8(60), s.Search(p1.IP).Score)
+		// zero version updates unconditionally
+		p2.Version = 0
+		suite.Nil(s.Update(p2))
+		suite.Equal(uint64(3), s.Search(p1.IP).Version)
+	}
+}
+
+func (suite *BackendTestSuite) TestModify() {
+	for _, s := range suite.backends {
+		ip := net.ParseIP("1.2.3.4")
+		_, err := s.Modify(net.ParseIP("6.7.8.9"), func(pxy *proxy.Proxy) error { return nil })
+		suite.Equal(ErrProxyDoesNotExists, err)
+		// error returned by fn discards the change
+		_, err = s.Modify(ip, func(pxy *proxy.Proxy) error {
+			pxy.Score = 99
+			return ErrProxyNoneAvailable
+		})
+		suite.Equal(ErrProxyNoneAvailable, err)
+		suite.Equal(int8(50), s.Search(ip).Score)
+		_, err = s.Modify(ip, func(pxy *proxy.Proxy) error {
+			pxy.Score = 0
+			return nil
+		})
+		suite.Equal(ErrProxyInvalid, err)
+		// concurrent modifications are never lost
+		var wg sync.WaitGroup
+		for i := 0; i < 40; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				s.Modify(ip, func(pxy *proxy.Proxy) error {
+					if i%2 == 0 {
+						pxy.Score += 2
+					} else {
+						pxy.Score--
+					}
+					return nil
+				})
+			}(i)
+		}
+		wg.Wait()
+		p := s.Search(ip)
+		suite.Equal(int8(70), p.Score)
+		suite.Equal(uint64(41), p.Version)
+		// re-indexed by the new score
+		suite.Equal(ip, s.TopK(2)[1].IP)
+		pxys, err := s.Select(storage.WithCondition(storage.ScoreBetween(60, 79)))
+		suite.Nil(err)
+		suite.Equal(1, len(pxys))
+		suite.Equal(ip, pxys[0].IP)
+	}
+}
+
+func (suite *BackendTestSuite) TestReturnCopies() {
+	for _, s := range suite.backends {
+		ip := net.ParseIP("5.6.7.8")
+		s.Search(ip).Score = 1
+		s.TopK(1)[0].Score = 1
+		s.Iter(func(pxy *proxy.Proxy) bool {
+			pxy.Score = 1
+			return true
+		})
+		pxys, _ := s.Select()
+		pxys[0].Score = 1
+		suite.Equal(int8(80), s.Search(ip).Score)
+		suite.Equal(ip, s.TopK(1)[0].IP)
+		p, _ := s.Modify(ip, func(pxy *proxy.Proxy) error { return nil })
+		p.Score = 1
+		suite.Equal(int8(80), s.Search(ip).Score)
+	}
+}
+
 func (suite *BackendTestSuite) TestInsertOrUpdate() {
 	for _, s := range suite.backends {
 		p := &proxy.Proxy{IP: net.ParseIP("6.6.6.6"), Port: 80, Score: 50}
@@ -134,6 +332,35 @@ func (suite *BackendTestSuite) TestInsertOrUpdate() {
 		suite.False(inserted)
 		sp := s.Search(p.IP)
 		suite.Equal(int8(100), sp.Score)
+		suite.Equal(uint64(2), sp.Version)
+		// stale
+		sp.Version = 1
+		_, err = s.InsertOrUpdate(sp)
+		suite.Equal(ErrProxyVersionConflict, err)
+		_, err = s.InsertOrUpdate(&proxy.Proxy{IP: p.IP})
+		suite.Equal(ErrProxyInvalid, err)
+		// never fails by concurrent deletes
+		var wg sync.WaitGroup
+		errs := make(chan error, 8*500)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 500; j++ {
+					if i%2 == 0 {
+						s.Delete(p)
+						continue
+					}
+					_, err := s.InsertOrUpdate(&proxy.Proxy{IP: p.IP, Port: 80, Score: 50})
+					errs <- err
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			suite.Nil(err)
+		}
 	}
 }
 
@@ -0,0 +1,388 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketProxies = []byte("proxies") // ip -> json(proxy)
+	// secondary indexes, key is the encoded field value followed by ip, value is empty.
+	bucketIndexes = map[string][]byte{
+		storage.IndexScore:     []byte("idx_score"),
+		storage.IndexCountry:   []byte("idx_country"),
+		storage.IndexAnonymity: []byte("idx_anonymity"),
+		storage.IndexCheckedAt: []byte("idx_checked_at"),
+	}
+)
+
+// BoltBackend is a persistent backend on an embedded bolt file,
+// suitable for single node deployments that need to survive restarts.
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+// NewBoltBackend opens(or creates) the bolt file at path.
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketProxies); err != nil {
+			return err
+		}
+		for _, name := range bucketIndexes {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltBackend{db: db}, nil
+}
+
+// Close releases the bolt file.
+func (s *BoltBackend) Close() error {
+	return s.db.Close()
+}
+
+func proxyKey(ip net.IP) []byte {
+	return []byte(ip.String())
+}
+
+// indexKeys returns the key of each secondary index for the proxy.
+func indexKeys(p *proxy.Proxy) map[string][]byte {
+	ip := proxyKey(p.IP)
+	checkedAt := make([]byte, 8)
+	binary.BigEndian.PutUint64(checkedAt, uint64(p.CheckedAt.UnixNano()))
+	return map[string][]byte{
+		storage.IndexScore:     append([]byte{byte(p.Score)}, ip...),
+		storage.IndexCountry:   append([]byte(storage.CountryOf(p)+"\x00"), ip...),
+		storage.IndexAnonymity: append([]byte{byte(p.Anon)}, ip...),
+		storage.IndexCheckedAt: append(checkedAt, ip...),
+	}
+}
+
+func (s *BoltBackend) get(tx *bolt.Tx, key []byte) *proxy.Proxy {
+	data := tx.Bucket(bucketProxies).Get(key)
+	if data == nil {
+		return nil
+	}
+	var r proxy.Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil
+	}
+	return r.Unwrap()
+}
+
+func (s *BoltBackend) put(tx *bolt.Tx, p *proxy.Proxy) error {
+	data, err := json.Marshal(proxy.NewRecord(p))
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(bucketProxies).Put(proxyKey(p.IP), data); err != nil {
+		return err
+	}
+	for index, key := range indexKeys(p) {
+		if err = tx.Bucket(bucketIndexes[index]).Put(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltBackend) remove(tx *bolt.Tx, p *proxy.Proxy) error {
+	if err := tx.Bucket(bucketProxies).Delete(proxyKey(p.IP)); err != nil {
+		return err
+	}
+	for index, key := range indexKeys(p) {
+		if err := tx.Bucket(bucketIndexes[index]).Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltBackend) Insert(p *proxy.Proxy) error {
+	if p == nil || p.Score <= 0 {
+		return ErrProxyInvalid
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if s.get(tx, proxyKey(p.IP)) != nil {
+			return ErrProxyDuplicated
+		}
+		p.Version = 1
+		return s.put(tx, p)
+	})
+}
+
+func (s *BoltBackend) Update(newP *proxy.Proxy) error {
+	if newP == nil || newP.Score <= 0 {
+		return ErrProxyInvalid
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		old := s.get(tx, proxyKey(newP.IP))
+		if old == nil {
+			return ErrProxyDoesNotExists
+		}
+		return s.replace(tx, old, newP)
+	})
+}
+
+// replace writes newP in place of old, which is stored in tx.
+func (s *BoltBackend) replace(tx *bolt.Tx, old, newP *proxy.Proxy) error {
+	if newP.Version != 0 && newP.Version != old.Version {
+		return ErrProxyVersionConflict
+	}
+	if err := s.remove(tx, old); err != nil {
+		return err
+	}
+	newP.Version = old.Version + 1
+	return s.put(tx, newP)
+}
+
+func (s *BoltBackend) Modify(ip net.IP, fn Modifier) (newP *proxy.Proxy, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		old := s.get(tx, proxyKey(ip))
+		if old == nil {
+			return ErrProxyDoesNotExists
+		}
+		newP = old.Clone()
+		if err := fn(newP); err != nil {
+			return err
+		}
+		if newP.Score <= 0 || !newP.IP.Equal(old.IP) {
+			return ErrProxyInvalid
+		}
+		if err := s.remove(tx, old); err != nil {
+			return err
+		}
+		newP.Version = old.Version + 1
+		return s.put(tx, newP)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newP, nil
+}
+
+// InsertOrUpdate looks up and writes p in one transaction, so that it never
+// fails by a delete or insert in between.
+func (s *BoltBackend) InsertOrUpdate(p *proxy.Proxy) (inserted bool, err error) {
+	if p == nil || p.Score <= 0 {
+		return false, ErrProxyInvalid
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		old := s.get(tx, proxyKey(p.IP))
+		if inserted = old == nil; inserted {
+			p.Version = 1
+			return s.put(tx, p)
+		}
+		return s.replace(tx, old, p)
+	})
+	if err != nil {
+		return false, err
+	}
+	return inserted, nil
+}
+
+func (s *BoltBackend) Delete(p *proxy.Proxy) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		old := s.get(tx, proxyKey(p.IP))
+		if old == nil {
+			return ErrProxyDoesNotExists
+		}
+		return s.remove(tx, old)
+	})
+}
+
+func (s *BoltBackend) Search(ip net.IP) (p *proxy.Proxy) {
+	s.db.View(func(tx *bolt.Tx) error {
+		p = s.get(tx, proxyKey(ip))
+		return nil
+	})
+	return
+}
+
+// candidates returns the keys of proxies which match all the indexable conditions,
+// indexed is false if none of the conditions has an index.
+func (s *BoltBackend) candidates(tx *bolt.Tx, conds []storage.Condition) (keys [][]byte, indexed bool) {
+	var matched map[string]bool
+	for _, cond := range conds {
+		name, ok := bucketIndexes[cond.Index]
+		if !ok {
+			continue
+		}
+		hit := make(map[string]bool)
+		scanIndex(tx.Bucket(name), cond, func(ip []byte) {
+			if matched == nil || matched[string(ip)] {
+				hit[string(ip)] = true
+			}
+		})
+		matched = hit
+	}
+	for ip := range matched {
+		keys = append(keys, []byte(ip))
+	}
+	return keys, matched != nil
+}
+
+// scanIndex calls fn with the ip of each entry in the index bucket which matches cond.
+func scanIndex(b *bolt.Bucket, cond storage.Condition, fn func(ip []byte)) {
+	c := b.Cursor()
+	if cond.Index == storage.IndexCountry {
+		for _, v := range cond.Values {
+			prefix := []byte(v + "\x00")
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				fn(k[len(prefix):])
+			}
+		}
+		return
+	}
+	width, decode := 1, func(k []byte) int64 { return int64(int8(k[0])) }
+	if cond.Index == storage.IndexCheckedAt {
+		width, decode = 8, func(k []byte) int64 { return int64(binary.BigEndian.Uint64(k)) }
+	}
+	var start []byte
+	if cond.Min > 0 {
+		start = make([]byte, width)
+		if width == 1 {
+			start[0] = byte(cond.Min)
+		} else {
+			binary.BigEndian.PutUint64(start, uint64(cond.Min))
+		}
+	}
+	k, _ := c.First()
+	if start != nil {
+		k, _ = c.Seek(start)
+	}
+	for ; k != nil; k, _ = c.Next() {
+		if v := decode(k); v > cond.Max {
+			return
+		} else if v >= cond.Min {
+			fn(k[width:])
+		}
+	}
+}
+
+func (s *BoltBackend) Select(opts ...storage.SelectOption) ([]*proxy.Proxy, error) {
+	sopts := storage.SelectOptions{}
+	for _, opt := range opts {
+		opt(&sopts)
+	}
+	var (
+		proxies []*proxy.Proxy
+		indexed bool
+	)
+	s.db.View(func(tx *bolt.Tx) error {
+		var keys [][]byte
+		keys, indexed = s.candidates(tx, sopts.Conditions)
+		for _, key := range keys {
+			if pxy := s.get(tx, key); pxy != nil {
+				proxies = append(proxies, pxy)
+			}
+		}
+		return nil
+	})
+	if indexed {
+		proxies = applyFilters(proxies, sopts.Filters)
+		storage.OrderBy{}.Sort(proxies)
+	} else {
+		// walk the score index, and stop as soon as enough proxies passed filters
+		// if they needn't be sorted by other order, the walk is in the order of
+		// Paginate, so the proxies walked are the first ones of that order.
+		earlyStop := sopts.Limit > 0 && sopts.Cursor == "" && sopts.OrderBy == storage.OrderBy{}
+		s.Iter(func(pxy *proxy.Proxy) bool {
+			if len(applyFilters([]*proxy.Proxy{pxy}, sopts.Filters)) > 0 {
+				proxies = append(proxies, pxy)
+			}
+			return !earlyStop || len(proxies) < sopts.Offset+sopts.Limit
+		})
+	}
+	proxies, err := sopts.Paginate(proxies)
+	if err != nil {
+		return nil, err
+	}
+	if len(proxies) == 0 {
+		return nil, ErrProxyNoneAvailable
+	}
+	return proxies, nil
+}
+
+func applyFilters(proxies []*proxy.Proxy, filters []storage.Filter) []*proxy.Proxy {
+	for _, filter := range filters {
+		proxies = filter(proxies)
+	}
+	return proxies
+}
+
+func (s *BoltBackend) Len() (n uint) {
+	s.db.View(func(tx *bolt.Tx) error {
+		n = uint(tx.Bucket(bucketProxies).Stats().KeyN)
+		return nil
+	})
+	return
+}
+
+func (s *BoltBackend) TopK(k int) []*proxy.Proxy {
+	proxies := make([]*proxy.Proxy, 0)
+	s.Iter(func(pxy *proxy.Proxy) bool {
+		if k == 0 || len(proxies) < k {
+			proxies = append(proxies, pxy)
+			return true
+		}
+		return false
+	})
+	return proxies
+}
+
+func (s *BoltBackend) All() []*proxy.Proxy {
+	proxies := make([]*proxy.Proxy, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketProxies).ForEach(func(k, _ []byte) error {
+			if pxy := s.get(tx, k); pxy != nil {
+				proxies = append(proxies, pxy)
+			}
+			return nil
+		})
+	})
+	return proxies
+}
+
+// Iter walks the proxies order by score descend and ip ascend when tied,
+// which is the default order of storage.OrderBy, inside a read transaction,
+// so iter must not write to the backend synchronously.
+func (s *BoltBackend) Iter(iter Iterator) {
+	s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketIndexes[storage.IndexScore]).Cursor()
+		// the keys are score+ip, walks back to the first key of each score,
+		// and then forward through the ips of the score.
+		for k, _ := c.Last(); k != nil; {
+			score := []byte{k[0]}
+			for k, _ = c.Seek(score); k != nil && k[0] == score[0]; k, _ = c.Next() {
+				if pxy := s.get(tx, k[1:]); pxy != nil && !iter(pxy) {
+					return nil
+				}
+			}
+			c.Seek(score)
+			k, _ = c.Prev()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/storage"
+)
+
+// EvictionPolicy decides which proxies are evicted first when the pool is full.
+type EvictionPolicy string
+
+// Policies supported by Evictor.
+const (
+	EvictLowestScore EvictionPolicy = "lowest_score"
+	EvictOldestCheck EvictionPolicy = "oldest_check"
+	EvictLeastUsed   EvictionPolicy = "least_used"
+)
+
+// less reports whether p1 should be evicted before p2.
+func (policy EvictionPolicy) less(p1, p2 *proxy.Proxy) bool {
+	switch policy {
+	case EvictOldestCheck:
+		if !p1.CheckedAt.Equal(p2.CheckedAt) {
+			return p1.CheckedAt.Before(p2.CheckedAt)
+		}
+	case EvictLeastUsed:
+		if p1.Uses != p2.Uses {
+			return p1.Uses < p2.Uses
+		}
+	}
+	return p1.Score < p2.Score
+}
+
+// ParseEvictionPolicy returns the policy with name, e.g. lowest_score.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch policy := EvictionPolicy(name); policy {
+	case EvictLowestScore, EvictOldestCheck, EvictLeastUsed:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown eviction policy %q", name)
+	}
+}
+
+// Evictor enforces the limits of a backend: proxies which are not checked
+// within the max age are expired, and proxies are evicted by the policy when
+// the size of pool exceeds the max size.
+// Every eviction notifies a Delete event with the reason.
+//
+// Evictor is also a pubsub.Watcher, attach it to the backend to evict
+// as soon as an insertion makes the pool full.
+type Evictor struct {
+	nb      NotifyBackend
+	maxAge  time.Duration
+	maxSize uint
+	policy  EvictionPolicy
+	mu      sync.Mutex
+	// evicting is 1 if an eviction triggered by Receipt is running.
+	evicting int32
+}
+
+// EvictorOption configures the Evictor.
+type EvictorOption func(e *Evictor)
+
+// WithMaxAge sets the max age since the last check, zero means never expire.
+func WithMaxAge(d time.Duration) EvictorOption {
+	return func(e *Evictor) {
+		e.maxAge = d
+	}
+}
+
+// WithMaxSize sets the max size of pool, zero means unbounded.
+func WithMaxSize(n uint) EvictorOption {
+	return func(e *Evictor) {
+		e.maxSize = n
+	}
+}
+
+// WithEvictionPolicy sets the policy used when the pool is full, default is EvictLowestScore.
+func WithEvictionPolicy(policy EvictionPolicy) EvictorOption {
+	return func(e *Evictor) {
+		e.policy = policy
+	}
+}
+
+// NewEvictor returns an evictor of the backend.
+func NewEvictor(nb NotifyBackend, opts ...EvictorOption) *Evictor {
+	e := &Evictor{nb: nb, policy: EvictLowestScore}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// expired reports whether pxy is not checked within the max age,
+// proxy never checked is aged since it was created.
+func (e *Evictor) expired(pxy *proxy.Proxy, now time.Time) bool {
+	if e.maxAge <= 0 {
+		return false
+	}
+	last := pxy.CheckedAt
+	if last.IsZero() {
+		last = pxy.CreatedAt
+	}
+	return !last.IsZero() && now.Sub(last) > e.maxAge
+}
+
+// Evict deletes the expired proxies, and then evicts proxies by the policy
+// until the size of pool doesn't exceed the max size.
+// It returns the number of proxies deleted.
+func (e *Evictor) Evict() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.maxAge <= 0 && (e.maxSize == 0 || e.nb.Len() <= e.maxSize) {
+		return 0
+	}
+	var (
+		now     = time.Now()
+		expired []*proxy.Proxy
+		alive   []*proxy.Proxy
+		deleted int
+	)
+	// enumerates all, since the policies don't rely on the order of scores
+	for _, pxy := range e.nb.All() {
+		if e.expired(pxy, now) {
+			expired = append(expired, pxy)
+		} else {
+			alive = append(alive, pxy)
+		}
+	}
+	for _, pxy := range expired {
+		if e.nb.Evict(pxy, ReasonExpired) == nil {
+			deleted++
+		}
+	}
+	if e.maxSize == 0 || uint(len(alive)) <= e.maxSize {
+		return deleted
+	}
+	// the ties of policy are in the default order, so that the eviction is deterministic
+	storage.OrderBy{}.Sort(alive)
+	sort.SliceStable(alive, func(i, j int) bool {
+		return e.policy.less(alive[i], alive[j])
+	})
+	for _, pxy := range alive[:uint(len(alive))-e.maxSize] {
+		if e.nb.Evict(pxy, ReasonEvicted) == nil {
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Receipt implements pubsub.Watcher interface,
+// it evicts when an insertion makes the size of pool exceed the max size.
+// The eviction runs in background, since it notifies events itself,
+// which may be blocked by the notifier delivering to this watcher.
+func (e *Evictor) Receipt(obj interface{}) {
+	if ev, ok := obj.(*Event); ok && ev.Op == Insert && e.maxSize > 0 && e.nb.Len() > e.maxSize {
+		if atomic.CompareAndSwapInt32(&e.evicting, 0, 1) {
+			go func() {
+				defer atomic.StoreInt32(&e.evicting, 0)
+				e.Evict()
+			}()
+		}
+	}
+}
+
+// Run evicts every period until ctx is done.
+func (e *Evictor) Run(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Evict()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
+	"github.com/stretchr/testify/assert"
+)
+
+type deletionRecorder struct {
+	mu      sync.Mutex
+	reasons map[string]Reason
+}
+
+func (r *deletionRecorder) Receipt(obj interface{}) {
+	if e, ok := obj.(*Event); ok && e.Op == Delete {
+		r.mu.Lock()
+		r.reasons[e.Pxy.IP.String()] = e.Reason
+		r.mu.Unlock()
+	}
+}
+
+func newEvictionBackend(t *testing.T) (NotifyBackend, *deletionRecorder) {
+	nb := WithNotifier(NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	recorder := &deletionRecorder{reasons: make(map[string]Reason)}
+	nb.Attach(recorder)
+	now := time.Now()
+	for _, p := range []*proxy.Proxy{
+		{IP: net.ParseIP("1.1.1.1"), Score: 90, CheckedAt: now.Add(-2 * time.Hour)},
+		{IP: net.ParseIP("2.2.2.2"), Score: 30, CheckedAt: now.Add(-time.Minute), Uses: 5},
+		{IP: net.ParseIP("3.3.3.3"), Score: 60, CheckedAt: now.Add(-30 * time.Minute)},
+		{IP: net.ParseIP("4.4.4.4"), Score: 80, CheckedAt: now, Uses: 1},
+	} {
+		assert.Nil(t, nb.Insert(p))
+	}
+	return nb, recorder
+}
+
+func TestEvictorMaxAge(t *testing.T) {
+	nb, recorder := newEvictionBackend(t)
+	assert.Equal(t, 0, NewEvictor(nb).Evict())
+	assert.Equal(t, 1, NewEvictor(nb, WithMaxAge(time.Hour)).Evict())
+	assert.Equal(t, uint(3), nb.Len())
+	assert.Equal(t, map[string]Reason{"1.1.1.1": ReasonExpired}, recorder.reasons)
+}
+
+func TestEvictorMaxSize(t *testing.T) {
+	testCases := []struct {
+		policy  EvictionPolicy
+		evicted []string
+	}{
+		{EvictLowestScore, []string{"2.2.2.2", "3.3.3.3"}},
+		{EvictOldestCheck, []string{"1.1.1.1", "3.3.3.3"}},
+		{EvictLeastUsed, []string{"3.3.3.3", "1.1.1.1"}},
+	}
+	for _, tc := range testCases {
+		nb, recorder := newEvictionBackend(t)
+		assert.Equal(t, 2, NewEvictor(nb, WithMaxSize(2), WithEvictionPolicy(tc.policy)).Evict())
+		assert.Equal(t, uint(2), nb.Len())
+		for _, ip := range tc.evicted {
+			assert.Equal(t, ReasonEvicted, recorder.reasons[ip], tc.policy)
+			assert.Nil(t, nb.Search(net.ParseIP(ip)))
+		}
+	}
+}
+
+func TestEvictorTiedScores(t *testing.T) {
+	nb := WithNotifier(NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	old := time.Now().Add(-2 * time.Hour)
+	for i := 1; i <= 20; i++ {
+		checkedAt := time.Now()
+		if i <= 5 {
+			checkedAt = old
+		}
+		assert.Nil(t, nb.Insert(&proxy.Proxy{IP: net.IPv4(10, 0, 0, byte(i)), Score: 100, CheckedAt: checkedAt}))
+	}
+	assert.Equal(t, 15, NewEvictor(nb, WithMaxAge(time.Hour), WithMaxSize(5)).Evict())
+	assert.Equal(t, uint(5), nb.Len())
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, nb.Search(net.IPv4(10, 0, 0, byte(i))))
+	}
+}
+
+func TestEvictorReceipt(t *testing.T) {
+	nb, recorder := newEvictionBackend(t)
+	nb.Attach(NewEvictor(nb, WithMaxSize(4)))
+	nb.Insert(&proxy.Proxy{IP: net.ParseIP("5.5.5.5"), Score: 50})
+	assert.Eventually(t, func() bool {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		return len(recorder.reasons) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, uint(4), nb.Len())
+	assert.Equal(t, ReasonEvicted, recorder.reasons["2.2.2.2"])
+}
+
+func TestEvictorRun(t *testing.T) {
+	nb, recorder := newEvictionBackend(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		NewEvictor(nb, WithMaxAge(time.Hour)).Run(ctx, time.Millisecond)
+	}()
+	assert.Eventually(t, func() bool {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		return len(recorder.reasons) == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("evictor not stopped")
+	}
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+	policy, err := ParseEvictionPolicy("least_used")
+	assert.Nil(t, err)
+	assert.Equal(t, EvictLeastUsed, policy)
+	_, err = ParseEvictionPolicy("unknown")
+	assert.NotNil(t, err)
+}
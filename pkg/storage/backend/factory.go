@@ -0,0 +1,32 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+
+	"github.com/Leosocy/IntelliProxy/config"
+)
+
+// Types of backend which can be selected by the config key `backend.type`.
+const (
+	TypeInMemory = "memory"
+	TypeBolt     = "bolt"
+)
+
+// NewBackend creates the backend selected by config.
+//
+//	backend.type:      memory(default) or bolt
+//	backend.bolt.path: file path of the bolt backend
+func NewBackend(cfg config.Provider) (Backend, error) {
+	switch typ := cfg.GetString("backend.type"); typ {
+	case TypeInMemory, "":
+		return NewInMemoryBackend(), nil
+	case TypeBolt:
+		return NewBoltBackend(cfg.GetString("backend.bolt.path"))
+	default:
+		return nil, fmt.Errorf("unknown backend type %q", typ)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"strconv"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/storage"
+)
+
+// scoreBucketWidth is the width of score range of each score index bucket.
+const scoreBucketWidth = 10
+
+type proxySet map[uint64]*proxy.Proxy // map[hash64(IP)]proxy
+
+// memIndexes are the secondary indexes of InMemoryBackend,
+// they are not safe for concurrent use, the caller must hold the backend lock.
+type memIndexes struct {
+	// sets maps index name to indexed value to the proxies with that value.
+	sets map[string]map[string]proxySet
+	// values records the indexed values of each proxy at the time it was added,
+	// so that it can be removed even if the proxy fields changed in place.
+	values map[uint64]map[string]string
+}
+
+func newMemIndexes() *memIndexes {
+	ix := &memIndexes{
+		sets:   make(map[string]map[string]proxySet),
+		values: make(map[uint64]map[string]string),
+	}
+	for _, index := range []string{
+		storage.IndexScore, storage.IndexCountry,
+		storage.IndexAnonymity, storage.IndexProtocol,
+	} {
+		ix.sets[index] = make(map[string]proxySet)
+	}
+	return ix
+}
+
+func scoreBucket(score int64) string {
+	return strconv.FormatInt(score/scoreBucketWidth, 10)
+}
+
+func indexValues(p *proxy.Proxy) map[string]string {
+	return map[string]string{
+		storage.IndexScore:     scoreBucket(int64(p.Score)),
+		storage.IndexCountry:   storage.CountryOf(p),
+		storage.IndexAnonymity: strconv.Itoa(int(p.Anon)),
+		storage.IndexProtocol:  string(storage.ProtocolOf(p)),
+	}
+}
+
+func (ix *memIndexes) add(h uint64, p *proxy.Proxy) {
+	values := indexValues(p)
+	for index, v := range values {
+		set, ok := ix.sets[index][v]
+		if !ok {
+			set = make(proxySet)
+			ix.sets[index][v] = set
+		}
+		set[h] = p
+	}
+	ix.values[h] = values
+}
+
+func (ix *memIndexes) remove(h uint64) {
+	for index, v := range ix.values[h] {
+		if set, ok := ix.sets[index][v]; ok {
+			delete(set, h)
+			if len(set) == 0 {
+				delete(ix.sets[index], v)
+			}
+		}
+	}
+	delete(ix.values, h)
+}
+
+// lookup returns the sets which contain all the proxies may match cond,
+// and the total size of them. ok is false if cond isn't indexed.
+func (ix *memIndexes) lookup(cond storage.Condition) (sets []proxySet, size int, ok bool) {
+	var keys []string
+	switch cond.Index {
+	case storage.IndexCountry, storage.IndexProtocol:
+		keys = cond.Values
+	case storage.IndexAnonymity:
+		for a := maxInt64(cond.Min, int64(proxy.Unknown)); a <= minInt64(cond.Max, int64(proxy.Elite)); a++ {
+			keys = append(keys, strconv.FormatInt(a, 10))
+		}
+	case storage.IndexScore:
+		for b := maxInt64(cond.Min, 0) / scoreBucketWidth; b <= minInt64(cond.Max, int64(proxy.MaximumScore))/scoreBucketWidth; b++ {
+			keys = append(keys, strconv.FormatInt(b, 10))
+		}
+	default:
+		return nil, 0, false
+	}
+	for _, key := range keys {
+		if set, found := ix.sets[cond.Index][key]; found {
+			sets = append(sets, set)
+			size += len(set)
+		}
+	}
+	return sets, size, true
+}
+
+// best chooses the most selective indexed condition, and returns the sets of
+// proxies may match all conditions. ok is false if none of the conditions is indexed.
+func (ix *memIndexes) best(conds []storage.Condition) (best []proxySet, bestSize int, ok bool) {
+	for _, cond := range conds {
+		if sets, size, indexed := ix.lookup(cond); indexed && (!ok || size < bestSize) {
+			best, bestSize, ok = sets, size, true
+		}
+	}
+	return
+}
+
+func collect(sets []proxySet, size int) []*proxy.Proxy {
+	proxies := make([]*proxy.Proxy, 0, size)
+	for _, set := range sets {
+		for _, p := range set {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -17,52 +17,76 @@ import (
 
 type comparableProxy struct {
 	pxy *proxy.Proxy
+	ip  string // of pxy, which breaks the ties of score
 }
 
-// Less implements rbtree.Less method.
+func newComparableProxy(p *proxy.Proxy) *comparableProxy {
+	return &comparableProxy{pxy: p, ip: p.IP.String()}
+}
+
+// Less implements rbtree.Less method, the proxies are ordered by score, and
+// by ip descend when tied, so that descending walks them in the default
+// order of storage.OrderBy, i.e. by score descend and then ip ascend.
 func (p *comparableProxy) Less(than rbtree.Item) bool {
 	thanP := than.(*comparableProxy)
-	if p.pxy.IP.Equal(thanP.pxy.IP) {
-		return false
+	if p.pxy.Score != thanP.pxy.Score {
+		return p.pxy.Score < thanP.pxy.Score
 	}
-	return p.pxy.Score <= thanP.pxy.Score
+	return p.ip > thanP.ip
 }
 
 // InMemoryBackend is a simple local in memory backend.
+//
+// The stored proxies are never changed in place, writes always replace
+// them with new copies, so the rbtree ordered by score stays consistent.
 type InMemoryBackend struct {
-	m    map[uint64]*proxy.Proxy // map[hash64(IP)]proxy
-	rbt  *rbtree.Rbtree
-	lock sync.RWMutex
+	m       map[uint64]*proxy.Proxy // map[hash64(IP)]proxy
+	rbt     *rbtree.Rbtree
+	indexes *memIndexes
+	lock    sync.RWMutex
 }
 
 // NewInMemoryBackend returns new InMemoryBackend with default configurations.
 func NewInMemoryBackend() *InMemoryBackend {
 	return &InMemoryBackend{
-		m:   make(map[uint64]*proxy.Proxy),
-		rbt: rbtree.New(),
+		m:       make(map[uint64]*proxy.Proxy),
+		rbt:     rbtree.New(),
+		indexes: newMemIndexes(),
 	}
 }
 
-func (s *InMemoryBackend) insert(p *proxy.Proxy) error {
+func hashIP(ip net.IP) uint64 {
 	hasher := fnv.New64()
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.rbt.Insert(&comparableProxy{pxy: p})
-	if _, err := hasher.Write(p.IP); err != nil {
-		return err
-	}
-	s.m[hasher.Sum64()] = p
-	return nil
+	hasher.Write(ip)
+	return hasher.Sum64()
+}
+
+// put stores p, which must not be referenced by others since now.
+func (s *InMemoryBackend) put(h uint64, p *proxy.Proxy) {
+	s.rbt.Insert(newComparableProxy(p))
+	s.m[h] = p
+	s.indexes.add(h, p)
+}
+
+func (s *InMemoryBackend) remove(h uint64, p *proxy.Proxy) {
+	s.rbt.Delete(newComparableProxy(p))
+	delete(s.m, h)
+	s.indexes.remove(h)
 }
 
 func (s *InMemoryBackend) Insert(p *proxy.Proxy) error {
 	if p == nil || p.Score <= 0 {
 		return ErrProxyInvalid
 	}
-	if sp := s.Search(p.IP); sp != nil {
+	h := hashIP(p.IP)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, found := s.m[h]; found {
 		return ErrProxyDuplicated
 	}
-	return s.insert(p)
+	p.Version = 1
+	s.put(h, p.Clone())
+	return nil
 }
 
 func (s *InMemoryBackend) Select(opts ...storage.SelectOption) ([]*proxy.Proxy, error) {
@@ -70,67 +94,128 @@ func (s *InMemoryBackend) Select(opts ...storage.SelectOption) ([]*proxy.Proxy,
 	for _, opt := range opts {
 		opt(&sopts)
 	}
-	proxies := s.TopK(0)
-	for _, filter := range sopts.Filters {
-		proxies = filter(proxies)
+	var proxies []*proxy.Proxy
+	earlyStop := sopts.Limit > 0 && sopts.Cursor == "" && sopts.OrderBy == storage.OrderBy{}
+	s.lock.RLock()
+	sets, size, indexed := s.indexes.best(sopts.Conditions)
+	if indexed && earlyStop && size > 0 {
+		// walking proxies order by score stops after about (offset+limit)/selectivity
+		// proxies, which is cheaper than collecting and sorting all the candidates.
+		indexed = size < (sopts.Offset+sopts.Limit)*len(s.m)/size
+	}
+	if indexed {
+		proxies = collect(sets, size)
 	}
-	if len(proxies) == 0 || sopts.Offset >= len(proxies) {
+	s.lock.RUnlock()
+	if indexed {
+		// only the candidates from the most selective index are filtered and sorted,
+		// by score and then ip like the default OrderBy, so the order is deterministic.
+		proxies = applyFilters(proxies, sopts.Filters)
+		storage.OrderBy{}.Sort(proxies)
+	} else {
+		s.iter(func(pxy *proxy.Proxy) bool {
+			if len(applyFilters([]*proxy.Proxy{pxy}, sopts.Filters)) > 0 {
+				proxies = append(proxies, pxy)
+			}
+			return !earlyStop || len(proxies) < sopts.Offset+sopts.Limit
+		})
+	}
+	proxies, err := sopts.Paginate(proxies)
+	if err != nil {
+		return nil, err
+	}
+	if len(proxies) == 0 {
 		return nil, ErrProxyNoneAvailable
 	}
-	remained := len(proxies) - sopts.Offset
-	if sopts.Limit == 0 || sopts.Limit >= remained {
-		return proxies[sopts.Offset:], nil
+	for i, pxy := range proxies {
+		proxies[i] = pxy.Clone()
 	}
-	return proxies[sopts.Offset : sopts.Offset+sopts.Limit], nil
+	return proxies, nil
 }
 
 func (s *InMemoryBackend) Search(ip net.IP) *proxy.Proxy {
-	hasher := fnv.New64()
+	h := hashIP(ip)
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	if _, err := hasher.Write(ip); err == nil {
-		return s.m[hasher.Sum64()]
+	if p, found := s.m[h]; found {
+		return p.Clone()
 	}
 	return nil
 }
 
-func (s *InMemoryBackend) delete(p *proxy.Proxy) error {
-	hasher := fnv.New64()
+func (s *InMemoryBackend) Delete(p *proxy.Proxy) error {
+	h := hashIP(p.IP)
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.rbt.Delete(&comparableProxy{pxy: p})
-	if _, err := hasher.Write(p.IP); err != nil {
-		return err
+	sp, found := s.m[h]
+	if !found {
+		return ErrProxyDoesNotExists
 	}
-	delete(s.m, hasher.Sum64())
+	s.remove(h, sp)
 	return nil
 }
 
-func (s *InMemoryBackend) Delete(p *proxy.Proxy) error {
-	var sp *proxy.Proxy
-	if sp = s.Search(p.IP); sp == nil {
+func (s *InMemoryBackend) Update(newP *proxy.Proxy) error {
+	if newP == nil || newP.Score <= 0 {
+		return ErrProxyInvalid
+	}
+	h := hashIP(newP.IP)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sp, found := s.m[h]
+	if !found {
 		return ErrProxyDoesNotExists
 	}
-	return s.delete(sp)
+	return s.replace(h, sp, newP)
 }
 
-func (s *InMemoryBackend) Update(newP *proxy.Proxy) error {
-	if err := s.Delete(newP); err != nil {
-		return err
+// replace replaces the stored old with a copy of newP if the versions agree.
+func (s *InMemoryBackend) replace(h uint64, old, newP *proxy.Proxy) error {
+	if newP.Version != 0 && newP.Version != old.Version {
+		return ErrProxyVersionConflict
 	}
-	return s.Insert(newP)
+	newP.Version = old.Version + 1
+	s.remove(h, old)
+	s.put(h, newP.Clone())
+	return nil
 }
 
+func (s *InMemoryBackend) Modify(ip net.IP, fn Modifier) (*proxy.Proxy, error) {
+	h := hashIP(ip)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sp, found := s.m[h]
+	if !found {
+		return nil, ErrProxyDoesNotExists
+	}
+	newP := sp.Clone()
+	if err := fn(newP); err != nil {
+		return nil, err
+	}
+	if newP.Score <= 0 || !newP.IP.Equal(sp.IP) {
+		return nil, ErrProxyInvalid
+	}
+	newP.Version = sp.Version + 1
+	s.remove(h, sp)
+	s.put(h, newP)
+	return newP.Clone(), nil
+}
+
+// InsertOrUpdate looks up and writes p under one lock, so that it never
+// fails by a delete or insert in between.
 func (s *InMemoryBackend) InsertOrUpdate(p *proxy.Proxy) (bool, error) {
-	err := s.Insert(p)
-	switch err {
-	case ErrProxyDuplicated:
-		return false, s.Update(p)
-	case nil:
-		return true, nil
-	default:
-		return false, err
+	if p == nil || p.Score <= 0 {
+		return false, ErrProxyInvalid
 	}
+	h := hashIP(p.IP)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sp, found := s.m[h]; found {
+		return false, s.replace(h, sp, p)
+	}
+	p.Version = 1
+	s.put(h, p.Clone())
+	return true, nil
 }
 
 func (s *InMemoryBackend) Len() uint {
@@ -151,7 +236,25 @@ func (s *InMemoryBackend) TopK(k int) []*proxy.Proxy {
 	return proxies
 }
 
+func (s *InMemoryBackend) All() []*proxy.Proxy {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	proxies := make([]*proxy.Proxy, 0, len(s.m))
+	for _, pxy := range s.m {
+		proxies = append(proxies, pxy.Clone())
+	}
+	return proxies
+}
+
+// Iter calls iter with a copy of each proxy order by score descend, and ip ascend when tied.
 func (s *InMemoryBackend) Iter(iter Iterator) {
+	s.iter(func(pxy *proxy.Proxy) bool {
+		return iter(pxy.Clone())
+	})
+}
+
+// iter calls iter with the stored proxies, which must not be changed or leaked.
+func (s *InMemoryBackend) iter(iter Iterator) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 	s.rbt.Descend(s.rbt.Max(), func(item rbtree.Item) bool {
@@ -0,0 +1,100 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+var benchCountries = []string{"CN", "HK", "US", "JP", "DE", "RU", "BR", "IN", "SG", "KR"}
+
+func newBenchProxy(i int) *proxy.Proxy {
+	return &proxy.Proxy{
+		IP:       net.IPv4(byte(i>>24), byte(i>>16), byte(i>>8), byte(i)),
+		Port:     80,
+		Protocol: []proxy.Protocol{proxy.HTTP, proxy.HTTPS, proxy.SOCKS5}[i%3],
+		Anon:     proxy.Anonymity(i % 4),
+		Score:    int8(1 + rand.Intn(int(proxy.MaximumScore))),
+		Latency:  uint32(rand.Intn(2000)),
+		GeoInfo:  &proxy.GeoInfo{CountryCode: benchCountries[i%len(benchCountries)]},
+	}
+}
+
+func TestInMemoryBackendIndexes(t *testing.T) {
+	assert := assert.New(t)
+	b := NewInMemoryBackend()
+	for i := 1; i <= 100; i++ {
+		b.Insert(newBenchProxy(i))
+	}
+	_, size, indexed := b.indexes.best([]storage.Condition{
+		storage.AnonymityAtLeast(proxy.Anonymous),
+		storage.CountryIn("CN"),
+	})
+	assert.True(indexed)
+	assert.Equal(10, size) // the country index is more selective
+	_, _, indexed = b.indexes.best([]storage.Condition{storage.CheckedSince(proxy.Proxy{}.CheckedAt)})
+	assert.False(indexed)
+	// indexes are maintained on update and delete
+	pxy := b.Search(net.IPv4(0, 0, 0, 10))
+	pxy.GeoInfo = &proxy.GeoInfo{CountryCode: "FR"}
+	b.Update(pxy)
+	_, size, _ = b.indexes.best([]storage.Condition{storage.CountryIn("FR")})
+	assert.Equal(1, size)
+	b.Delete(pxy)
+	_, size, _ = b.indexes.best([]storage.Condition{storage.CountryIn("FR")})
+	assert.Equal(0, size)
+}
+
+func TestInMemoryBackendSelectIndexedTies(t *testing.T) {
+	b := NewInMemoryBackend()
+	var ips []string
+	for i := 1; i <= 20; i++ {
+		pxy := newBenchProxy(i)
+		pxy.Score, pxy.GeoInfo = 60, &proxy.GeoInfo{CountryCode: "CN"}
+		b.Insert(pxy)
+		ips = append(ips, pxy.IP.String())
+	}
+	sort.Strings(ips)
+	for n := 0; n < 3; n++ {
+		proxies, err := b.Select(storage.WithQuery(storage.MustParseQuery("country in (CN)")))
+		assert.Nil(t, err)
+		var got []string
+		for _, pxy := range proxies {
+			got = append(got, pxy.IP.String())
+		}
+		// the ties are ordered by ip like OrderBy, not by the index
+		assert.Equal(t, ips, got)
+	}
+}
+
+func BenchmarkInMemoryBackendSelect(b *testing.B) {
+	query := storage.MustParseQuery("score >= 80 and anon = elite and country in (CN, HK) and latency < 800")
+	for _, n := range []int{10000, 100000, 1000000} {
+		backend := NewInMemoryBackend()
+		for i := 1; i <= n; i++ {
+			backend.Insert(newBenchProxy(i))
+		}
+		for name, opts := range map[string][]storage.SelectOption{
+			"Indexed":      {storage.WithQuery(query)},
+			"Scan":         {storage.WithFilter(query.Filter())},
+			"IndexedTop10": {storage.WithQuery(query), storage.WithLimit(10)},
+			"ScanTop10":    {storage.WithFilter(query.Filter()), storage.WithLimit(10)},
+		} {
+			b.Run(fmt.Sprintf("%s-%d", name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					backend.Select(opts...)
+				}
+			})
+		}
+	}
+}
@@ -5,6 +5,10 @@
 package backend
 
 import (
+	"net"
+	"sync"
+	"sync/atomic"
+
 	"github.com/Leosocy/IntelliProxy/pkg/proxy"
 	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
 	"github.com/Leosocy/IntelliProxy/pkg/storage"
@@ -14,14 +18,109 @@ import (
 type NotifyBackend interface {
 	pubsub.Notifier
 	Backend
+	// Evict deletes the proxy from backend, and notifies a Delete event with reason.
+	Evict(p *proxy.Proxy, reason Reason) error
+	// Tag returns a view of the backend, which tags the events of
+	// its writes with source and reason.
+	Tag(source Source, reason Reason) NotifyBackend
 }
 
 // Event represents a single backend notification.
 type Event struct {
-	Op  Op           // Backend operation that triggered the event.
-	Pxy *proxy.Proxy // Related proxy.
+	Op     Op           // Backend operation that triggered the event.
+	Pxy    *proxy.Proxy // Related proxy, the deleted one of Delete event.
+	Old    *proxy.Proxy // The proxy before Update or Delete, nil if unknown.
+	Reason Reason       // Why the operation happened, empty if unknown.
+	Source Source       // Who made the operation, empty if unknown.
+}
+
+// ScoreDelta returns the change of score, a missing proxy is scored 0.
+func (e *Event) ScoreDelta() int {
+	return int(scoreOf(e.after())) - int(scoreOf(e.before()))
+}
+
+// before returns the proxy before the event, nil if it didn't exist.
+func (e *Event) before() *proxy.Proxy {
+	if e.Op == Insert {
+		return nil
+	}
+	return e.Old
+}
+
+// after returns the proxy after the event, nil if it doesn't exist.
+func (e *Event) after() *proxy.Proxy {
+	if e.Op == Delete {
+		return nil
+	}
+	return e.Pxy
+}
+
+func scoreOf(p *proxy.Proxy) int8 {
+	if p == nil {
+		return 0
+	}
+	return p.Score
+}
+
+// Changes returns the json names of fields changed by Update event,
+// e.g. score and geo_info, it returns nil if the old value is unknown.
+func (e *Event) Changes() (fields []string) {
+	if e.Op != Update || e.Old == nil {
+		return nil
+	}
+	o, n := e.Old, e.Pxy
+	for _, c := range []struct {
+		name    string
+		changed bool
+	}{
+		{"port", o.Port != n.Port},
+		{"protocol", o.Protocol != n.Protocol},
+		{"geo_info", (o.GeoInfo == nil) != (n.GeoInfo == nil) || (o.GeoInfo != nil && *o.GeoInfo != *n.GeoInfo)},
+		{"anonymity", o.Anon != n.Anon},
+		{"capabilities", o.Caps != n.Caps},
+		{"latency", o.Latency != n.Latency},
+		{"speed", o.Speed != n.Speed},
+		{"score", o.Score != n.Score},
+		{"checked_at", !o.CheckedAt.Equal(n.CheckedAt)},
+		{"uses", o.Uses != n.Uses},
+	} {
+		if c.changed {
+			fields = append(fields, c.name)
+		}
+	}
+	return
 }
 
+// Reason describes why a proxy is changed or deleted.
+type Reason string
+
+// Reasons of backend operations.
+const (
+	ReasonExpired   Reason = "expired"   // not checked within the max age
+	ReasonEvicted   Reason = "evicted"   // evicted since the pool is full
+	ReasonCrawled   Reason = "crawled"   // found by spider
+	ReasonSubmitted Reason = "submitted" // submitted by a trusted entry point
+	ReasonRestored  Reason = "restored"  // restored from snapshot on start
+	ReasonSighted   Reason = "sighted"   // listed again by a source
+	ReasonInspected Reason = "inspected" // scored by checker
+	ReasonDetected  Reason = "detected"  // anonymity or geography information detected
+	ReasonUsed      Reason = "used"      // used by middleman successfully
+	ReasonFailed    Reason = "failed"    // failed to be used by middleman
+)
+
+// Source describes the component which made the operation.
+type Source string
+
+// Sources of backend operations.
+const (
+	SourceSpider    Source = "spider"
+	SourceChecker   Source = "checker"
+	SourceMiddleman Source = "middleman"
+	SourceEviction  Source = "eviction"
+	SourceSubmit    Source = "submit"
+	SourceSnapshot  Source = "snapshot"
+)
+
 // Op describes a set of backend operations.
 type Op uint32
 
@@ -32,53 +131,242 @@ const (
 	Delete
 )
 
+// MarshalText implements encoding.TextMarshaler, so that Op is encoded as its name in JSON.
+func (op Op) MarshalText() ([]byte, error) {
+	return []byte(op.String()), nil
+}
+
+func (op Op) String() string {
+	switch op {
+	case Insert:
+		return "insert"
+	case Update:
+		return "update"
+	case Delete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
 // notifyBackendWrapper implements NotifyBackend interface.
-// It wraps the Backend's `Insert/InsertOrUpdate` method to send event
+// It wraps the Backend's `Insert/Update/InsertOrUpdate/Modify/Delete` method to send event
 // when the new proxy inserted, updated or deleted.
+// The proxies of events are copies, so watchers can't affect the writers and vice versa.
 type notifyBackendWrapper struct {
 	pubsub.Notifier
 	Backend
+	source Source
+	reason Reason
+}
+
+func (nb *notifyBackendWrapper) notify(op Op, p, old *proxy.Proxy) {
+	nb.Notify(&Event{Op: op, Pxy: p.Clone(), Old: old, Reason: nb.reason, Source: nb.source})
 }
 
 func (nb *notifyBackendWrapper) Insert(p *proxy.Proxy) (err error) {
 	if err = nb.Backend.Insert(p); err == nil {
-		nb.Notify(&Event{Insert, p})
+		nb.notify(Insert, p, nil)
 	}
 	return
 }
 
+// Update notifies with the old value searched before updating, which may be
+// inaccurate if the proxy is written concurrently, use Modify if it matters.
 func (nb *notifyBackendWrapper) Update(newP *proxy.Proxy) (err error) {
+	old := nb.Backend.Search(newP.IP)
 	if err = nb.Backend.Update(newP); err == nil {
-		nb.Notify(&Event{Update, newP})
+		nb.notify(Update, newP, old)
 	}
 	return
 }
 
 func (nb *notifyBackendWrapper) InsertOrUpdate(p *proxy.Proxy) (inserted bool, err error) {
+	old := nb.Backend.Search(p.IP)
 	if inserted, err = nb.Backend.InsertOrUpdate(p); err == nil {
-		var op Op
 		if inserted {
-			op = Insert
+			nb.notify(Insert, p, nil)
 		} else {
-			op = Update
+			nb.notify(Update, p, old)
 		}
-		nb.Notify(&Event{op, p})
+	}
+	return
+}
+
+func (nb *notifyBackendWrapper) Modify(ip net.IP, fn Modifier) (newP *proxy.Proxy, err error) {
+	var old *proxy.Proxy
+	if newP, err = nb.Backend.Modify(ip, func(pxy *proxy.Proxy) error {
+		old = pxy.Clone()
+		return fn(pxy)
+	}); err == nil {
+		nb.notify(Update, newP, old)
 	}
 	return
 }
 
 func (nb *notifyBackendWrapper) Delete(p *proxy.Proxy) (err error) {
+	old := nb.Backend.Search(p.IP)
 	if err = nb.Backend.Delete(p); err == nil {
-		nb.Notify(&Event{Delete, p})
+		if old == nil {
+			old = p.Clone()
+		}
+		nb.notify(Delete, old, old)
 	}
 	return
 }
 
+func (nb *notifyBackendWrapper) Evict(p *proxy.Proxy, reason Reason) error {
+	return nb.Tag(SourceEviction, reason).Delete(p)
+}
+
+func (nb *notifyBackendWrapper) Tag(source Source, reason Reason) NotifyBackend {
+	return &notifyBackendWrapper{Notifier: nb.Notifier, Backend: nb.Backend, source: source, reason: reason}
+}
+
 // WithNotifier returns a notifiable backend with notifier
 func WithNotifier(backend Backend, notifier pubsub.Notifier) NotifyBackend {
 	return &notifyBackendWrapper{Notifier: notifier, Backend: backend}
 }
 
+// SizeWatcher notifies when the size of backend drops below the threshold,
+// and when it recovers to >= threshold.
+type SizeWatcher struct {
+	b         Backend
+	threshold uint
+	callback  func(size uint, below bool)
+	below     int32 // -1 unknown, 0 false, 1 true
+}
+
+func NewSizeWatcher(b Backend, threshold uint, callback func(size uint, below bool)) *SizeWatcher {
+	return &SizeWatcher{
+		b:         b,
+		threshold: threshold,
+		callback:  callback,
+		below:     -1,
+	}
+}
+
+// Receipt implements pubsub.Watcher interface.
+func (w *SizeWatcher) Receipt(obj interface{}) {
+	if e, ok := obj.(*Event); !ok || e.Op == Update {
+		return
+	}
+	size := w.b.Len()
+	var below int32
+	if size < w.threshold {
+		below = 1
+	}
+	if old := atomic.SwapInt32(&w.below, below); old != below && (old != -1 || below == 1) {
+		w.callback(size, below == 1)
+	}
+}
+
+// QualityWatcher tracks the number of proxies in backend which match the query,
+// and notifies when it drops below the low water mark, and when it recovers to
+// >= the high water mark afterwards, so that the notifications alternate.
+type QualityWatcher struct {
+	b         Backend
+	q         *storage.Query
+	low, high uint
+	callback  func(count uint, low bool)
+	mu        sync.Mutex
+	count     uint
+	lowered   bool // whether notified below the low water mark
+}
+
+// NewQualityWatcher returns a watcher of the proxies in b matching q, which are counted
+// initially. The high water mark is raised to low if less.
+func NewQualityWatcher(b Backend, q *storage.Query, low, high uint, callback func(count uint, low bool)) *QualityWatcher {
+	if high < low {
+		high = low
+	}
+	w := &QualityWatcher{b: b, q: q, low: low, high: high, callback: callback}
+	w.count = w.recount()
+	return w
+}
+
+// recount counts the proxies in backend matching the query.
+func (w *QualityWatcher) recount() (count uint) {
+	for _, pxy := range w.b.All() {
+		if w.q.Match(pxy) {
+			count++
+		}
+	}
+	return
+}
+
+// Count returns the number of proxies matching the query.
+func (w *QualityWatcher) Count() uint {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count
+}
+
+// Check notifies if the count crosses the water marks since the last notification.
+// It is called on every event, and should be called once after attached, since
+// the backend may be below the low water mark initially.
+func (w *QualityWatcher) Check() {
+	w.mu.Lock()
+	count, notify := w.count, false
+	switch {
+	case !w.lowered && count < w.low:
+		w.lowered, notify = true, true
+	case w.lowered && count >= w.high:
+		w.lowered, notify = false, true
+	}
+	lowered := w.lowered
+	w.mu.Unlock()
+	if notify {
+		w.callback(count, lowered)
+	}
+}
+
+// Receipt implements pubsub.Watcher interface.
+func (w *QualityWatcher) Receipt(obj interface{}) {
+	e, ok := obj.(*Event)
+	if !ok {
+		return
+	}
+	if e.Op == Update && e.Old == nil {
+		// recounts since whether the proxy matched before is unknown
+		count := w.recount()
+		w.mu.Lock()
+		w.count = count
+		w.mu.Unlock()
+	} else {
+		before, after := e.before(), e.after()
+		matched := func(pxy *proxy.Proxy) bool {
+			return pxy != nil && w.q.Match(pxy)
+		}
+		w.mu.Lock()
+		switch {
+		case !matched(before) && matched(after):
+			w.count++
+		case matched(before) && !matched(after) && w.count > 0:
+			w.count--
+		}
+		w.mu.Unlock()
+	}
+	w.Check()
+}
+
+// BusPublisher publishes the backend events to bus under topic `backend.<op>`,
+// e.g. backend.insert, the payload is *Event.
+type BusPublisher struct {
+	bus *pubsub.Bus
+}
+
+func NewBusPublisher(bus *pubsub.Bus) *BusPublisher {
+	return &BusPublisher{bus: bus}
+}
+
+// Receipt implements pubsub.Watcher interface.
+func (p *BusPublisher) Receipt(obj interface{}) {
+	if e, ok := obj.(*Event); ok {
+		p.bus.Publish(pubsub.Topic("backend", e.Op.String()), e)
+	}
+}
+
 // InsertionWatcher only interested in the new proxy inserted event,
 // and will notify when the proxy passed filtered if filters set.
 type InsertionWatcher struct {
@@ -101,12 +389,76 @@ func (w *InsertionWatcher) Receipt(obj interface{}) {
 }
 
 func (w *InsertionWatcher) receipt(e *Event) {
-	proxies := []*proxy.Proxy{e.Pxy}
-	for _, filter := range w.filters {
-		proxies = filter(proxies)
+	if pass(e.Pxy, w.filters) {
+		w.callback(e.Pxy)
+	}
+}
+
+// pass reports whether pxy passes all the filters.
+func pass(pxy *proxy.Proxy, filters []storage.Filter) bool {
+	return len(applyFilters([]*proxy.Proxy{pxy}, filters)) > 0
+}
+
+// EventWatcher is interested in the events of an operation,
+// and will notify when the proxy passed filters if filters set.
+// The proxy filtered is the new one of Insert and Update event,
+// and the deleted one of Delete event.
+type EventWatcher struct {
+	op       Op
+	callback func(*Event)
+	filters  []storage.Filter
+}
+
+// NewEventWatcher returns a watcher of events of op.
+func NewEventWatcher(op Op, callback func(*Event), fn ...storage.Filter) *EventWatcher {
+	return &EventWatcher{
+		op:       op,
+		callback: callback,
+		filters:  fn,
 	}
-	if len(proxies) == 0 {
+}
+
+// NewUpdateWatcher returns a watcher only interested in the Update events.
+func NewUpdateWatcher(callback func(*Event), fn ...storage.Filter) *EventWatcher {
+	return NewEventWatcher(Update, callback, fn...)
+}
+
+// NewDeletionWatcher returns a watcher only interested in the Delete events.
+func NewDeletionWatcher(callback func(*Event), fn ...storage.Filter) *EventWatcher {
+	return NewEventWatcher(Delete, callback, fn...)
+}
+
+// Receipt implements pubsub.Watcher interface with filters.
+func (w *EventWatcher) Receipt(obj interface{}) {
+	if e, ok := obj.(*Event); ok && e.Op == w.op && pass(e.Pxy, w.filters) {
+		w.callback(e)
+	}
+}
+
+// ScoreCrossingWatcher notifies when the score of a proxy crosses the threshold,
+// up is true if the score rises to >= threshold, false if it falls below it.
+// Missing proxy is scored 0, so the insertion of a proxy with score >= threshold
+// crosses up, and the deletion of a proxy with score >= threshold crosses down.
+type ScoreCrossingWatcher struct {
+	threshold int8
+	callback  func(e *Event, up bool)
+}
+
+func NewScoreCrossingWatcher(threshold int8, callback func(e *Event, up bool)) *ScoreCrossingWatcher {
+	return &ScoreCrossingWatcher{
+		threshold: threshold,
+		callback:  callback,
+	}
+}
+
+// Receipt implements pubsub.Watcher interface.
+func (w *ScoreCrossingWatcher) Receipt(obj interface{}) {
+	e, ok := obj.(*Event)
+	if !ok || (e.Op == Update && e.Old == nil) {
 		return
 	}
-	w.callback(proxies[0])
+	before, after := scoreOf(e.before()) >= w.threshold, scoreOf(e.after()) >= w.threshold
+	if before != after {
+		w.callback(e, after)
+	}
 }
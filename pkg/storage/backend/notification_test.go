@@ -5,6 +5,8 @@
 package backend
 
 import (
+	"net"
+	"sync"
 	"testing"
 
 	"github.com/Leosocy/IntelliProxy/pkg/proxy"
@@ -38,3 +40,151 @@ func TestInsertionWatcher(t *testing.T) {
 	// assert only notify when insert pxy
 	assert.Equal(t, 1, recvCount)
 }
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+func (r *eventRecorder) record(e *Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func TestEventWatchers(t *testing.T) {
+	nb := WithNotifier(NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	updates, deletions := &eventRecorder{}, &eventRecorder{}
+	nb.Attach(NewUpdateWatcher(updates.record, storage.FilterScore(50)))
+	nb.Attach(NewDeletionWatcher(deletions.record))
+
+	pxy, _ := proxy.NewProxy("1.2.3.4", "80")
+	nb.Insert(pxy)
+	checker := nb.Tag(SourceChecker, ReasonInspected)
+	checker.Modify(pxy.IP, func(p *proxy.Proxy) error {
+		p.AddScore(-10)
+		p.Latency = 100
+		return nil
+	})
+	// filtered out by score
+	checker.Modify(pxy.IP, func(p *proxy.Proxy) error {
+		p.Score = 10
+		return nil
+	})
+	nb.Evict(pxy, ReasonExpired)
+
+	assert.Len(t, updates.events, 1)
+	e := updates.events[0]
+	assert.Equal(t, SourceChecker, e.Source)
+	assert.Equal(t, ReasonInspected, e.Reason)
+	assert.Equal(t, -10, e.ScoreDelta())
+	assert.Equal(t, []string{"latency", "score", "checked_at"}, e.Changes())
+
+	assert.Len(t, deletions.events, 1)
+	e = deletions.events[0]
+	assert.Equal(t, SourceEviction, e.Source)
+	assert.Equal(t, ReasonExpired, e.Reason)
+	assert.Equal(t, int8(10), e.Pxy.Score)
+	assert.Equal(t, -10, e.ScoreDelta())
+	assert.Nil(t, e.Changes())
+}
+
+func TestScoreCrossingWatcher(t *testing.T) {
+	nb := WithNotifier(NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	var crossings []bool
+	nb.Attach(NewScoreCrossingWatcher(80, func(e *Event, up bool) {
+		crossings = append(crossings, up)
+	}))
+	setScore := func(ip net.IP, score int8) {
+		nb.Modify(ip, func(p *proxy.Proxy) error {
+			p.Score = score
+			return nil
+		})
+	}
+
+	good := &proxy.Proxy{IP: net.ParseIP("1.1.1.1"), Score: 90}
+	bad := &proxy.Proxy{IP: net.ParseIP("2.2.2.2"), Score: 50}
+	nb.Insert(good)       // up
+	nb.Insert(bad)        // none
+	setScore(bad.IP, 70)  // none
+	setScore(good.IP, 70) // down
+	setScore(bad.IP, 80)  // up
+	setScore(bad.IP, 100) // none
+	nb.Delete(bad)        // down
+	nb.Delete(good)       // none
+	assert.Equal(t, []bool{true, false, true, false}, crossings)
+}
+
+func TestBusPublisher(t *testing.T) {
+	bus := pubsub.NewBus()
+	nb := WithNotifier(NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	nb.Attach(NewBusPublisher(bus))
+	var topics []string
+	bus.Subscribe("backend.*", pubsub.Typed(func(topic string, e *Event) {
+		topics = append(topics, topic)
+	}))
+	pxy, _ := proxy.NewProxy("1.2.3.4", "80")
+	nb.Insert(pxy)
+	nb.Update(pxy)
+	nb.Delete(pxy)
+	bus.Flush()
+	assert.Equal(t, []string{"backend.insert", "backend.update", "backend.delete"}, topics)
+}
+
+func TestSizeWatcher(t *testing.T) {
+	nb := WithNotifier(NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	var levels []bool
+	nb.Attach(NewSizeWatcher(nb, 2, func(size uint, below bool) {
+		levels = append(levels, below)
+	}))
+	p1 := &proxy.Proxy{IP: net.ParseIP("1.1.1.1"), Score: 50}
+	p2 := &proxy.Proxy{IP: net.ParseIP("2.2.2.2"), Score: 50}
+	nb.Insert(p1) // below
+	nb.Insert(p2) // recovered
+	nb.Update(p2) // ignored
+	nb.Delete(p1) // below
+	nb.Delete(p2) // still below
+	assert.Equal(t, []bool{true, false, true}, levels)
+}
+
+func TestQualityWatcher(t *testing.T) {
+	b := NewInMemoryBackend()
+	b.Insert(&proxy.Proxy{IP: net.ParseIP("1.1.1.1"), Score: 80})
+	nb := WithNotifier(b, &pubsub.BaseNotifier{})
+	var counts []uint
+	var levels []bool
+	w := NewQualityWatcher(nb, storage.MustParseQuery("score >= 60"), 2, 3, func(count uint, low bool) {
+		counts = append(counts, count)
+		levels = append(levels, low)
+	})
+	nb.Attach(w)
+	assert.Equal(t, uint(1), w.Count())
+	w.Check() // low initially
+	p2 := &proxy.Proxy{IP: net.ParseIP("2.2.2.2"), Score: 80}
+	p3 := &proxy.Proxy{IP: net.ParseIP("3.3.3.3"), Score: 30}
+	nb.Insert(p2) // 2, between the marks
+	nb.Insert(p3) // not matched
+	nb.Modify(p3.IP, func(pxy *proxy.Proxy) error {
+		pxy.Score = 90 // 3, recovered
+		return nil
+	})
+	nb.Update(&proxy.Proxy{IP: p2.IP, Score: 10}) // old is searched, 2
+	nb.Delete(p3)                                 // 1, low
+	nb.Delete(p3)                                 // not found
+	assert.Equal(t, uint(1), w.Count())
+	assert.Equal(t, []uint{1, 3, 1}, counts)
+	assert.Equal(t, []bool{true, false, true}, levels)
+}
+
+func TestQualityWatcherTiedScores(t *testing.T) {
+	b := NewInMemoryBackend()
+	for i := 1; i <= 10; i++ {
+		b.Insert(&proxy.Proxy{IP: net.IPv4(10, 0, 0, byte(i)), Score: 100})
+	}
+	notified := false
+	w := NewQualityWatcher(WithNotifier(b, &pubsub.BaseNotifier{}), storage.MustParseQuery("score >= 60"), 10, 20,
+		func(count uint, low bool) { notified = true })
+	assert.Equal(t, uint(10), w.Count())
+	w.Check()
+	assert.False(t, notified)
+}
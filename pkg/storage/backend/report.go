@@ -0,0 +1,58 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"sort"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+)
+
+// SourceReport is the quality of proxies stored, which are listed by a source.
+type SourceReport struct {
+	Source    string  `json:"source"`
+	Proxies   uint    `json:"proxies"`    // stored proxies listed by the source
+	Exclusive uint    `json:"exclusive"`  // stored proxies listed by the source only
+	Share     float64 `json:"share"`      // of the stored proxies, in [0, 1]
+	MeanScore float64 `json:"mean_score"` // of the proxies listed by the source
+}
+
+// ReportSources returns the reports of all the sources listing the proxies
+// in b, sorted by the number of proxies descending.
+func ReportSources(b Backend) []SourceReport {
+	reports := make(map[string]*SourceReport)
+	scores := make(map[string]float64)
+	var total uint
+	b.Iter(func(pxy *proxy.Proxy) bool {
+		total++
+		sources := pxy.Sources()
+		for _, source := range sources {
+			r, ok := reports[source]
+			if !ok {
+				r = &SourceReport{Source: source}
+				reports[source] = r
+			}
+			r.Proxies++
+			if len(sources) == 1 {
+				r.Exclusive++
+			}
+			scores[source] += float64(pxy.Score)
+		}
+		return true
+	})
+	sorted := make([]SourceReport, 0, len(reports))
+	for source, r := range reports {
+		r.Share = float64(r.Proxies) / float64(total)
+		r.MeanScore = scores[source] / float64(r.Proxies)
+		sorted = append(sorted, *r)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Proxies != sorted[j].Proxies {
+			return sorted[i].Proxies > sorted[j].Proxies
+		}
+		return sorted[i].Source < sorted[j].Source
+	})
+	return sorted
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportSources(t *testing.T) {
+	b := NewInMemoryBackend()
+	assert.Empty(t, ReportSources(b))
+
+	now := time.Now()
+	sighted := func(ip string, score int8, sources ...string) *proxy.Proxy {
+		pxy := &proxy.Proxy{IP: net.ParseIP(ip), Score: score}
+		for _, source := range sources {
+			pxy.Sight(source, now)
+		}
+		return pxy
+	}
+	for _, pxy := range []*proxy.Proxy{
+		sighted("1.1.1.1", 90, "xici", "kuai"),
+		sighted("2.2.2.2", 60, "xici"),
+		sighted("3.3.3.3", 30, "kuai", "yun", "xici"),
+		{IP: net.ParseIP("4.4.4.4"), Score: 80, Source: "manual"},
+		{IP: net.ParseIP("5.5.5.5"), Score: 10},
+	} {
+		assert.Nil(t, b.Insert(pxy))
+	}
+	assert.Equal(t, []SourceReport{
+		{Source: "xici", Proxies: 3, Exclusive: 1, Share: 0.6, MeanScore: 60},
+		{Source: "kuai", Proxies: 2, Share: 0.4, MeanScore: 60},
+		{Source: "manual", Proxies: 1, Exclusive: 1, Share: 0.2, MeanScore: 80},
+		{Source: "yun", Proxies: 1, Share: 0.2, MeanScore: 30},
+	}, ReportSources(b))
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/storage"
+)
+
+// SnapshotVersion is the version of snapshot format written by Snapshotter,
+// it must be increased when the format changes incompatibly.
+const SnapshotVersion = 1
+
+type snapshot struct {
+	Version   int             `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Proxies   []*proxy.Record `json:"proxies"`
+}
+
+// Snapshotter saves all proxies of a backend to a file and loads them back,
+// which provides crash safety for the non-persistent backends, e.g. InMemoryBackend.
+type Snapshotter struct {
+	backend Backend
+	path    string
+}
+
+// NewSnapshotter returns a snapshotter which saves backend to path.
+func NewSnapshotter(backend Backend, path string) *Snapshotter {
+	return &Snapshotter{backend: backend, path: path}
+}
+
+// Save writes a snapshot of all proxies atomically,
+// the snapshot is written to a temporary file first and then renamed to path.
+func (s *Snapshotter) Save() error {
+	proxies := s.backend.All()
+	storage.OrderBy{}.Sort(proxies)
+	records := make([]*proxy.Record, 0, len(proxies))
+	for _, pxy := range proxies {
+		records = append(records, proxy.NewRecord(pxy))
+	}
+	data, err := json.Marshal(&snapshot{
+		Version:   SnapshotVersion,
+		CreatedAt: time.Now(),
+		Proxies:   records,
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Load reads proxies from the latest snapshot,
+// it returns no proxies and no error if the snapshot doesn't exist.
+func (s *Snapshotter) Load() ([]*proxy.Proxy, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var snap snapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	if snap.Version != SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	proxies := make([]*proxy.Proxy, 0, len(snap.Proxies))
+	for _, r := range snap.Proxies {
+		proxies = append(proxies, r.Unwrap())
+	}
+	return proxies, nil
+}
+
+// Run saves a snapshot every period until ctx is done.
+func (s *Snapshotter) Run(ctx context.Context, period time.Duration, onErr func(error)) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Save(); err != nil && onErr != nil {
+				onErr(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
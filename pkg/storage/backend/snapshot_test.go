@@ -0,0 +1,51 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotter(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	b := NewInMemoryBackend()
+	s := NewSnapshotter(b, path)
+	// snapshot doesn't exist
+	proxies, err := s.Load()
+	assert.Nil(err)
+	assert.Empty(proxies)
+	// save and load
+	b.Insert(&proxy.Proxy{IP: net.ParseIP("1.2.3.4"), Port: 80, Score: 50,
+		GeoInfo: &proxy.GeoInfo{CountryCode: "CN"}})
+	b.Insert(&proxy.Proxy{IP: net.ParseIP("5.6.7.8"), Port: 8080, Score: 80, Anon: proxy.Elite,
+		Username: "user", Password: "secret"})
+	assert.Nil(s.Save())
+	proxies, err = s.Load()
+	assert.Nil(err)
+	assert.Len(proxies, 2)
+	assert.Equal("5.6.7.8", proxies[0].IP.String())
+	assert.Equal(proxy.Elite, proxies[0].Anon)
+	assert.Equal("secret", proxies[0].Password) // kept by snapshots only
+	assert.Equal("CN", proxies[1].GeoInfo.CountryCode)
+	// all the tied ones
+	for i := 1; i <= 20; i++ {
+		b.Insert(&proxy.Proxy{IP: net.IPv4(10, 0, 0, byte(i)), Port: 80, Score: 100})
+	}
+	assert.Nil(s.Save())
+	proxies, err = s.Load()
+	assert.Nil(err)
+	assert.Len(proxies, 22)
+	// unsupported version
+	ioutil.WriteFile(path, []byte(`{"version": 0}`), 0600)
+	_, err = s.Load()
+	assert.NotNil(err)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"math"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+)
+
+// Names of the proxy fields which backends may maintain secondary indexes on.
+const (
+	IndexScore     = "score"
+	IndexCountry   = "country"
+	IndexAnonymity = "anonymity"
+	IndexCheckedAt = "checked_at"
+	IndexProtocol  = "protocol"
+)
+
+// Condition is an indexable predicate on a single proxy field.
+//
+// String indexes (country, protocol) match when the value equals any of Values,
+// numeric indexes (score, anonymity, checked_at as unix nano) match
+// when the value is within the inclusive range [Min, Max].
+type Condition struct {
+	Index  string
+	Values []string
+	Min    int64
+	Max    int64
+}
+
+// ScoreBetween returns a condition matching proxies which min <= score <= max.
+func ScoreBetween(min, max int8) Condition {
+	return Condition{Index: IndexScore, Min: int64(min), Max: int64(max)}
+}
+
+// CountryIn returns a condition matching proxies located in one of the countries,
+// codes are ISO 3166-1 alpha-2, e.g. CN.
+func CountryIn(codes ...string) Condition {
+	return Condition{Index: IndexCountry, Values: codes}
+}
+
+// ProtocolIn returns a condition matching proxies using one of the protocols.
+func ProtocolIn(protocols ...proxy.Protocol) Condition {
+	values := make([]string, 0, len(protocols))
+	for _, p := range protocols {
+		values = append(values, string(p))
+	}
+	return Condition{Index: IndexProtocol, Values: values}
+}
+
+// AnonymityAtLeast returns a condition matching proxies which anonymity >= anon.
+func AnonymityAtLeast(anon proxy.Anonymity) Condition {
+	return Condition{Index: IndexAnonymity, Min: int64(anon), Max: int64(proxy.Elite)}
+}
+
+// CheckedSince returns a condition matching proxies checked at or after t.
+func CheckedSince(t time.Time) Condition {
+	return Condition{Index: IndexCheckedAt, Min: t.UnixNano(), Max: math.MaxInt64}
+}
+
+// Match reports whether the proxy satisfies the condition.
+func (c Condition) Match(pxy *proxy.Proxy) bool {
+	switch c.Index {
+	case IndexCountry:
+		return c.contains(CountryOf(pxy))
+	case IndexProtocol:
+		return c.contains(string(ProtocolOf(pxy)))
+	case IndexScore:
+		return c.inRange(int64(pxy.Score))
+	case IndexAnonymity:
+		return c.inRange(int64(pxy.Anon))
+	case IndexCheckedAt:
+		return c.inRange(pxy.CheckedAt.UnixNano())
+	default:
+		return true
+	}
+}
+
+func (c Condition) contains(s string) bool {
+	for _, v := range c.Values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Condition) inRange(v int64) bool {
+	return v >= c.Min && v <= c.Max
+}
+
+// Filter returns a Filter which only keeps proxies matching the condition.
+func (c Condition) Filter() Filter {
+	return FilterFunc(c.Match)
+}
+
+// CountryOf returns the country code of the proxy, or empty if geo info unknown.
+func CountryOf(pxy *proxy.Proxy) string {
+	if pxy.GeoInfo == nil {
+		return ""
+	}
+	return pxy.GeoInfo.CountryCode
+}
+
+// ProtocolOf returns the protocol of proxy, empty protocol means http.
+func ProtocolOf(pxy *proxy.Proxy) proxy.Protocol {
+	if pxy.Protocol == "" {
+		return proxy.HTTP
+	}
+	return pxy.Protocol
+}
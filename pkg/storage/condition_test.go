@@ -0,0 +1,36 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditionMatch(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	pxy := &proxy.Proxy{
+		IP:        net.ParseIP("1.1.1.1"),
+		Score:     60,
+		Anon:      proxy.Anonymous,
+		GeoInfo:   &proxy.GeoInfo{CountryCode: "CN"},
+		CheckedAt: now,
+	}
+	assert.True(ScoreBetween(60, 100).Match(pxy))
+	assert.False(ScoreBetween(61, 100).Match(pxy))
+	assert.True(CountryIn("HK", "CN").Match(pxy))
+	assert.False(CountryIn("US").Match(pxy))
+	assert.False(CountryIn("CN").Match(&proxy.Proxy{}))
+	assert.True(AnonymityAtLeast(proxy.Anonymous).Match(pxy))
+	assert.False(AnonymityAtLeast(proxy.Elite).Match(pxy))
+	assert.True(CheckedSince(now.Add(-time.Minute)).Match(pxy))
+	assert.False(CheckedSince(now.Add(time.Minute)).Match(pxy))
+	assert.Len(CountryIn("CN").Filter()([]*proxy.Proxy{pxy, {}}), 1)
+}
@@ -5,22 +5,150 @@
 package storage
 
 import (
+	"strings"
+	"time"
+
 	"github.com/Leosocy/IntelliProxy/pkg/proxy"
 )
 
 // Filter is used to filter a proxy during the selection process
 type Filter func([]*proxy.Proxy) []*proxy.Proxy
 
-// FilterScore is a score based Select Filter which will
-// only return proxies which score >= threshold
-func FilterScore(threshold int8) Filter {
+// FilterFunc returns a Filter which only keeps proxies that match returns true.
+func FilterFunc(match func(pxy *proxy.Proxy) bool) Filter {
 	return func(old []*proxy.Proxy) []*proxy.Proxy {
 		var proxies []*proxy.Proxy
 		for _, pxy := range old {
-			if pxy.Score >= threshold {
+			if match(pxy) {
 				proxies = append(proxies, pxy)
 			}
 		}
 		return proxies
 	}
 }
+
+// FilterScore is a score based Select Filter which will
+// only return proxies which score >= threshold
+func FilterScore(threshold int8) Filter {
+	return FilterFunc(func(pxy *proxy.Proxy) bool {
+		return pxy.Score >= threshold
+	})
+}
+
+// FilterAnonymity only returns proxies which anonymity >= anon.
+func FilterAnonymity(anon proxy.Anonymity) Filter {
+	return FilterFunc(func(pxy *proxy.Proxy) bool {
+		return pxy.Anon >= anon
+	})
+}
+
+// FilterCountry only returns proxies located in one of the countries, e.g. CN.
+func FilterCountry(codes ...string) Filter {
+	return filterGeo(func(info *proxy.GeoInfo) string { return info.CountryCode }, codes)
+}
+
+// FilterRegion only returns proxies located in one of the regions, e.g. JS or Jiangsu.
+func FilterRegion(regions ...string) Filter {
+	return FilterFunc(func(pxy *proxy.Proxy) bool {
+		if pxy.GeoInfo == nil {
+			return false
+		}
+		return containsFold(regions, pxy.GeoInfo.RegionCode) || containsFold(regions, pxy.GeoInfo.RegionName)
+	})
+}
+
+// FilterCity only returns proxies located in one of the cities, e.g. Nanjing.
+func FilterCity(cities ...string) Filter {
+	return filterGeo(func(info *proxy.GeoInfo) string { return info.City }, cities)
+}
+
+// FilterISP only returns proxies which ISP contains one of the names, case insensitive.
+func FilterISP(names ...string) Filter {
+	return FilterFunc(func(pxy *proxy.Proxy) bool {
+		if pxy.GeoInfo == nil {
+			return false
+		}
+		isp := strings.ToLower(pxy.GeoInfo.ISP)
+		for _, name := range names {
+			if strings.Contains(isp, strings.ToLower(name)) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// FilterASN only returns proxies belong to one of the autonomous systems, e.g. AS4134.
+func FilterASN(asns ...string) Filter {
+	return filterGeo(func(info *proxy.GeoInfo) string { return asnOf(info.ASN) }, asns)
+}
+
+// FilterLatency only returns proxies which latency is known and <= max.
+func FilterLatency(max time.Duration) Filter {
+	return FilterFunc(func(pxy *proxy.Proxy) bool {
+		return pxy.Latency > 0 && time.Duration(pxy.Latency)*time.Millisecond <= max
+	})
+}
+
+// FilterSpeed only returns proxies which speed >= min kb/s.
+func FilterSpeed(min uint32) Filter {
+	return FilterFunc(func(pxy *proxy.Proxy) bool {
+		return pxy.Speed >= min
+	})
+}
+
+// FilterProtocol only returns proxies using one of the protocols.
+func FilterProtocol(protocols ...proxy.Protocol) Filter {
+	return FilterFunc(func(pxy *proxy.Proxy) bool {
+		for _, p := range protocols {
+			if ProtocolOf(pxy) == p {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// FilterCapability only returns proxies which support all the capabilities.
+func FilterCapability(caps proxy.Capability) Filter {
+	return FilterFunc(func(pxy *proxy.Proxy) bool {
+		return pxy.Caps.Has(caps)
+	})
+}
+
+// FilterCheckedWithin only returns proxies checked within the duration.
+func FilterCheckedWithin(d time.Duration) Filter {
+	return FilterFunc(func(pxy *proxy.Proxy) bool {
+		return time.Since(pxy.CheckedAt) <= d
+	})
+}
+
+// FilterCreatedWithin only returns proxies created within the duration.
+func FilterCreatedWithin(d time.Duration) Filter {
+	return FilterFunc(func(pxy *proxy.Proxy) bool {
+		return time.Since(pxy.CreatedAt) <= d
+	})
+}
+
+func filterGeo(get func(info *proxy.GeoInfo) string, values []string) Filter {
+	return FilterFunc(func(pxy *proxy.Proxy) bool {
+		return pxy.GeoInfo != nil && containsFold(values, get(pxy.GeoInfo))
+	})
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if s != "" && strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// asnOf returns the AS number part of ip-api `as` field, e.g. AS4134.
+func asnOf(as string) string {
+	if idx := strings.IndexByte(as, ' '); idx >= 0 {
+		return as[:idx]
+	}
+	return as
+}
@@ -7,6 +7,7 @@ package storage
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/Leosocy/IntelliProxy/pkg/proxy"
 	"github.com/stretchr/testify/assert"
@@ -42,3 +43,37 @@ func TestFilterScore(t *testing.T) {
 		assert.Equal(data.count, len(proxies))
 	}
 }
+
+func TestBuiltinFilters(t *testing.T) {
+	assert := assert.New(t)
+	proxies := []*proxy.Proxy{
+		{
+			IP: net.ParseIP("1.1.1.1"), Anon: proxy.Elite, Protocol: proxy.SOCKS5, Caps: proxy.CapHTTPS | proxy.CapPOST,
+			Latency: 300, Speed: 200, CreatedAt: time.Now(), CheckedAt: time.Now(),
+			GeoInfo: &proxy.GeoInfo{CountryCode: "CN", RegionCode: "JS", City: "Nanjing", ISP: "Chinanet", ASN: "AS4134 CHINANET"},
+		},
+		{
+			IP: net.ParseIP("2.2.2.2"), Anon: proxy.Transparent, Latency: 1000,
+			CreatedAt: time.Now().Add(-time.Hour), CheckedAt: time.Now().Add(-time.Hour),
+		},
+	}
+	for _, filter := range []Filter{
+		FilterAnonymity(proxy.Anonymous),
+		FilterCountry("cn"),
+		FilterRegion("JS"),
+		FilterCity("Nanjing"),
+		FilterISP("chinanet"),
+		FilterASN("AS4134"),
+		FilterLatency(500 * time.Millisecond),
+		FilterSpeed(100),
+		FilterProtocol(proxy.SOCKS5),
+		FilterCapability(proxy.CapHTTPS),
+		FilterCheckedWithin(time.Minute),
+		FilterCreatedWithin(time.Minute),
+	} {
+		filtered := filter(proxies)
+		assert.Len(filtered, 1)
+		assert.Equal("1.1.1.1", filtered[0].IP.String())
+	}
+	assert.Len(FilterProtocol(proxy.HTTP)(proxies), 1)
+}
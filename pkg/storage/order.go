@@ -0,0 +1,200 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+)
+
+// ErrInvalidCursor is returned by Select when the cursor can't be decoded.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// OrderField is the proxy field which the selection sorted by.
+type OrderField string
+
+// Fields supported by OrderBy.
+const (
+	OrderByScore     OrderField = "score"
+	OrderByLatency   OrderField = "latency"
+	OrderBySpeed     OrderField = "speed"
+	OrderByCheckedAt OrderField = "checked_at"
+	OrderByCreatedAt OrderField = "created_at"
+	// OrderByRandom sorts by a random permutation that is stable for the same seed.
+	OrderByRandom OrderField = "random"
+)
+
+// Direction of order.
+const (
+	Asc  = false
+	Desc = true
+)
+
+// OrderBy describes how the selected proxies are sorted,
+// the zero value sorts by score descend.
+type OrderBy struct {
+	Field OrderField `json:"f"`
+	Desc  bool       `json:"d"`
+	Seed  int64      `json:"s,omitempty"` // only used by OrderByRandom
+}
+
+// NewOrderBy returns an OrderBy, a new seed is generated for OrderByRandom.
+func NewOrderBy(field OrderField, desc bool) OrderBy {
+	o := OrderBy{Field: field, Desc: desc}
+	if field == OrderByRandom {
+		o.Seed = rand.Int63()
+	}
+	return o
+}
+
+// WithOrderBy sets the order of the proxies returned.
+func WithOrderBy(field OrderField, desc bool) SelectOption {
+	order := NewOrderBy(field, desc)
+	return func(options *SelectOptions) {
+		options.OrderBy = order
+	}
+}
+
+// WithCursor makes Select return the proxies after the cursor,
+// cursor is returned by NextCursor and carries the order itself,
+// so the order of the previous page is used regardless of WithOrderBy.
+func WithCursor(cursor string) SelectOption {
+	return func(options *SelectOptions) {
+		options.Cursor = cursor
+	}
+}
+
+func (o OrderBy) field() OrderField {
+	if o.Field == "" {
+		return OrderByScore
+	}
+	return o.Field
+}
+
+// isDefault reports whether o is the natural order of backends, i.e. score descend.
+func (o OrderBy) isDefault() bool {
+	return o.field() == OrderByScore && (o.Field == "" || o.Desc)
+}
+
+func (o OrderBy) value(pxy *proxy.Proxy) int64 {
+	switch o.field() {
+	case OrderByLatency:
+		return int64(pxy.Latency)
+	case OrderBySpeed:
+		return int64(pxy.Speed)
+	case OrderByCheckedAt:
+		return pxy.CheckedAt.UnixNano()
+	case OrderByCreatedAt:
+		return pxy.CreatedAt.UnixNano()
+	case OrderByRandom:
+		hasher := fnv.New64a()
+		binary.Write(hasher, binary.BigEndian, o.Seed)
+		hasher.Write(pxy.IP)
+		return int64(hasher.Sum64() >> 1)
+	default:
+		return int64(pxy.Score)
+	}
+}
+
+// less compares by (value, ip) in the direction of order,
+// ip breaks ties so that every proxy has a unique position.
+func (o OrderBy) less(v1 int64, ip1 string, v2 int64, ip2 string) bool {
+	if v1 == v2 {
+		return ip1 < ip2
+	}
+	if o.Desc || o.Field == "" {
+		return v1 > v2
+	}
+	return v1 < v2
+}
+
+// Sort sorts proxies in place by the order.
+func (o OrderBy) Sort(proxies []*proxy.Proxy) {
+	sort.SliceStable(proxies, func(i, j int) bool {
+		return o.less(o.value(proxies[i]), proxies[i].IP.String(), o.value(proxies[j]), proxies[j].IP.String())
+	})
+}
+
+type cursor struct {
+	OrderBy
+	Value int64  `json:"v"`
+	IP    string `json:"ip"`
+}
+
+// NextCursor returns the cursor pointing to the position right after page,
+// which is selected with opts, or empty if page is empty.
+//
+// The cursor records the sort key of the last proxy rather than an offset, so
+// pages stay stable while the backend mutates: a proxy is never returned twice
+// or skipped unless its own sort key changed between two pages.
+func NextCursor(page []*proxy.Proxy, opts ...SelectOption) string {
+	if len(page) == 0 {
+		return ""
+	}
+	options := SelectOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	order, _, err := options.order()
+	if err != nil {
+		return ""
+	}
+	last := page[len(page)-1]
+	data, _ := json.Marshal(&cursor{OrderBy: order, Value: order.value(last), IP: last.IP.String()})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// order returns the effective order and the decoded cursor if set.
+func (options *SelectOptions) order() (OrderBy, *cursor, error) {
+	if options.Cursor == "" {
+		return options.OrderBy, nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(options.Cursor)
+	if err != nil {
+		return OrderBy{}, nil, ErrInvalidCursor
+	}
+	c := &cursor{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return OrderBy{}, nil, ErrInvalidCursor
+	}
+	return c.OrderBy, c, nil
+}
+
+// Paginate sorts the filtered proxies by the order of options, drops the
+// proxies up to cursor, and then applies offset and limit.
+// The proxies passed in must be sorted by score descend, which is the
+// natural order of backends, so that they needn't be sorted again by default,
+// unless they are paged by limit or cursor, which need the ties of score
+// broken by ip, so that NextCursor and Paginate agree on a total order.
+func (options *SelectOptions) Paginate(proxies []*proxy.Proxy) ([]*proxy.Proxy, error) {
+	order, c, err := options.order()
+	if err != nil {
+		return nil, err
+	}
+	if !order.isDefault() || c != nil || options.Limit > 0 {
+		order.Sort(proxies)
+	}
+	if c != nil {
+		idx := sort.Search(len(proxies), func(i int) bool {
+			return order.less(c.Value, c.IP, order.value(proxies[i]), proxies[i].IP.String())
+		})
+		proxies = proxies[idx:]
+	}
+	if options.Offset >= len(proxies) {
+		return nil, nil
+	}
+	proxies = proxies[options.Offset:]
+	if options.Limit > 0 && options.Limit < len(proxies) {
+		proxies = proxies[:options.Limit]
+	}
+	return proxies, nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func newOrderTestProxies() []*proxy.Proxy {
+	var proxies []*proxy.Proxy
+	for i := 1; i <= 10; i++ {
+		proxies = append(proxies, &proxy.Proxy{
+			IP:      net.ParseIP(fmt.Sprintf("1.1.1.%d", i)),
+			Score:   int8(100 - i*5),
+			Latency: uint32(i % 3 * 100),
+		})
+	}
+	return proxies
+}
+
+func TestPaginateOrderBy(t *testing.T) {
+	assert := assert.New(t)
+	opts := SelectOptions{}
+	WithOrderBy(OrderByLatency, Asc)(&opts)
+	page, err := opts.Paginate(newOrderTestProxies())
+	assert.Nil(err)
+	for i := 1; i < len(page); i++ {
+		assert.True(page[i-1].Latency <= page[i].Latency)
+	}
+	// random order is stable for the same seed
+	WithOrderBy(OrderByRandom, Asc)(&opts)
+	first, _ := opts.Paginate(newOrderTestProxies())
+	second, _ := opts.Paginate(newOrderTestProxies())
+	assert.Equal(first, second)
+}
+
+func TestPaginateCursor(t *testing.T) {
+	assert := assert.New(t)
+	proxies := newOrderTestProxies()
+	opts := []SelectOption{WithOrderBy(OrderByLatency, Desc), WithLimit(4)}
+	seen := make(map[string]bool)
+	for {
+		options := SelectOptions{}
+		for _, opt := range opts {
+			opt(&options)
+		}
+		page, err := options.Paginate(append([]*proxy.Proxy(nil), proxies...))
+		assert.Nil(err)
+		for _, pxy := range page {
+			assert.False(seen[pxy.String()], "duplicated %s", pxy)
+			seen[pxy.String()] = true
+		}
+		if len(page) < options.Limit {
+			break
+		}
+		// rescoring doesn't affect the following pages
+		for _, pxy := range proxies {
+			pxy.Score = 100 - pxy.Score
+		}
+		opts = []SelectOption{WithCursor(NextCursor(page, opts...)), WithLimit(4)}
+	}
+	assert.Len(seen, len(proxies))
+	// invalid cursor
+	_, err := (&SelectOptions{Cursor: "invalid"}).Paginate(proxies)
+	assert.Equal(ErrInvalidCursor, err)
+}
+
+func TestPaginateCursorTiedScores(t *testing.T) {
+	assert := assert.New(t)
+	// score descend as backends return, but the ties are not ordered by ip
+	var proxies []*proxy.Proxy
+	for i := 30; i >= 1; i-- {
+		proxies = append(proxies, &proxy.Proxy{IP: net.ParseIP(fmt.Sprintf("1.1.1.%d", i)), Score: 80})
+	}
+	opts := []SelectOption{WithLimit(7)}
+	seen := make(map[string]bool)
+	for {
+		options := SelectOptions{}
+		for _, opt := range opts {
+			opt(&options)
+		}
+		page, err := options.Paginate(append([]*proxy.Proxy(nil), proxies...))
+		assert.Nil(err)
+		for _, pxy := range page {
+			assert.False(seen[pxy.String()], "duplicated %s", pxy)
+			seen[pxy.String()] = true
+		}
+		if len(page) < options.Limit {
+			break
+		}
+		opts = []SelectOption{WithCursor(NextCursor(page, opts...)), WithLimit(7)}
+	}
+	assert.Len(seen, len(proxies))
+}
@@ -0,0 +1,613 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+)
+
+// Query is a compiled query expression, e.g.
+//
+//	score >= 80 and anon = elite and country in (CN, HK) and latency < 800
+//
+// Grammar:
+//
+//	expr       = term { "or" term }
+//	term       = factor { "and" factor }
+//	factor     = "not" factor | "(" expr ")" | comparison
+//	comparison = field op value | field "in" "(" value { "," value } ")"
+//	op         = "=" | "!=" | "<" | "<=" | ">" | ">=" | "~"
+//
+// Numeric fields: score, latency(ms), speed(kb/s), anon(unknown|transparent|anonymous|elite),
+// checked_age and created_age(durations like 10m, the time since checked/created).
+// Text fields(case insensitive, "~" means contains): country, region, city, isp, asn, protocol.
+// Flag fields: cap(https|post), "=" means the proxy has the capability.
+type Query struct {
+	expr  string
+	match predicate
+	conds []Condition
+}
+
+type predicate func(pxy *proxy.Proxy) bool
+
+// ParseQuery compiles the query expression, an empty expression matches all proxies.
+func ParseQuery(expr string) (*Query, error) {
+	q := &Query{expr: expr, match: func(*proxy.Proxy) bool { return true }}
+	p := &queryParser{lexer: newQueryLexer(expr)}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == tokEOF {
+		return q, nil
+	}
+	var err error
+	if q.match, q.conds, err = p.parseExpr(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+	return q, nil
+}
+
+// MustParseQuery is like ParseQuery but panics if the expression can't be parsed.
+func MustParseQuery(expr string) *Query {
+	q, err := ParseQuery(expr)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+// Match reports whether the proxy satisfies the query.
+func (q *Query) Match(pxy *proxy.Proxy) bool {
+	return q.match(pxy)
+}
+
+// Filter returns a Filter which only keeps proxies matching the query.
+func (q *Query) Filter() Filter {
+	return FilterFunc(q.match)
+}
+
+// Conditions returns the indexable conditions implied by the query,
+// they are only extracted from comparisons joined by "and" at top level.
+func (q *Query) Conditions() []Condition {
+	return q.conds
+}
+
+func (q *Query) String() string {
+	return q.expr
+}
+
+// WithQuery adds the query's filter and indexable conditions used during the Select call.
+func WithQuery(q *Query) SelectOption {
+	return func(options *SelectOptions) {
+		options.Filters = append(options.Filters, q.Filter())
+		options.Conditions = append(options.Conditions, q.conds...)
+	}
+}
+
+type fieldKind uint8
+
+const (
+	numericField fieldKind = iota
+	textField
+	flagField
+)
+
+type queryField struct {
+	kind  fieldKind
+	num   func(pxy *proxy.Proxy) int64
+	text  func(pxy *proxy.Proxy) []string
+	parse func(v string) (int64, error)
+	// index and bounds of the condition implied by comparisons on this field.
+	index    string
+	min, max int64
+}
+
+var anonymityNames = map[string]proxy.Anonymity{
+	"unknown":     proxy.Unknown,
+	"transparent": proxy.Transparent,
+	"anonymous":   proxy.Anonymous,
+	"elite":       proxy.Elite,
+}
+
+var capabilityNames = map[string]proxy.Capability{
+	"https": proxy.CapHTTPS,
+	"post":  proxy.CapPOST,
+}
+
+func parseInt(v string) (int64, error) {
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func parseDuration(v string) (int64, error) {
+	d, err := time.ParseDuration(v)
+	return int64(d), err
+}
+
+func geoText(get func(info *proxy.GeoInfo) []string) func(pxy *proxy.Proxy) []string {
+	return func(pxy *proxy.Proxy) []string {
+		if pxy.GeoInfo == nil {
+			return nil
+		}
+		return get(pxy.GeoInfo)
+	}
+}
+
+var queryFields = map[string]*queryField{
+	"score": {
+		kind: numericField, parse: parseInt,
+		num:   func(pxy *proxy.Proxy) int64 { return int64(pxy.Score) },
+		index: IndexScore, min: 0, max: int64(proxy.MaximumScore),
+	},
+	"anon": {
+		kind: numericField,
+		num:  func(pxy *proxy.Proxy) int64 { return int64(pxy.Anon) },
+		parse: func(v string) (int64, error) {
+			if anon, ok := anonymityNames[strings.ToLower(v)]; ok {
+				return int64(anon), nil
+			}
+			return parseInt(v)
+		},
+		index: IndexAnonymity, min: int64(proxy.Unknown), max: int64(proxy.Elite),
+	},
+	"latency": {
+		kind: numericField, parse: parseInt,
+		num: func(pxy *proxy.Proxy) int64 { return int64(pxy.Latency) },
+	},
+	"speed": {
+		kind: numericField, parse: parseInt,
+		num: func(pxy *proxy.Proxy) int64 { return int64(pxy.Speed) },
+	},
+	"checked_age": {
+		kind: numericField, parse: parseDuration,
+		num: func(pxy *proxy.Proxy) int64 { return int64(time.Since(pxy.CheckedAt)) },
+	},
+	"created_age": {
+		kind: numericField, parse: parseDuration,
+		num: func(pxy *proxy.Proxy) int64 { return int64(time.Since(pxy.CreatedAt)) },
+	},
+	"country": {
+		kind:  textField,
+		text:  geoText(func(info *proxy.GeoInfo) []string { return []string{info.CountryCode, info.CountryName} }),
+		index: IndexCountry,
+	},
+	"region": {
+		kind: textField,
+		text: geoText(func(info *proxy.GeoInfo) []string { return []string{info.RegionCode, info.RegionName} }),
+	},
+	"city": {
+		kind: textField,
+		text: geoText(func(info *proxy.GeoInfo) []string { return []string{info.City} }),
+	},
+	"isp": {
+		kind: textField,
+		text: geoText(func(info *proxy.GeoInfo) []string { return []string{info.ISP} }),
+	},
+	"asn": {
+		kind: textField,
+		text: geoText(func(info *proxy.GeoInfo) []string { return []string{asnOf(info.ASN)} }),
+	},
+	"protocol": {
+		kind:  textField,
+		text:  func(pxy *proxy.Proxy) []string { return []string{string(ProtocolOf(pxy))} },
+		index: IndexProtocol,
+	},
+	"cap": {
+		kind: flagField,
+		num:  func(pxy *proxy.Proxy) int64 { return int64(pxy.Caps) },
+		parse: func(v string) (int64, error) {
+			if c, ok := capabilityNames[strings.ToLower(v)]; ok {
+				return int64(c), nil
+			}
+			return 0, fmt.Errorf("unknown capability %q", v)
+		},
+	},
+}
+
+func init() {
+	queryFields["anonymity"] = queryFields["anon"]
+	queryFields["caps"] = queryFields["cap"]
+}
+
+type queryParser struct {
+	*lexer
+	tok token
+}
+
+func (p *queryParser) next() (err error) {
+	p.tok, err = p.lexer.next()
+	return
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("query: %s at position %d", fmt.Sprintf(format, args...), p.tok.pos)
+}
+
+func (p *queryParser) isKeyword(kw string) bool {
+	return p.tok.kind == tokWord && strings.EqualFold(p.tok.text, kw)
+}
+
+// parseExpr returns the predicate and the indexable conditions
+// of the expression, conditions are dropped once "or" or "not" used.
+func (p *queryParser) parseExpr() (predicate, []Condition, error) {
+	left, conds, err := p.parseTerm()
+	if err != nil {
+		return nil, nil, err
+	}
+	for p.isKeyword("or") {
+		if err = p.next(); err != nil {
+			return nil, nil, err
+		}
+		right, _, err := p.parseTerm()
+		if err != nil {
+			return nil, nil, err
+		}
+		left, conds = or(left, right), nil
+	}
+	return left, conds, nil
+}
+
+func (p *queryParser) parseTerm() (predicate, []Condition, error) {
+	left, conds, err := p.parseFactor()
+	if err != nil {
+		return nil, nil, err
+	}
+	for p.isKeyword("and") {
+		if err = p.next(); err != nil {
+			return nil, nil, err
+		}
+		right, rconds, err := p.parseFactor()
+		if err != nil {
+			return nil, nil, err
+		}
+		left, conds = and(left, right), append(conds, rconds...)
+	}
+	return left, conds, nil
+}
+
+func (p *queryParser) parseFactor() (predicate, []Condition, error) {
+	switch {
+	case p.isKeyword("not"):
+		if err := p.next(); err != nil {
+			return nil, nil, err
+		}
+		pred, _, err := p.parseFactor()
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(pxy *proxy.Proxy) bool { return !pred(pxy) }, nil, nil
+	case p.tok.kind == tokLParen:
+		if err := p.next(); err != nil {
+			return nil, nil, err
+		}
+		pred, conds, err := p.parseExpr()
+		if err != nil {
+			return nil, nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, nil, p.errorf("expected )")
+		}
+		return pred, conds, p.next()
+	default:
+		return p.parseComparison()
+	}
+}
+
+func (p *queryParser) parseComparison() (predicate, []Condition, error) {
+	if p.tok.kind != tokWord {
+		return nil, nil, p.errorf("expected field, got %q", p.tok.text)
+	}
+	name := strings.ToLower(p.tok.text)
+	f, ok := queryFields[name]
+	if !ok {
+		return nil, nil, p.errorf("unknown field %q", p.tok.text)
+	}
+	if err := p.next(); err != nil {
+		return nil, nil, err
+	}
+	var op string
+	switch {
+	case p.tok.kind == tokOp:
+		op = p.tok.text
+	case p.isKeyword("in"):
+		op = "in"
+	default:
+		return nil, nil, p.errorf("expected operator after %s", name)
+	}
+	if err := p.next(); err != nil {
+		return nil, nil, err
+	}
+	values, err := p.parseValues(op == "in")
+	if err != nil {
+		return nil, nil, err
+	}
+	return f.compile(name, op, values, p)
+}
+
+func (p *queryParser) parseValues(list bool) (values []string, err error) {
+	if !list {
+		if p.tok.kind != tokWord && p.tok.kind != tokString {
+			return nil, p.errorf("expected value, got %q", p.tok.text)
+		}
+		values = append(values, p.tok.text)
+		return values, p.next()
+	}
+	if p.tok.kind != tokLParen {
+		return nil, p.errorf("expected ( after in")
+	}
+	for {
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokWord && p.tok.kind != tokString {
+			return nil, p.errorf("expected value, got %q", p.tok.text)
+		}
+		values = append(values, p.tok.text)
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == tokRParen {
+			return values, p.next()
+		}
+		if p.tok.kind != tokComma {
+			return nil, p.errorf("expected , or )")
+		}
+	}
+}
+
+func (f *queryField) compile(name, op string, values []string, p *queryParser) (predicate, []Condition, error) {
+	if f.kind == textField {
+		return f.compileText(name, op, values, p)
+	}
+	nums := make([]int64, 0, len(values))
+	for _, v := range values {
+		n, err := f.parse(v)
+		if err != nil {
+			return nil, nil, p.errorf("invalid value %q of %s", v, name)
+		}
+		nums = append(nums, n)
+	}
+	if f.kind == flagField {
+		has := func(pxy *proxy.Proxy) bool {
+			for _, n := range nums {
+				if f.num(pxy)&n == n {
+					return true
+				}
+			}
+			return false
+		}
+		switch op {
+		case "=", "in":
+			return has, nil, nil
+		case "!=":
+			return func(pxy *proxy.Proxy) bool { return !has(pxy) }, nil, nil
+		}
+		return nil, nil, p.errorf("operator %s not supported by %s", op, name)
+	}
+	n := nums[0]
+	lo, hi := int64(math.MinInt64), int64(math.MaxInt64)
+	var pred predicate
+	switch op {
+	case "=":
+		lo, hi = n, n
+	case ">=":
+		lo = n
+	case ">":
+		if n == math.MaxInt64 {
+			return none, nil, nil
+		}
+		lo = n + 1
+	case "<=":
+		hi = n
+	case "<":
+		if n == math.MinInt64 {
+			return none, nil, nil
+		}
+		hi = n - 1
+	case "!=":
+		pred = func(pxy *proxy.Proxy) bool { return f.num(pxy) != n }
+	case "in":
+		pred = func(pxy *proxy.Proxy) bool {
+			v := f.num(pxy)
+			for _, n := range nums {
+				if v == n {
+					return true
+				}
+			}
+			return false
+		}
+	default:
+		return nil, nil, p.errorf("operator %s not supported by %s", op, name)
+	}
+	if pred != nil {
+		return pred, nil, nil
+	}
+	pred = func(pxy *proxy.Proxy) bool {
+		v := f.num(pxy)
+		return v >= lo && v <= hi
+	}
+	if f.index == "" {
+		return pred, nil, nil
+	}
+	cond := Condition{Index: f.index, Min: maxInt64(lo, f.min), Max: minInt64(hi, f.max)}
+	return pred, []Condition{cond}, nil
+}
+
+func (f *queryField) compileText(name, op string, values []string, p *queryParser) (predicate, []Condition, error) {
+	if name == "asn" {
+		for i, v := range values {
+			if _, err := strconv.Atoi(v); err == nil {
+				values[i] = "AS" + v
+			}
+		}
+	}
+	eq := func(pxy *proxy.Proxy) bool {
+		for _, s := range f.text(pxy) {
+			if containsFold(values, s) {
+				return true
+			}
+		}
+		return false
+	}
+	switch op {
+	case "=", "in":
+		var conds []Condition
+		switch f.index {
+		case IndexCountry:
+			codes := make([]string, 0, len(values))
+			for _, v := range values {
+				codes = append(codes, strings.ToUpper(v))
+			}
+			// country names are not indexed, so only upper case codes are used.
+			if allCountryCodes(codes) {
+				conds = append(conds, Condition{Index: f.index, Values: codes})
+			}
+		case IndexProtocol:
+			protocols := make([]string, 0, len(values))
+			for _, v := range values {
+				protocols = append(protocols, strings.ToLower(v))
+			}
+			conds = append(conds, Condition{Index: f.index, Values: protocols})
+		}
+		return eq, conds, nil
+	case "!=":
+		return func(pxy *proxy.Proxy) bool { return !eq(pxy) }, nil, nil
+	case "~":
+		return func(pxy *proxy.Proxy) bool {
+			for _, s := range f.text(pxy) {
+				if strings.Contains(strings.ToLower(s), strings.ToLower(values[0])) {
+					return true
+				}
+			}
+			return false
+		}, nil, nil
+	}
+	return nil, nil, p.errorf("operator %s not supported by %s", op, name)
+}
+
+func allCountryCodes(codes []string) bool {
+	for _, code := range codes {
+		if len(code) != 2 {
+			return false
+		}
+	}
+	return true
+}
+
+func and(left, right predicate) predicate {
+	return func(pxy *proxy.Proxy) bool { return left(pxy) && right(pxy) }
+}
+
+func or(left, right predicate) predicate {
+	return func(pxy *proxy.Proxy) bool { return left(pxy) || right(pxy) }
+}
+
+// none matches nothing, e.g. the comparisons beyond the range of int64.
+func none(pxy *proxy.Proxy) bool {
+	return false
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type tokenKind uint8
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type lexer struct {
+	src []rune
+	pos int
+}
+
+func newQueryLexer(src string) *lexer {
+	return &lexer{src: []rune(src)}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-:/+", r)
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(l.src[l.pos]) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+	r := l.src[l.pos]
+	switch {
+	case r == '(':
+		l.pos++
+		return token{tokLParen, "(", start}, nil
+	case r == ')':
+		l.pos++
+		return token{tokRParen, ")", start}, nil
+	case r == ',':
+		l.pos++
+		return token{tokComma, ",", start}, nil
+	case r == '"' || r == '\'':
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != r {
+			l.pos++
+		}
+		if l.pos >= len(l.src) {
+			return token{}, fmt.Errorf("query: unterminated string at position %d", start)
+		}
+		l.pos++
+		return token{tokString, string(l.src[start+1 : l.pos-1]), start}, nil
+	case strings.ContainsRune("=!<>~", r):
+		l.pos++
+		if l.pos < len(l.src) && l.src[l.pos] == '=' && r != '=' && r != '~' {
+			l.pos++
+		}
+		op := string(l.src[start:l.pos])
+		if op == "!" {
+			return token{}, fmt.Errorf("query: unexpected ! at position %d", start)
+		}
+		return token{tokOp, op, start}, nil
+	case isWordRune(r):
+		for l.pos < len(l.src) && isWordRune(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{tokWord, string(l.src[start:l.pos]), start}, nil
+	default:
+		return token{}, fmt.Errorf("query: unexpected %q at position %d", r, start)
+	}
+}
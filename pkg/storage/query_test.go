@@ -0,0 +1,80 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuery(t *testing.T) {
+	pxy := &proxy.Proxy{
+		IP:        net.ParseIP("1.1.1.1"),
+		Score:     85,
+		Anon:      proxy.Elite,
+		Caps:      proxy.CapHTTPS,
+		Latency:   500,
+		GeoInfo:   &proxy.GeoInfo{CountryCode: "HK", City: "Hong Kong", ISP: "PCCW", ASN: "AS3491 PCCW Global"},
+		CheckedAt: time.Now().Add(-time.Minute),
+	}
+	tests := []struct {
+		expr    string
+		want    bool
+		wantErr bool
+	}{
+		{expr: "", want: true},
+		{expr: "score >= 80 and anon = elite and country in (CN, HK) and latency < 800", want: true},
+		{expr: "score > 85", want: false},
+		{expr: "score >= 90 or country = hk", want: true},
+		{expr: "not (score >= 90) and anon >= anonymous", want: true},
+		{expr: "city = 'hong kong' and isp ~ pcc", want: true},
+		{expr: "asn = 3491 and protocol = http", want: true},
+		{expr: "cap = https and cap != post", want: true},
+		{expr: "checked_age < 10m and created_age > 1h", want: true},
+		{expr: "speed > 0", want: false},
+		{expr: "latency > 9223372036854775807", want: false},
+		{expr: "latency < -9223372036854775808", want: false},
+		{expr: "not (latency > 9223372036854775807)", want: true},
+		{expr: "unknown = 1", wantErr: true},
+		{expr: "score >= high", wantErr: true},
+		{expr: "score >= 80 and", wantErr: true},
+		{expr: "country in (CN, HK", wantErr: true},
+		{expr: "cap > https", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			q, err := ParseQuery(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				assert.Equal(t, tt.want, q.Match(pxy))
+				assert.Equal(t, tt.want, len(q.Filter()([]*proxy.Proxy{pxy})) == 1)
+			}
+		})
+	}
+}
+
+func TestQueryConditions(t *testing.T) {
+	assert := assert.New(t)
+	q := MustParseQuery("score > 80 and country in (cn, HK) and anon >= anonymous and latency < 800")
+	assert.Equal([]Condition{
+		{Index: IndexScore, Min: 81, Max: 100},
+		{Index: IndexCountry, Values: []string{"CN", "HK"}},
+		{Index: IndexAnonymity, Min: 2, Max: 3},
+	}, q.Conditions())
+	// conditions are dropped with or
+	assert.Empty(MustParseQuery("score > 80 or country = CN").Conditions())
+	// nothing matched beyond the range of int64
+	assert.Empty(MustParseQuery("score > 9223372036854775807").Conditions())
+	opts := SelectOptions{}
+	WithQuery(q)(&opts)
+	assert.Len(opts.Filters, 1)
+	assert.Len(opts.Conditions, 3)
+}
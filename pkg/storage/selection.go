@@ -6,8 +6,13 @@ package storage
 
 type SelectOptions struct {
 	Filters []Filter
-	Limit   int
-	Offset  int
+	// Conditions are the indexable parts of Filters, backends which maintain
+	// secondary indexes use them to narrow the candidates before filtering.
+	Conditions []Condition
+	OrderBy    OrderBy
+	Cursor     string
+	Limit      int
+	Offset     int
 }
 
 type SelectOption func(*SelectOptions)
@@ -19,6 +24,18 @@ func WithFilter(fn ...Filter) SelectOption {
 	}
 }
 
+// WithCondition adds indexable conditions used during the Select call,
+// each condition is also added as a filter, so the result is the same
+// whether the backend has the index or not.
+func WithCondition(conds ...Condition) SelectOption {
+	return func(options *SelectOptions) {
+		for _, cond := range conds {
+			options.Conditions = append(options.Conditions, cond)
+			options.Filters = append(options.Filters, cond.Filter())
+		}
+	}
+}
+
 // WithLimit sets the limit number of proxies returned
 func WithLimit(limit int) SelectOption {
 	return func(options *SelectOptions) {
@@ -0,0 +1,76 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package submit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client submits the proxies by the HTTP API, see `POST /proxies` of api.Server.
+type Client struct {
+	addr  string
+	token string
+	hc    *http.Client
+}
+
+// Token authenticates the client by the token of API server,
+// whose submissions are trusted, see Submitter.SubmitTrusted.
+func Token(token string) func(*Client) {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// NewClient returns a client of the API server listening on addr,
+// e.g. `127.0.0.1:8082` or `http://proxies.local`.
+func NewClient(addr string, options ...func(*Client)) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	c := &Client{
+		addr: strings.TrimSuffix(addr, "/"),
+		hc:   &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, opt := range options {
+		opt(c)
+	}
+	return c
+}
+
+// Submit submits the proxies, and returns the results of them.
+func (c *Client) Submit(subs ...Submission) ([]Result, error) {
+	body, err := json.Marshal(subs)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.addr+"/proxies", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("submit: %s, %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var results []Result
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
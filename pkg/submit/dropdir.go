@@ -0,0 +1,123 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package submit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Suffixes appended to the files of drop-in directory after submitted.
+const (
+	SuffixDone   = ".done"
+	SuffixFailed = ".failed"
+)
+
+// DropDir submits the proxies in the files dropped into a directory:
+// `.txt` of a proxy per line, see ParseText, and `.json` or `.jsonl`
+// of submissions, see ParseJSON. The name of file without extension is
+// the source of proxies which don't specify one, e.g. `vendor.txt` is of
+// `vendor`. The files are renamed with SuffixDone after submitted, or
+// with SuffixFailed if failed to parse. Hidden files are ignored, so
+// write to `.name.txt` and rename it to drop a file atomically.
+type DropDir struct {
+	dir     string
+	s       *Submitter
+	trusted bool
+}
+
+// TrustFiles submits the proxies dropped as trusted, see Submitter.SubmitTrusted,
+// only if the directory is writable by the trusted only.
+func TrustFiles() func(*DropDir) {
+	return func(d *DropDir) {
+		d.trusted = true
+	}
+}
+
+// NewDropDir returns a drop-in directory of dir, which submits the proxies by s.
+func NewDropDir(dir string, s *Submitter, options ...func(*DropDir)) *DropDir {
+	d := &DropDir{dir: dir, s: s}
+	for _, opt := range options {
+		opt(d)
+	}
+	return d
+}
+
+// Scan submits the proxies in the files dropped since the last scan,
+// and calls fn with the results of each file, or the error if failed.
+func (d *DropDir) Scan(fn func(file string, results []Result, err error)) error {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch filepath.Ext(name) {
+		case ".txt", ".json", ".jsonl":
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		results, err := d.submitFile(name)
+		suffix := SuffixDone
+		if err != nil {
+			suffix = SuffixFailed
+		}
+		path := filepath.Join(d.dir, name)
+		if renameErr := os.Rename(path, path+suffix); err == nil {
+			err = renameErr
+		}
+		fn(path, results, err)
+	}
+	return nil
+}
+
+func (d *DropDir) submitFile(name string) ([]Result, error) {
+	data, err := os.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var subs []Submission
+	if ext := filepath.Ext(name); ext == ".txt" {
+		subs = ParseText(data)
+	} else if subs, err = ParseJSON(data); err != nil {
+		return nil, err
+	}
+	source := strings.TrimSuffix(name, filepath.Ext(name))
+	for i := range subs {
+		if subs[i].Source == "" {
+			subs[i].Source = source
+		}
+	}
+	if d.trusted {
+		return d.s.SubmitTrusted(subs...), nil
+	}
+	return d.s.Submit(subs...), nil
+}
+
+// Run scans the directory every period until ctx is done, see Scan.
+func (d *DropDir) Run(ctx context.Context, period time.Duration, fn func(file string, results []Result, err error)) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.Scan(fn); err != nil {
+				fn(d.dir, nil, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
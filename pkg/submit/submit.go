@@ -0,0 +1,257 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+// Package submit pushes the proxies found by other than spiders, e.g. paid
+// ones or those tested by users, into the pool. The proxies submitted go
+// through the same dedupe and checking as the crawled ones.
+package submit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+)
+
+// Statuses of the proxies submitted.
+const (
+	// StatusAccepted means the proxy is sent to be checked.
+	StatusAccepted = "accepted"
+	// StatusDuplicate means the proxy has been sent before.
+	StatusDuplicate = "duplicate"
+	// StatusInvalid means the submission is not a valid proxy.
+	StatusInvalid = "invalid"
+	// StatusBusy means the trusted proxy is dropped since the checks queued are full.
+	StatusBusy = "busy"
+)
+
+// Submission is a proxy submitted, given by URL, or IP and Port.
+type Submission struct {
+	URL      string            `json:"url,omitempty"` // [protocol://][username:password@]ip:port
+	IP       string            `json:"ip,omitempty"`
+	Port     uint32            `json:"port,omitempty"`
+	Protocol string            `json:"protocol,omitempty"` // http if empty
+	Username string            `json:"username,omitempty"`
+	Password string            `json:"password,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Source   string            `json:"source,omitempty"` // the default source of submitter if empty
+}
+
+// String returns the URL of submission, or the `ip:port` if no URL.
+func (sub *Submission) String() string {
+	if sub.URL != "" {
+		return sub.URL
+	}
+	return fmt.Sprintf("%s:%d", sub.IP, sub.Port)
+}
+
+// Proxy returns the proxy submitted, whose source is defaultSource
+// if the submission doesn't specify one.
+func (sub *Submission) Proxy(defaultSource string) (*proxy.Proxy, error) {
+	var pxy *proxy.Proxy
+	var err error
+	if sub.URL != "" {
+		pxy, err = proxy.ParseURL(sub.URL)
+	} else {
+		pxy, err = proxy.NewProxy(sub.IP, strconv.FormatUint(uint64(sub.Port), 10))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pxy.Port == 0 {
+		return nil, fmt.Errorf("invalid port of %s", sub)
+	}
+	if sub.Protocol != "" {
+		protocol := proxy.ParseProtocol(sub.Protocol)
+		if protocol == "" {
+			return nil, fmt.Errorf("unknown protocol %q", sub.Protocol)
+		}
+		if pxy.Protocol != "" && pxy.Protocol != protocol {
+			return nil, fmt.Errorf("protocol %s conflicts with %s of url", protocol, pxy.Protocol)
+		}
+		pxy.Protocol = protocol
+	}
+	if sub.Username != "" || sub.Password != "" {
+		pxy.Username, pxy.Password = sub.Username, sub.Password
+	}
+	if len(sub.Labels) > 0 {
+		pxy.Labels = make(map[string]string, len(sub.Labels))
+		for k, v := range sub.Labels {
+			pxy.Labels[k] = v
+		}
+	}
+	pxy.Source = sub.Source
+	if pxy.Source == "" {
+		pxy.Source = defaultSource
+	}
+	return pxy, nil
+}
+
+// Result is the result of a submission.
+type Result struct {
+	Proxy  string `json:"proxy"` // `protocol://ip:port` of the proxy, or the submission if invalid
+	Source string `json:"source,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Submitter sends the proxies submitted to the CachedChan, which are then checked
+// like the crawled ones. The proxies submitted by trusted entry points, e.g. the API
+// with token, skip the dedupe of chan, and are checked at once, e.g. to re-check a
+// paid proxy after it's renewed. Trust is decided by the entry point, never by the
+// submission, see SubmitTrusted.
+type Submitter struct {
+	ch            proxy.CachedChan
+	check         func(pxy *proxy.Proxy)
+	queue         chan *proxy.Proxy // trusted proxies to check, nil if trusting none
+	workers       int
+	defaultSource string
+}
+
+// DefaultSource sets the source of submissions which don't specify one, `manual` by default.
+func DefaultSource(source string) func(*Submitter) {
+	return func(s *Submitter) {
+		s.defaultSource = source
+	}
+}
+
+// Trust checks the trusted proxies by check, by at most workers at a time,
+// and queues up to queue of them, the others are dropped as StatusBusy.
+// The workers run by Run.
+func Trust(check func(pxy *proxy.Proxy), workers, queue int) func(*Submitter) {
+	return func(s *Submitter) {
+		s.check = check
+		s.workers = workers
+		s.queue = make(chan *proxy.Proxy, queue)
+	}
+}
+
+// NewSubmitter returns a submitter sending the proxies to ch.
+func NewSubmitter(ch proxy.CachedChan, options ...func(*Submitter)) *Submitter {
+	s := &Submitter{
+		ch:            ch,
+		defaultSource: "manual",
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	return s
+}
+
+// Submit sends the proxies submitted, and returns the results in the same order.
+func (s *Submitter) Submit(subs ...Submission) []Result {
+	return s.submitAll(false, subs)
+}
+
+// SubmitTrusted submits the proxies by a trusted entry point, which skip the
+// dedupe and are queued to check, see Trust. They are submitted like Submit
+// if trusting none.
+func (s *Submitter) SubmitTrusted(subs ...Submission) []Result {
+	return s.submitAll(s.queue != nil, subs)
+}
+
+func (s *Submitter) submitAll(trusted bool, subs []Submission) []Result {
+	results := make([]Result, 0, len(subs))
+	for i := range subs {
+		results = append(results, s.submit(&subs[i], trusted))
+	}
+	return results
+}
+
+func (s *Submitter) submit(sub *Submission, trusted bool) Result {
+	pxy, err := sub.Proxy(s.defaultSource)
+	if err != nil {
+		return Result{Proxy: sub.String(), Source: sub.Source, Status: StatusInvalid, Error: err.Error()}
+	}
+	protocol := pxy.Protocol
+	if protocol == "" {
+		protocol = proxy.HTTP
+	}
+	result := Result{Proxy: fmt.Sprintf("%s://%s:%d", protocol, pxy.IP, pxy.Port), Source: pxy.Source, Status: StatusAccepted}
+	if trusted {
+		select {
+		case s.queue <- pxy:
+		default:
+			result.Status = StatusBusy
+		}
+	} else if !s.ch.SendProxy(pxy) {
+		result.Status = StatusDuplicate
+	}
+	return result
+}
+
+// Run checks the trusted proxies queued until ctx is done,
+// and returns after the checks in flight finish.
+func (s *Submitter) Run(ctx context.Context) {
+	if s.queue == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case pxy := <-s.queue:
+					s.check(pxy)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// ParseText parses the proxies one per line, in the form of Submission.URL.
+// The blank lines and comments starting with `#` are skipped.
+func ParseText(data []byte) []Submission {
+	var subs []Submission
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		subs = append(subs, Submission{URL: line})
+	}
+	return subs
+}
+
+// ParseJSON parses the submissions in JSON, which is an object, an array
+// of objects, or a stream of them, e.g. JSON lines.
+func ParseJSON(data []byte) ([]Submission, error) {
+	var subs []Submission
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '[' {
+			var batch []Submission
+			if err := json.Unmarshal(raw, &batch); err != nil {
+				return nil, err
+			}
+			subs = append(subs, batch...)
+			continue
+		}
+		var sub Submission
+		if err := json.Unmarshal(raw, &sub); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
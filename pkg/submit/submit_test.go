@@ -0,0 +1,152 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package submit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubmission_Proxy(t *testing.T) {
+	sub := Submission{IP: "1.2.3.4", Port: 1080, Protocol: "SOCKS5", Username: "u", Password: "p",
+		Labels: map[string]string{"vendor": "v"}}
+	pxy, err := sub.Proxy("manual")
+	if assert.Nil(t, err) {
+		assert.Equal(t, proxy.SOCKS5, pxy.Protocol)
+		assert.Equal(t, "socks5://u:p@1.2.3.4:1080", pxy.URL())
+		assert.Equal(t, "manual", pxy.Source)
+		assert.Equal(t, "v", pxy.Labels["vendor"])
+	}
+	pxy, err = (&Submission{URL: "https://1.2.3.4:443", Protocol: "https", Source: "vendor"}).Proxy("manual")
+	if assert.Nil(t, err) {
+		assert.Equal(t, proxy.HTTPS, pxy.Protocol)
+		assert.Equal(t, "vendor", pxy.Source)
+	}
+	for _, sub := range []Submission{
+		{URL: "https://1.2.3.4:443", Protocol: "socks5"},
+		{IP: "1.2.3.4", Port: 80, Protocol: "ftp"},
+		{IP: "1.2.3.4"},
+		{URL: "localhost:80"},
+	} {
+		_, err := sub.Proxy("manual")
+		assert.NotNil(t, err, sub.String())
+	}
+}
+
+func TestSubmitter(t *testing.T) {
+	ch := proxy.NewBloomCachedChan()
+	checked := make(chan *proxy.Proxy)
+	s := NewSubmitter(ch, DefaultSource("cli"), Trust(func(pxy *proxy.Proxy) {
+		checked <- pxy
+	}, 1, 1))
+
+	results := s.Submit(
+		Submission{URL: "1.2.3.4:80"},
+		Submission{URL: "http://1.2.3.4:80"},
+		Submission{URL: "not a proxy"},
+		Submission{URL: "5.6.7.8:80", Source: "vendor"}, // trust is not up to the submission
+	)
+	assert.Equal(t, []Result{
+		{Proxy: "http://1.2.3.4:80", Source: "cli", Status: StatusAccepted},
+		{Proxy: "http://1.2.3.4:80", Source: "cli", Status: StatusDuplicate},
+		{Proxy: "not a proxy", Status: StatusInvalid, Error: results[2].Error},
+		{Proxy: "http://5.6.7.8:80", Source: "vendor", Status: StatusAccepted},
+	}, results)
+	assert.NotEmpty(t, results[2].Error)
+	assert.Equal(t, "cli", (<-ch.Recv()).Source)
+	assert.Equal(t, "vendor", (<-ch.Recv()).Source)
+
+	// skips the dedupe, and queues up to 1 before the worker runs
+	results = s.SubmitTrusted(
+		Submission{URL: "5.6.7.8:80", Source: "vendor"},
+		Submission{URL: "5.6.7.8:80", Source: "vendor"},
+	)
+	assert.Equal(t, StatusAccepted, results[0].Status)
+	assert.Equal(t, StatusBusy, results[1].Status)
+	assert.Len(t, ch.Recv(), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	assert.Equal(t, "vendor", (<-checked).Source)
+	cancel()
+	<-done
+
+	// trusts none
+	s = NewSubmitter(ch)
+	assert.Equal(t, StatusDuplicate, s.SubmitTrusted(Submission{URL: "5.6.7.8:80"})[0].Status)
+	s.Run(ctx)
+}
+
+func TestParse(t *testing.T) {
+	subs := ParseText([]byte("# paid\n1.2.3.4:80\n\n  socks5://5.6.7.8:1080  \n"))
+	assert.Equal(t, []Submission{{URL: "1.2.3.4:80"}, {URL: "socks5://5.6.7.8:1080"}}, subs)
+
+	subs, err := ParseJSON([]byte(`{"url": "1.2.3.4:80"}
+[{"ip": "5.6.7.8", "port": 1080, "protocol": "socks5", "labels": {"plan": "pro"}}]
+{"url": "9.9.9.9:80", "source": "vendor"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []Submission{
+		{URL: "1.2.3.4:80"},
+		{IP: "5.6.7.8", Port: 1080, Protocol: "socks5", Labels: map[string]string{"plan": "pro"}},
+		{URL: "9.9.9.9:80", Source: "vendor"},
+	}, subs)
+	_, err = ParseJSON([]byte(`{"url": "1.2.3.4:80"`))
+	assert.NotNil(t, err)
+	_, err = ParseJSON([]byte(`"1.2.3.4:80"`))
+	assert.NotNil(t, err)
+}
+
+func TestDropDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"vendor.txt":    "1.2.3.4:80\n",
+		"batch.jsonl":   `{"url": "5.6.7.8:80", "source": "other"}` + "\n" + `{"url": "9.9.9.9:80"}`,
+		"broken.json":   `[{"url": `,
+		".writing.txt":  "1.1.1.1:80\n",
+		"ignored.csv":   "2.2.2.2,80\n",
+		"old.txt.done":  "3.3.3.3:80\n",
+		"README.md":     "drop the proxies here",
+		"empty.txt":     "",
+		"comments.json": "",
+	}
+	for name, data := range files {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644))
+	}
+	ch := proxy.NewBloomCachedChan()
+	d := NewDropDir(dir, NewSubmitter(ch))
+	scanned := make(map[string][]Result)
+	failed := make(map[string]bool)
+	assert.Nil(t, d.Scan(func(file string, results []Result, err error) {
+		scanned[filepath.Base(file)] = results
+		failed[filepath.Base(file)] = err != nil
+	}))
+	assert.Len(t, scanned, 5)
+	assert.True(t, failed["broken.json"])
+	assert.Equal(t, []Result{{Proxy: "http://1.2.3.4:80", Source: "vendor", Status: StatusAccepted}}, scanned["vendor.txt"])
+	assert.Equal(t, []Result{
+		{Proxy: "http://5.6.7.8:80", Source: "other", Status: StatusAccepted},
+		{Proxy: "http://9.9.9.9:80", Source: "batch", Status: StatusAccepted},
+	}, scanned["batch.jsonl"])
+	assert.Len(t, ch.Recv(), 3)
+	for _, name := range []string{"vendor.txt.done", "batch.jsonl.done", "broken.json.failed", ".writing.txt", "ignored.csv"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.Nil(t, err, name)
+	}
+
+	scanned = make(map[string][]Result)
+	assert.Nil(t, d.Scan(func(file string, results []Result, err error) {
+		scanned[filepath.Base(file)] = results
+	}))
+	assert.Empty(t, scanned)
+	assert.NotNil(t, NewDropDir(filepath.Join(dir, "missing"), nil).Scan(nil))
+}
@@ -0,0 +1,369 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+// Package webhook delivers the events published on the bus to the
+// configured HTTP endpoints as signed JSON POSTs.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/config"
+	"github.com/Leosocy/IntelliProxy/pkg/checker"
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
+	"github.com/Leosocy/IntelliProxy/pkg/storage"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+)
+
+// Headers of the webhook requests.
+const (
+	// HeaderSignature is `sha256=<hex>`, the HMAC-SHA256 of body with the endpoint secret.
+	HeaderSignature = "X-IntelliProxy-Signature"
+	HeaderTopic     = "X-IntelliProxy-Topic"
+	HeaderDelivery  = "X-IntelliProxy-Delivery"
+)
+
+// Endpoint is a URL which the selected events are posted to.
+type Endpoint struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	// Topics are the patterns of topics delivered, e.g. backend.insert or spider.**,
+	// empty means all topics.
+	Topics []string `json:"topics"`
+	// Query filters the events related to a proxy, e.g. backend events and
+	// checker results, by the storage query language, e.g. `anon = elite`.
+	// Events not related to a proxy are not filtered.
+	Query string `json:"query"`
+
+	query *storage.Query
+	queue chan *Event
+}
+
+// Event is the JSON body posted to endpoints.
+type Event struct {
+	ID    string      `json:"id"`
+	Topic string      `json:"topic"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// ProxyChange is the data of the backend events.
+type ProxyChange struct {
+	Op     string         `json:"op"`
+	Proxy  *proxy.Proxy   `json:"proxy"`
+	Old    *proxy.Proxy   `json:"old,omitempty"`
+	Reason backend.Reason `json:"reason,omitempty"`
+	Source backend.Source `json:"source,omitempty"`
+}
+
+// ScoreChange is the data of the checker results.
+type ScoreChange struct {
+	Proxy  *proxy.Proxy `json:"proxy"`
+	Before int8         `json:"before"`
+	After  int8         `json:"after"`
+}
+
+// dataOf returns the data of event of the payload, the payloads with
+// untagged fields are converted to the types above, so that the JSON
+// doesn't change with the names of Go fields.
+func dataOf(payload interface{}) interface{} {
+	switch v := payload.(type) {
+	case *backend.Event:
+		return &ProxyChange{Op: v.Op.String(), Proxy: v.Pxy, Old: v.Old, Reason: v.Reason, Source: v.Source}
+	case *checker.Result:
+		return &ScoreChange{Proxy: v.Pxy, Before: v.Before, After: v.After}
+	default:
+		return payload
+	}
+}
+
+// deadLetter is a line of the dead-letter file.
+type deadLetter struct {
+	URL   string    `json:"url"`
+	Event *Event    `json:"event"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// Sink is a pubsub.Watcher which receives *pubsub.Message, and posts the
+// events selected by each endpoint to it. Every endpoint has its own queue
+// and delivery goroutine, a failed delivery is retried with exponential
+// backoff, and written to the dead-letter file if it still fails.
+type Sink struct {
+	endpoints  []*Endpoint
+	client     *http.Client
+	retries    int
+	backoff    time.Duration
+	deadLetter string
+	dlMu       sync.Mutex
+	seq        uint64
+	wg         sync.WaitGroup
+	mu         sync.RWMutex // guards closed and sending to the queues
+	closed     bool
+}
+
+// Option configures the Sink.
+type Option func(s *Sink)
+
+// WithRetries sets the max times of retry after the first delivery failed, default is 3.
+func WithRetries(n int) Option {
+	return func(s *Sink) {
+		s.retries = n
+	}
+}
+
+// WithBackoff sets the wait time before the first retry, which doubles for each retry, default is 1s.
+func WithBackoff(d time.Duration) Option {
+	return func(s *Sink) {
+		s.backoff = d
+	}
+}
+
+// WithTimeout sets the timeout of each request, default is 10s.
+func WithTimeout(d time.Duration) Option {
+	return func(s *Sink) {
+		s.client.Timeout = d
+	}
+}
+
+// WithDeadLetter sets the file which the undeliverable events are appended to as JSON lines,
+// empty means they are discarded.
+func WithDeadLetter(path string) Option {
+	return func(s *Sink) {
+		s.deadLetter = path
+	}
+}
+
+// NewSink returns a sink delivering to the endpoints,
+// it fails if the query of any endpoint can't be parsed.
+func NewSink(endpoints []Endpoint, opts ...Option) (*Sink, error) {
+	s := &Sink{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		retries: 3,
+		backoff: time.Second,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	for i := range endpoints {
+		ep := endpoints[i]
+		q, err := storage.ParseQuery(ep.Query)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %v", ep.URL, err)
+		}
+		ep.query = q
+		ep.queue = make(chan *Event, 256)
+		s.endpoints = append(s.endpoints, &ep)
+	}
+	for _, ep := range s.endpoints {
+		s.wg.Add(1)
+		go s.loop(ep)
+	}
+	return s, nil
+}
+
+// NewSinkFromConfig returns a sink configured by `webhook.*`, e.g.
+//
+//	webhook:
+//	  endpoints:
+//	    - url: https://ops.example.com/hooks/proxy
+//	      secret: s3cret
+//	      topics: [backend.insert]
+//	      query: anon = elite
+//	  dead_letter: webhook-dead-letter.jsonl
+//
+// It returns nil if no endpoint configured.
+func NewSinkFromConfig(cfg config.Provider) (*Sink, error) {
+	var endpoints []Endpoint
+	if raw := cfg.Get("webhook.endpoints"); raw != nil {
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &endpoints); err != nil {
+			return nil, fmt.Errorf("invalid webhook.endpoints, %v", err)
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, nil
+	}
+	return NewSink(endpoints,
+		WithRetries(cfg.GetInt("webhook.retries")),
+		WithBackoff(cfg.GetDuration("webhook.backoff")),
+		WithTimeout(cfg.GetDuration("webhook.timeout")),
+		WithDeadLetter(cfg.GetString("webhook.dead_letter")))
+}
+
+// Subscribe subscribes the sink to all topics of bus.
+func (s *Sink) Subscribe(bus *pubsub.Bus) *pubsub.Subscription {
+	return bus.Subscribe("**", func(msg *pubsub.Message) {
+		s.Receipt(msg)
+	})
+}
+
+// Receipt implements pubsub.Watcher interface, obj must be *pubsub.Message.
+// It never blocks, the event is written to dead-letter file if the queue of endpoint is full,
+// and dropped if the sink is closed.
+func (s *Sink) Receipt(obj interface{}) {
+	msg, ok := obj.(*pubsub.Message)
+	if !ok {
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	var e *Event
+	for _, ep := range s.endpoints {
+		if !ep.selects(msg) {
+			continue
+		}
+		if e == nil {
+			e = &Event{
+				ID:    fmt.Sprintf("%d-%d", msg.Time.UnixNano(), atomic.AddUint64(&s.seq, 1)),
+				Topic: msg.Topic,
+				Time:  msg.Time,
+				Data:  dataOf(msg.Payload),
+			}
+		}
+		select {
+		case ep.queue <- e:
+		default:
+			s.bury(ep, e, fmt.Errorf("queue is full"))
+		}
+	}
+}
+
+// Close waits for the queued events delivered, the events received after Close are dropped.
+func (s *Sink) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		for _, ep := range s.endpoints {
+			close(ep.queue)
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Sink) loop(ep *Endpoint) {
+	defer s.wg.Done()
+	for e := range ep.queue {
+		body, err := json.Marshal(e)
+		if err == nil {
+			err = s.deliver(ep, e, body)
+		}
+		if err != nil {
+			s.bury(ep, e, err)
+		}
+	}
+}
+
+// deliver posts the body, and retries with backoff on network errors,
+// 429 and 5xx responses.
+func (s *Sink) deliver(ep *Endpoint, e *Event, body []byte) (err error) {
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		if retryable, err = s.post(ep, e, body); err == nil || !retryable || attempt >= s.retries {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *Sink) post(ep *Endpoint, e *Event, body []byte) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderTopic, e.Topic)
+	req.Header.Set(HeaderDelivery, e.ID)
+	req.Header.Set(HeaderSignature, Sign(ep.Secret, body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// bury appends the undeliverable event to the dead-letter file.
+func (s *Sink) bury(ep *Endpoint, e *Event, cause error) {
+	if s.deadLetter == "" {
+		return
+	}
+	line, err := json.Marshal(&deadLetter{URL: ep.URL, Event: e, Error: cause.Error(), Time: time.Now()})
+	if err != nil {
+		return
+	}
+	s.dlMu.Lock()
+	defer s.dlMu.Unlock()
+	f, err := os.OpenFile(s.deadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+// Sign returns the value of HeaderSignature of body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// selects reports whether the message should be delivered to the endpoint.
+func (ep *Endpoint) selects(msg *pubsub.Message) bool {
+	if len(ep.Topics) > 0 && !matchAny(ep.Topics, msg.Topic) {
+		return false
+	}
+	if pxy := proxyOf(msg.Payload); pxy != nil {
+		return ep.query.Match(pxy)
+	}
+	return true
+}
+
+func matchAny(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if pubsub.MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyOf returns the proxy related to the payload, nil if none.
+func proxyOf(payload interface{}) *proxy.Proxy {
+	switch v := payload.(type) {
+	case *proxy.Proxy:
+		return v
+	case *backend.Event:
+		return v.Pxy
+	case *checker.Result:
+		return v.Pxy
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+type receiver struct {
+	mu     sync.Mutex
+	events []*Event
+	bodies []string
+	fails  int32 // respond 503 for the first fails requests
+	secret string
+	t      *testing.T
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	assert.Equal(r.t, Sign(r.secret, body), req.Header.Get(HeaderSignature))
+	if atomic.AddInt32(&r.fails, -1) >= 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	e := &Event{}
+	assert.Nil(r.t, json.Unmarshal(body, e))
+	assert.Equal(r.t, e.Topic, req.Header.Get(HeaderTopic))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	r.bodies = append(r.bodies, string(body))
+}
+
+func (r *receiver) topics() (topics []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.events {
+		topics = append(topics, e.Topic)
+	}
+	return
+}
+
+func TestSinkDelivery(t *testing.T) {
+	elite, spiders := &receiver{secret: "elite", fails: 2, t: t}, &receiver{secret: "spider", t: t}
+	ts1, ts2 := httptest.NewServer(elite), httptest.NewServer(spiders)
+	defer ts1.Close()
+	defer ts2.Close()
+	sink, err := NewSink([]Endpoint{
+		{URL: ts1.URL, Secret: "elite", Topics: []string{"backend.insert"}, Query: "anon = elite"},
+		{URL: ts2.URL, Secret: "spider", Topics: []string{"spider.*.crawl.failing"}},
+	}, WithBackoff(time.Millisecond))
+	assert.Nil(t, err)
+
+	bus := pubsub.NewBus()
+	sink.Subscribe(bus)
+	pxy, _ := proxy.NewProxy("1.2.3.4", "80")
+	bus.Publish("backend.insert", &backend.Event{Op: backend.Insert, Pxy: pxy})
+	pxy, _ = proxy.NewProxy("5.6.7.8", "80")
+	pxy.Anon = proxy.Elite
+	pxy.Username, pxy.Password = "user", "secret"
+	bus.Publish("backend.insert", &backend.Event{Op: backend.Insert, Pxy: pxy})
+	bus.Publish("backend.delete", &backend.Event{Op: backend.Delete, Pxy: pxy})
+	bus.Publish("spider.xici.crawl.done", nil)
+	bus.Publish("spider.xici.crawl.failing", nil)
+	bus.Flush()
+	sink.Close()
+
+	// delivered after retried twice
+	assert.Equal(t, []string{"backend.insert"}, elite.topics())
+	data := elite.events[0].Data.(map[string]interface{})
+	assert.Equal(t, "insert", data["op"])
+	assert.Equal(t, "5.6.7.8", data["proxy"].(map[string]interface{})["ip"])
+	assert.Equal(t, []string{"spider.xici.crawl.failing"}, spiders.topics())
+	assert.NotContains(t, elite.bodies[0], "secret")
+}
+
+func TestSinkDeadLetter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	sink, err := NewSink([]Endpoint{{URL: ts.URL}},
+		WithRetries(2), WithBackoff(time.Millisecond), WithDeadLetter(path))
+	assert.Nil(t, err)
+	sink.Receipt(&pubsub.Message{Topic: "scheduler.start", Time: time.Now()})
+	sink.Receipt(&pubsub.Message{Topic: "scheduler.snapshot", Time: time.Now()})
+	sink.Close()
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	var letters []deadLetter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var l deadLetter
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &l))
+		letters = append(letters, l)
+	}
+	assert.Len(t, letters, 2)
+	assert.Equal(t, ts.URL, letters[0].URL)
+	assert.Equal(t, "scheduler.start", letters[0].Event.Topic)
+	assert.Contains(t, letters[0].Error, "503")
+}
+
+func TestSinkReceiptAfterClose(t *testing.T) {
+	var delivered int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&delivered, 1)
+	}))
+	defer ts.Close()
+	sink, err := NewSink([]Endpoint{{URL: ts.URL}})
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sink.Receipt(&pubsub.Message{Topic: "scheduler.snapshot", Time: time.Now()})
+			}
+		}()
+	}
+	// never panics by sending to the closed queues
+	sink.Close()
+	wg.Wait()
+	n := atomic.LoadInt32(&delivered)
+	sink.Receipt(&pubsub.Message{Topic: "scheduler.snapshot", Time: time.Now()})
+	sink.Close()
+	assert.Equal(t, n, atomic.LoadInt32(&delivered))
+}
+
+func TestNewSinkFromConfig(t *testing.T) {
+	v := viper.New()
+	sink, err := NewSinkFromConfig(v)
+	assert.Nil(t, err)
+	assert.Nil(t, sink)
+
+	v.Set("webhook.endpoints", []interface{}{
+		map[string]interface{}{"url": "http://localhost/hook", "topics": []string{"backend.*"}, "query": "score >="},
+	})
+	_, err = NewSinkFromConfig(v)
+	assert.NotNil(t, err)
+
+	v.Set("webhook.endpoints", []interface{}{
+		map[string]interface{}{"url": "http://localhost/hook", "secret": "s", "query": "score >= 90"},
+	})
+	sink, err = NewSinkFromConfig(v)
+	assert.Nil(t, err)
+	assert.Len(t, sink.endpoints, 1)
+	assert.Equal(t, "s", sink.endpoints[0].Secret)
+	sink.Close()
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+// Package api provides the HTTP API of the proxy pool.
+package api
+
+import (
+	"net/http"
+
+	"github.com/Leosocy/IntelliProxy/pkg/spider"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+	"github.com/Leosocy/IntelliProxy/pkg/submit"
+)
+
+// Server is the HTTP API server.
+//
+//	GET /events    streams the changes of proxies, see Hub.ServeHTTP.
+//	GET /spiders   returns the statistics of spiders as JSON.
+//	GET /sources   returns the quality reports of sources as JSON.
+//	GET /metrics   returns the metrics in Prometheus text format.
+//	POST /proxies  submits proxies, see Server.serveSubmit.
+type Server struct {
+	*http.ServeMux
+	nb          backend.NotifyBackend
+	hub         *Hub
+	spiderStats func() []spider.Stats
+	submitter   *submit.Submitter
+	submitToken string // bearer token of trusted submissions, empty if trusting none
+}
+
+// Option configures the Server.
+type Option func(s *Server)
+
+// WithSpiderStats serves the statistics of spiders returned by fn.
+func WithSpiderStats(fn func() []spider.Stats) Option {
+	return func(s *Server) {
+		s.spiderStats = fn
+	}
+}
+
+// WithSubmitter accepts the proxies submitted by s.
+func WithSubmitter(s *submit.Submitter) Option {
+	return func(srv *Server) {
+		srv.submitter = s
+	}
+}
+
+// WithSubmitToken trusts the submissions authorized by the bearer token,
+// see submit.Submitter.SubmitTrusted.
+func WithSubmitToken(token string) Option {
+	return func(srv *Server) {
+		srv.submitToken = token
+	}
+}
+
+// NewServer returns an API server serving the proxies in nb.
+func NewServer(nb backend.NotifyBackend, opts ...Option) *Server {
+	s := &Server{
+		ServeMux: http.NewServeMux(),
+		nb:       nb,
+		hub:      NewHub(nb, 4096),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	nb.Attach(s.hub)
+	s.Handle("/events", s.hub)
+	s.HandleFunc("/spiders", s.serveSpiders)
+	s.HandleFunc("/sources", s.serveSources)
+	s.HandleFunc("/metrics", s.serveMetrics)
+	s.HandleFunc("/proxies", s.serveSubmit)
+	return s
+}
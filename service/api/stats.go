@@ -0,0 +1,84 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Leosocy/IntelliProxy/pkg/spider"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+)
+
+func (s *Server) stats() []spider.Stats {
+	if s.spiderStats == nil {
+		return []spider.Stats{}
+	}
+	return s.spiderStats()
+}
+
+// serveSpiders returns the statistics of spiders.
+func (s *Server) serveSpiders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stats())
+}
+
+// serveSources returns the quality reports of the sources listing the proxies stored.
+func (s *Server) serveSources(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backend.ReportSources(s.nb))
+}
+
+// spiderMetrics are the metrics of each spider.
+var spiderMetrics = []struct {
+	name, kind, help string
+	value            func(st *spider.Stats) uint64
+}{
+	{"crawls_total", "counter", "Crawls of the spider.", func(st *spider.Stats) uint64 { return st.Crawls }},
+	{"http_errors_total", "counter", "Urls failed to crawl.", func(st *spider.Stats) uint64 { return st.HTTPErrors }},
+	{"rows_total", "counter", "Records parsed.", func(st *spider.Stats) uint64 { return st.Rows }},
+	{"valid_total", "counter", "Valid proxies parsed.", func(st *spider.Stats) uint64 { return st.Valid }},
+	{"new_total", "counter", "Valid proxies not found before.", func(st *spider.Stats) uint64 { return st.New }},
+	{"survived_total", "counter", "New proxies inserted after scoring.", func(st *spider.Stats) uint64 { return st.Survived }},
+	{"enabled", "gauge", "Whether the spider is enabled.", func(st *spider.Stats) uint64 { return boolMetric(st.Enabled) }},
+	{"dead", "gauge", "Whether the spider is dead for finding nothing.", func(st *spider.Stats) uint64 { return boolMetric(st.Dead) }},
+}
+
+func boolMetric(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// serveMetrics returns the metrics in Prometheus text format.
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "intelliproxy_pool_size", "gauge", "Proxies in the pool.")
+	fmt.Fprintf(w, "intelliproxy_pool_size %d\n", s.nb.Len())
+	stats := s.stats()
+	for _, m := range spiderMetrics {
+		name := "intelliproxy_spider_" + m.name
+		writeMetric(w, name, m.kind, m.help)
+		for i := range stats {
+			fmt.Fprintf(w, "%s{spider=%q} %d\n", name, stats[i].Spider, m.value(&stats[i]))
+		}
+	}
+	reports := backend.ReportSources(s.nb)
+	writeMetric(w, "intelliproxy_source_proxies", "gauge", "Proxies in the pool listed by the source.")
+	for _, r := range reports {
+		fmt.Fprintf(w, "intelliproxy_source_proxies{source=%q} %d\n", r.Source, r.Proxies)
+	}
+	writeMetric(w, "intelliproxy_source_mean_score", "gauge", "Mean score of proxies in the pool listed by the source.")
+	for _, r := range reports {
+		fmt.Fprintf(w, "intelliproxy_source_mean_score{source=%q} %g\n", r.Source, r.MeanScore)
+	}
+}
+
+func writeMetric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
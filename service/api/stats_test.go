@@ -0,0 +1,54 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
+	"github.com/Leosocy/IntelliProxy/pkg/spider"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpiderStatsAndMetrics(t *testing.T) {
+	nb := backend.WithNotifier(backend.NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	nb.Insert(&proxy.Proxy{IP: net.ParseIP("1.1.1.1"), Score: 90, Source: "xici"})
+	s := NewServer(nb, WithSpiderStats(func() []spider.Stats {
+		return []spider.Stats{{Spider: "xici", Crawls: 6, Enabled: true, Dead: true}}
+	}))
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/spiders", nil))
+	var stats []spider.Stats
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Len(t, stats, 1)
+	assert.True(t, stats[0].Dead)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	assert.Contains(t, string(body), "intelliproxy_pool_size 1\n")
+	assert.Contains(t, string(body), "# TYPE intelliproxy_spider_crawls_total counter\n")
+	assert.Contains(t, string(body), `intelliproxy_spider_crawls_total{spider="xici"} 6`)
+	assert.Contains(t, string(body), `intelliproxy_spider_dead{spider="xici"} 1`)
+	assert.Contains(t, string(body), `intelliproxy_source_proxies{source="xici"} 1`)
+	assert.Contains(t, string(body), `intelliproxy_source_mean_score{source="xici"} 90`)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/sources", nil))
+	var reports []backend.SourceReport
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &reports))
+	assert.Equal(t, []backend.SourceReport{{Source: "xici", Proxies: 1, Exclusive: 1, Share: 1, MeanScore: 90}}, reports)
+
+	rec = httptest.NewRecorder()
+	NewServer(nb).ServeHTTP(rec, httptest.NewRequest("GET", "/spiders", nil))
+	assert.Equal(t, "[]\n", rec.Body.String())
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/storage"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+)
+
+// Ops of the records in change stream, besides the backend operations.
+const (
+	OpSnapshot = "snapshot" // a proxy in the initial snapshot
+	OpReady    = "ready"    // the snapshot is over, deltas follow
+)
+
+// Record is an item of the change stream.
+type Record struct {
+	// ID is `<epoch>-<seq>`, where seq increases by one for each backend event
+	// and epoch changes when the process restarts. Clients resume with the
+	// ID of the last record received. Snapshot records have no ID.
+	ID     string         `json:"id,omitempty"`
+	Op     string         `json:"op"`
+	Proxy  *proxy.Proxy   `json:"proxy,omitempty"`
+	Reason backend.Reason `json:"reason,omitempty"`
+	Source backend.Source `json:"source,omitempty"`
+
+	seq uint64
+	old *proxy.Proxy
+}
+
+// filter returns the record seen by a client with query q, nil if nothing
+// should be sent. Clients keep a replica of the proxies matching q, so an
+// update makes a proxy no longer matching is sent as a delete.
+func (r *Record) filter(q *storage.Query) *Record {
+	matchOld := r.old != nil && q.Match(r.old)
+	switch r.Op {
+	case backend.Delete.String():
+		if matchOld {
+			return r
+		}
+	default:
+		if q.Match(r.Proxy) {
+			return r
+		}
+		if matchOld {
+			deleted := *r
+			deleted.Op = backend.Delete.String()
+			return &deleted
+		}
+	}
+	return nil
+}
+
+type client struct {
+	ch chan *Record
+	// overflowed is closed when the client is too slow to keep up.
+	overflowed chan struct{}
+}
+
+// Hub is a pubsub.Watcher which records the backend events with IDs,
+// keeps the recent ones for resuming, and fans them out to the streams.
+type Hub struct {
+	b        backend.Backend
+	capacity int
+	epoch    string // of the process, so that the IDs of a previous one aren't resumed
+	mu       sync.Mutex
+	seq      uint64
+	recent   []*Record // at least the latest capacity records, the oldest first
+	clients  map[*client]struct{}
+}
+
+// NewHub returns a hub which takes snapshot from b, and keeps capacity
+// recent records for resuming.
+func NewHub(b backend.Backend, capacity int) *Hub {
+	return &Hub{
+		b:        b,
+		capacity: capacity,
+		epoch:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		clients:  make(map[*client]struct{}),
+	}
+}
+
+// Receipt implements pubsub.Watcher interface.
+func (h *Hub) Receipt(obj interface{}) {
+	e, ok := obj.(*backend.Event)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	rec := &Record{ID: h.eventID(h.seq), seq: h.seq, Op: e.Op.String(), Proxy: e.Pxy, Reason: e.Reason, Source: e.Source, old: e.Old}
+	h.recent = append(h.recent, rec)
+	// trim when doubled, so that the records are copied once per capacity events
+	if len(h.recent) >= 2*h.capacity {
+		h.recent = append(h.recent[:0], h.recent[len(h.recent)-h.capacity:]...)
+	}
+	for c := range h.clients {
+		select {
+		case c.ch <- rec:
+		default:
+			delete(h.clients, c)
+			close(c.overflowed)
+		}
+	}
+}
+
+// subscribe registers a client. If lastID is still in the recent records,
+// the records after it are returned as backlog and resumed is true,
+// otherwise head is the ID of the latest record, which the snapshot starts from.
+func (h *Hub) subscribe(lastID uint64, resume bool) (c *client, backlog []*Record, resumed bool, head uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c = &client{ch: make(chan *Record, 256), overflowed: make(chan struct{})}
+	h.clients[c] = struct{}{}
+	// all the records after lastID are kept
+	kept := lastID == h.seq || (len(h.recent) > 0 && lastID+1 >= h.recent[0].seq)
+	if resume && lastID <= h.seq && kept {
+		for _, rec := range h.recent {
+			if rec.seq > lastID {
+				backlog = append(backlog, rec)
+			}
+		}
+		return c, backlog, true, h.seq
+	}
+	return c, nil, false, h.seq
+}
+
+func (h *Hub) eventID(seq uint64) string {
+	return h.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// parseEventID returns the seq of id, ok is false if id is invalid or of another epoch.
+func (h *Hub) parseEventID(id string) (seq uint64, ok bool) {
+	if !strings.HasPrefix(id, h.epoch+"-") {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimPrefix(id, h.epoch+"-"), 10, 64)
+	return seq, err == nil
+}
+
+func (h *Hub) unsubscribe(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+// streamWriter writes records as Server-Sent Events or NDJSON.
+type streamWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	sse     bool
+}
+
+func (sw *streamWriter) write(rec *Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if sw.sse {
+		if rec.ID != "" {
+			fmt.Fprintf(sw.w, "id: %s\n", rec.ID)
+		}
+		_, err = fmt.Fprintf(sw.w, "event: %s\ndata: %s\n\n", rec.Op, data)
+	} else {
+		_, err = fmt.Fprintf(sw.w, "%s\n", data)
+	}
+	return err
+}
+
+func (sw *streamWriter) ping() error {
+	var err error
+	if sw.sse {
+		_, err = fmt.Fprint(sw.w, ": ping\n\n")
+	} else {
+		_, err = fmt.Fprint(sw.w, "\n")
+	}
+	sw.flusher.Flush()
+	return err
+}
+
+// keepAlive is the interval of pings sent when there is no record.
+var keepAlive = 15 * time.Second
+
+// ServeHTTP streams the changes of proxies matching the query parameter `q`,
+// which is the same expression as storage.ParseQuery.
+//
+// The stream starts with a snapshot of the matching proxies, followed by a
+// `ready` record carrying the ID where the deltas start from. The stream is
+// NDJSON if the parameter `format` is ndjson or the Accept header is
+// application/x-ndjson, otherwise Server-Sent Events.
+// Clients resume after a reconnect by the `Last-Event-ID` header or the
+// `last_event_id` parameter, the snapshot is sent again if the ID is too old
+// or of another process.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := storage.ParseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sw := &streamWriter{w: w, flusher: flusher, sse: true}
+	if r.URL.Query().Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		sw.sse = false
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	lastID, ok := h.parseEventID(lastEventID)
+	c, backlog, resumed, head := h.subscribe(lastID, ok)
+	defer h.unsubscribe(c)
+
+	if !resumed {
+		// deltas happened while taking the snapshot are sent again,
+		// they are idempotent for replicas.
+		proxies, _ := h.b.Select(storage.WithQuery(q))
+		for _, pxy := range proxies {
+			if sw.write(&Record{Op: OpSnapshot, Proxy: pxy}) != nil {
+				return
+			}
+		}
+		if sw.write(&Record{ID: h.eventID(head), Op: OpReady}) != nil {
+			return
+		}
+	}
+	for _, rec := range backlog {
+		if rec = rec.filter(q); rec != nil && sw.write(rec) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec := <-c.ch:
+			if rec = rec.filter(q); rec != nil {
+				if sw.write(rec) != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		case <-ticker.C:
+			if sw.ping() != nil {
+				return
+			}
+		case <-c.overflowed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
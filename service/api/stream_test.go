@@ -0,0 +1,216 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+	"github.com/stretchr/testify/suite"
+)
+
+type StreamTestSuite struct {
+	suite.Suite
+	nb  backend.NotifyBackend
+	hub *Hub
+	ts  *httptest.Server
+}
+
+func (suite *StreamTestSuite) SetupTest() {
+	suite.nb = backend.WithNotifier(backend.NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	srv := NewServer(suite.nb)
+	suite.hub = srv.hub
+	suite.ts = httptest.NewServer(srv)
+	suite.nb.Insert(&proxy.Proxy{IP: net.ParseIP("1.1.1.1"), Score: 90})
+	suite.nb.Insert(&proxy.Proxy{IP: net.ParseIP("2.2.2.2"), Score: 30})
+}
+
+func (suite *StreamTestSuite) TearDownTest() {
+	suite.ts.Close()
+}
+
+// open opens a stream, and returns a function reading the next record.
+func (suite *StreamTestSuite) open(params url.Values, header http.Header) (next func() *Record, closeStream func()) {
+	req, _ := http.NewRequest(http.MethodGet, suite.ts.URL+"/events?"+params.Encode(), nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	suite.Require().Nil(err)
+	suite.Require().Equal(http.StatusOK, resp.StatusCode)
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	sse := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+	next = func() *Record {
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return nil
+				}
+				if sse {
+					if !strings.HasPrefix(line, "data: ") {
+						continue
+					}
+					line = strings.TrimPrefix(line, "data: ")
+				}
+				rec := &Record{}
+				suite.Require().Nil(json.Unmarshal([]byte(line), rec))
+				return rec
+			case <-time.After(time.Second):
+				suite.FailNow("timeout reading record")
+			}
+		}
+	}
+	return next, func() { resp.Body.Close() }
+}
+
+func (suite *StreamTestSuite) setScore(ip string, score int8) {
+	suite.nb.Modify(net.ParseIP(ip), func(pxy *proxy.Proxy) error {
+		pxy.Score = score
+		return nil
+	})
+}
+
+func (suite *StreamTestSuite) TestSnapshotAndDeltasSSE() {
+	suite.testSnapshotAndDeltas("sse")
+}
+
+func (suite *StreamTestSuite) TestSnapshotAndDeltasNDJSON() {
+	suite.testSnapshotAndDeltas("ndjson")
+}
+
+func (suite *StreamTestSuite) testSnapshotAndDeltas(format string) {
+	next, closeStream := suite.open(url.Values{"q": {"score >= 60"}, "format": {format}}, nil)
+	rec := next()
+	suite.Equal(OpSnapshot, rec.Op)
+	suite.Equal("1.1.1.1", rec.Proxy.IP.String())
+	rec = next()
+	suite.Equal(OpReady, rec.Op)
+	suite.Equal(suite.hub.eventID(2), rec.ID)
+
+	suite.setScore("2.2.2.2", 80) // starts matching
+	rec = next()
+	suite.Equal(suite.hub.eventID(3), rec.ID)
+	suite.Equal("update", rec.Op)
+	suite.Equal("2.2.2.2", rec.Proxy.IP.String())
+	suite.setScore("1.1.1.1", 20) // no longer matching
+	rec = next()
+	suite.Equal(suite.hub.eventID(4), rec.ID)
+	suite.Equal("delete", rec.Op)
+	suite.setScore("1.1.1.1", 10) // not matching before and after
+	suite.nb.Tag(backend.SourceEviction, backend.ReasonExpired).Delete(&proxy.Proxy{IP: net.ParseIP("2.2.2.2")})
+	rec = next()
+	suite.Equal(suite.hub.eventID(6), rec.ID)
+	suite.Equal("delete", rec.Op)
+	suite.Equal(backend.ReasonExpired, rec.Reason)
+	suite.Equal(backend.SourceEviction, rec.Source)
+	closeStream()
+}
+
+func (suite *StreamTestSuite) TestResume() {
+	suite.setScore("1.1.1.1", 95) // 3
+	suite.setScore("2.2.2.2", 85) // 4
+	// resume from 3 with header
+	next, closeStream := suite.open(url.Values{"q": {"score >= 60"}}, http.Header{"Last-Event-ID": {suite.hub.eventID(3)}})
+	rec := next()
+	suite.Equal(suite.hub.eventID(4), rec.ID)
+	suite.Equal("2.2.2.2", rec.Proxy.IP.String())
+	closeStream()
+	// resume from latest
+	next, closeStream = suite.open(url.Values{"last_event_id": {suite.hub.eventID(4)}}, nil)
+	suite.setScore("1.1.1.1", 96)
+	suite.Equal(suite.hub.eventID(5), next().ID)
+	closeStream()
+	// unknown id starts from snapshot
+	next, closeStream = suite.open(url.Values{"last_event_id": {suite.hub.eventID(100)}}, nil)
+	suite.Equal(OpSnapshot, next().Op)
+	closeStream()
+}
+
+func (suite *StreamTestSuite) TestResumeAnotherEpoch() {
+	suite.setScore("1.1.1.1", 95)
+	// the same seq of a previous process, e.g. before a restart
+	previous := NewHub(suite.nb, 16)
+	previous.epoch = "previous"
+	for _, id := range []string{previous.eventID(3), "3"} {
+		next, closeStream := suite.open(url.Values{"last_event_id": {id}}, nil)
+		suite.Equal(OpSnapshot, next().Op, id)
+		closeStream()
+	}
+	seq, ok := suite.hub.parseEventID(suite.hub.eventID(3))
+	suite.True(ok)
+	suite.Equal(uint64(3), seq)
+	_, ok = suite.hub.parseEventID(previous.eventID(3))
+	suite.False(ok)
+}
+
+func (suite *StreamTestSuite) TestResumeTooOld() {
+	hub := NewHub(suite.nb, 2)
+	suite.nb.Attach(hub)
+	for i := 0; i < 5; i++ {
+		suite.setScore("1.1.1.1", int8(50+i))
+	}
+	_, backlog, resumed, head := hub.subscribe(3, true)
+	suite.True(resumed)
+	suite.Len(backlog, 2)
+	suite.Equal(uint64(5), head)
+	_, _, resumed, _ = hub.subscribe(0, true)
+	suite.False(resumed)
+}
+
+func (suite *StreamTestSuite) TestSnapshotTiedScores() {
+	for i := 1; i <= 20; i++ {
+		suite.nb.Insert(&proxy.Proxy{IP: net.IPv4(10, 0, 0, byte(i)), Score: 100})
+	}
+	next, closeStream := suite.open(url.Values{"format": {"ndjson"}}, nil)
+	defer closeStream()
+	snapshot := 0
+	for rec := next(); rec.Op == OpSnapshot; rec = next() {
+		snapshot++
+	}
+	suite.Equal(22, snapshot)
+}
+
+func (suite *StreamTestSuite) TestNoCredentials() {
+	suite.nb.Insert(&proxy.Proxy{IP: net.ParseIP("3.3.3.3"), Score: 95, Username: "user", Password: "secret"})
+	resp, err := http.Get(suite.ts.URL + "/events?format=ndjson")
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	go suite.setScore("3.3.3.3", 96)
+	for scanner.Scan() {
+		suite.NotContains(scanner.Text(), "secret")
+		if strings.Contains(scanner.Text(), `"op":"update"`) {
+			break
+		}
+	}
+}
+
+func (suite *StreamTestSuite) TestBadQuery() {
+	resp, err := http.Get(suite.ts.URL + "/events?q=" + url.QueryEscape("score >="))
+	suite.Nil(err)
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestStreamTestSuite(t *testing.T) {
+	suite.Run(t, new(StreamTestSuite))
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/Leosocy/IntelliProxy/pkg/submit"
+)
+
+// maxSubmitSize is the max size of body submitting proxies.
+const maxSubmitSize = 8 << 20
+
+// serveSubmit submits the proxies in body, which is JSON of submissions
+// if Content-Type is `application/json`, see submit.ParseJSON, otherwise
+// a proxy per line, see submit.ParseText. The query `source` is the
+// source of proxies which don't specify one. The submissions authorized by
+// `Authorization: Bearer <token>` of WithSubmitToken are trusted.
+// Returns the results as JSON.
+func (s *Server) serveSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.submitter == nil {
+		http.Error(w, "submission is disabled", http.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSubmitSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var subs []submit.Submission
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if subs, err = submit.ParseJSON(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		subs = submit.ParseText(data)
+	}
+	if source := r.URL.Query().Get("source"); source != "" {
+		for i := range subs {
+			if subs[i].Source == "" {
+				subs[i].Source = source
+			}
+		}
+	}
+	var results []submit.Result
+	if s.trusted(r) {
+		results = s.submitter.SubmitTrusted(subs...)
+	} else {
+		results = s.submitter.Submit(subs...)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// trusted reports whether r is authorized by the submit token.
+func (s *Server) trusted(r *http.Request) bool {
+	if s.submitToken == "" {
+		return false
+	}
+	want := "Bearer " + s.submitToken
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) == 1
+}
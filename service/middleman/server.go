@@ -5,9 +5,15 @@
 package middleman
 
 import (
+	"bufio"
+	"context"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/Leosocy/IntelliProxy/pkg/loadbalancer"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
 	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
 
 	"github.com/elazarl/goproxy"
@@ -23,12 +29,18 @@ import (
 type Server struct {
 	sm *SessionManager
 	*goproxy.ProxyHttpServer
+	mu       sync.Mutex
+	hijacked map[*hijackedConn]struct{} // the CONNECT tunnels, which http.Server doesn't track
 }
 
-func NewServer(nb backend.NotifyBackend) *Server {
+// NewServer returns a middleman server using the proxies in nb by strategy,
+// and publishes the session events to bus.
+func NewServer(nb backend.NotifyBackend, bus *pubsub.Bus, strategy loadbalancer.Strategy,
+	options ...func(*SessionManager)) *Server {
 	s := &Server{
-		sm:              NewSessionManager(nb, loadbalancer.WeightedRoundRobin),
+		sm:              NewSessionManager(nb, bus, strategy, options...),
 		ProxyHttpServer: goproxy.NewProxyHttpServer(),
+		hijacked:        make(map[*hijackedConn]struct{}),
 	}
 	s.Verbose = true
 	s.OnRequest().HandleConnect(goproxy.AlwaysMitm)
@@ -38,3 +50,92 @@ func NewServer(nb backend.NotifyBackend) *Server {
 	})
 	return s
 }
+
+// ServeHTTP tracks the connections hijacked by CONNECT, which are served
+// by goproxy after the request returns.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if hj, ok := w.(http.Hijacker); ok && r.Method == http.MethodConnect {
+		w = &hijackTracker{ResponseWriter: w, hijacker: hj, s: s}
+	}
+	s.ProxyHttpServer.ServeHTTP(w, r)
+}
+
+// hijackedPollInterval is the interval of checking whether the hijacked connections are done.
+var hijackedPollInterval = 100 * time.Millisecond
+
+// Shutdown waits for the hijacked connections done, which http.Server.Shutdown
+// doesn't wait for. The ones still open when ctx is done are closed, and the
+// error of ctx is returned. It should be called after http.Server.Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	ticker := time.NewTicker(hijackedPollInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.hijacked)
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			for c := range s.hijacked {
+				c.Conn.Close()
+				delete(s.hijacked, c)
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the sessions to the proxies, see SessionManager.Close.
+func (s *Server) Close() {
+	s.sm.Close()
+}
+
+func (s *Server) untrack(c *hijackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.hijacked, c)
+}
+
+// hijackTracker tracks the connection hijacked from the ResponseWriter.
+type hijackTracker struct {
+	http.ResponseWriter
+	hijacker http.Hijacker
+	s        *Server
+}
+
+func (t *hijackTracker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := t.hijacker.Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+	c := &hijackedConn{Conn: conn, s: t.s}
+	t.s.mu.Lock()
+	t.s.hijacked[c] = struct{}{}
+	t.s.mu.Unlock()
+	return c, rw, nil
+}
+
+// hijackedConn is done when closed, or when reading fails, since goproxy
+// doesn't close the connection whose TLS handshake fails.
+type hijackedConn struct {
+	net.Conn
+	s *Server
+}
+
+func (c *hijackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+		c.s.untrack(c)
+	}
+	return n, err
+}
+
+func (c *hijackedConn) Close() error {
+	c.s.untrack(c)
+	return c.Conn.Close()
+}
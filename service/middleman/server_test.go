@@ -0,0 +1,61 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package middleman
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/loadbalancer"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	nb := backend.WithNotifier(backend.NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	mm := NewServer(nb, pubsub.NewBus(), loadbalancer.RoundRobin)
+	defer mm.Close()
+	ts := httptest.NewServer(mm)
+	defer ts.Close()
+
+	// connect opens a tunnel, which is hijacked when the response is read.
+	connect := func() net.Conn {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return conn
+	}
+
+	conn := connect()
+	conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, mm.Shutdown(ctx))
+
+	conn = connect()
+	defer conn.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, mm.Shutdown(ctx))
+	// closed by Shutdown
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
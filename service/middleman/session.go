@@ -9,10 +9,12 @@ import (
 	"net/http"
 	"net/http/httptrace"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Leosocy/IntelliProxy/pkg/loadbalancer"
-	"github.com/Leosocy/IntelliProxy/pkg/storage"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
 	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
 
 	"github.com/Leosocy/IntelliProxy/pkg/proxy"
@@ -26,8 +28,9 @@ import (
 //
 // session can carry different requests with the same pxy, and will reuse connection.
 type session struct {
-	pxy *proxy.Proxy
-	tr  *http.Transport
+	pxy  *proxy.Proxy
+	tr   *http.Transport
+	uses uint64 // successful requests not flushed to backend yet, see SessionManager.flushUses
 }
 
 func newSession(pxy *proxy.Proxy, tr *http.Transport) *session {
@@ -101,35 +104,157 @@ type roundTripRes struct {
 }
 
 type SessionManager struct {
+	nb                  backend.NotifyBackend
+	bus                 *pubsub.Bus
 	lb                  loadbalancer.LoadBalancer
 	pxyCh               chan *proxy.Proxy
+	sessions            map[string]*session // map[IP]session
+	mu                  sync.Mutex
 	defaultRoundTripper http.RoundTripper
+	watcher             *backend.ScoreCrossingWatcher
+	quit                chan struct{} // closed by Close
+	closeOnce           sync.Once
+	goodScore           int8          // minimum score of proxies used by sessions
+	failurePenalty      int8          // score reduced when a request through the proxy failed
+	flushPeriod         time.Duration // of writing the uses of proxies to backend
 }
 
-func NewSessionManager(nb backend.NotifyBackend, strategy loadbalancer.Strategy) *SessionManager {
+// GoodScore sets the minimum score of proxies used by sessions, 90 by default.
+func GoodScore(score int8) func(*SessionManager) {
+	return func(sm *SessionManager) {
+		sm.goodScore = score
+	}
+}
+
+// FailurePenalty sets the score reduced when a request through the proxy failed, 10 by default.
+func FailurePenalty(penalty int8) func(*SessionManager) {
+	return func(sm *SessionManager) {
+		sm.failurePenalty = penalty
+	}
+}
+
+// Topics of the session events published by SessionManager, the payload is the proxy.
+const (
+	TopicSessionAdd     = "middleman.session.add"
+	TopicSessionRemove  = "middleman.session.remove"
+	TopicRequestFailure = "middleman.request.failed"
+)
+
+// FlushUsesEvery sets the period of writing the uses of proxies to backend, 1m by default.
+// The uses are counted in memory meanwhile, so that a request doesn't cost a write.
+func FlushUsesEvery(period time.Duration) func(*SessionManager) {
+	return func(sm *SessionManager) {
+		sm.flushPeriod = period
+	}
+}
+
+func NewSessionManager(nb backend.NotifyBackend, bus *pubsub.Bus, strategy loadbalancer.Strategy,
+	options ...func(*SessionManager)) *SessionManager {
 	sm := &SessionManager{
-		lb:    loadbalancer.NewLoadBalancer(strategy),
-		pxyCh: make(chan *proxy.Proxy, 128),
+		nb:             nb,
+		bus:            bus,
+		lb:             loadbalancer.NewLoadBalancer(strategy),
+		pxyCh:          make(chan *proxy.Proxy, 128),
+		sessions:       make(map[string]*session),
+		quit:           make(chan struct{}),
+		goodScore:      90,
+		failurePenalty: 10,
+		flushPeriod:    time.Minute,
+	}
+	for _, opt := range options {
+		opt(sm)
 	}
-	nb.Attach(backend.NewInsertionWatcher(func(pxy *proxy.Proxy) {
-		sm.pxyCh <- pxy
-	}, storage.FilterScore(90)))
+	// sessions are added when the proxy becomes good enough,
+	// and removed when it gets worse or is removed from backend.
+	sm.watcher = backend.NewScoreCrossingWatcher(sm.goodScore, func(e *backend.Event, up bool) {
+		if up {
+			select {
+			case sm.pxyCh <- e.Pxy:
+			case <-sm.quit:
+			}
+		} else {
+			sm.delSession(e.Pxy.IP)
+		}
+	})
+	nb.Attach(sm.watcher)
 	sm.init()
 	return sm
 }
 
 func (sm *SessionManager) init() {
 	go func() {
+		ticker := time.NewTicker(sm.flushPeriod)
+		defer ticker.Stop()
 		for {
 			select {
 			case pxy := <-sm.pxyCh:
-				session := newSession(pxy, newDefaultSessionTransport())
-				sm.lb.AddEndpoint(session)
+				sm.addSession(pxy)
+			case <-ticker.C:
+				for _, session := range sm.allSessions() {
+					sm.flushUses(session)
+				}
+			case <-sm.quit:
+				return
 			}
 		}
 	}()
 }
 
+func (sm *SessionManager) allSessions() []*session {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sessions := make([]*session, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Close stops adding sessions, closes the idle connections of all sessions,
+// and flushes the uses of them. Call it after the requests are drained,
+// e.g. by http.Server.Shutdown.
+func (sm *SessionManager) Close() {
+	sm.closeOnce.Do(func() {
+		close(sm.quit)
+		sm.nb.Detach(sm.watcher)
+		sm.mu.Lock()
+		closed := make([]*session, 0, len(sm.sessions))
+		for ip, session := range sm.sessions {
+			delete(sm.sessions, ip)
+			sm.lb.DelEndpoint(session)
+			session.close()
+			closed = append(closed, session)
+		}
+		sm.mu.Unlock()
+		for _, session := range closed {
+			sm.flushUses(session)
+		}
+	})
+}
+
+func (sm *SessionManager) addSession(pxy *proxy.Proxy) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if _, found := sm.sessions[pxy.IP.String()]; found {
+		return
+	}
+	session := newSession(pxy, newDefaultSessionTransport())
+	sm.sessions[pxy.IP.String()] = session
+	sm.lb.AddEndpoint(session)
+	sm.bus.Publish(TopicSessionAdd, pxy)
+}
+
+func (sm *SessionManager) delSession(ip net.IP) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if session, found := sm.sessions[ip.String()]; found {
+		delete(sm.sessions, ip.String())
+		sm.lb.DelEndpoint(session)
+		sm.bus.Publish(TopicSessionRemove, session.pxy)
+		go sm.flushUses(session)
+	}
+}
+
 func (sm *SessionManager) pickOne() (*session, error) {
 	endpoint := sm.lb.Select()
 	if endpoint == nil {
@@ -158,10 +283,46 @@ func (sm *SessionManager) RoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (r
 
 	select {
 	case v := <-rtResCh:
+		if v.s == nil {
+			return v.resp, v.err
+		}
 		if v.err != nil {
 			logrus.Warnf("Remove session:%s from load balancer", v.s.String())
-			sm.lb.DelEndpoint(v.s)
+			sm.delSession(v.s.pxy.IP)
+			go sm.reportFailure(v.s)
+		} else {
+			sm.markUsed(v.s)
 		}
 		return v.resp, v.err
 	}
 }
+
+// markUsed counts a use of the proxy, which is used by least-used eviction.
+func (sm *SessionManager) markUsed(s *session) {
+	atomic.AddUint64(&s.uses, 1)
+}
+
+// flushUses adds the uses counted since the last flush to the proxy in backend,
+// which costs a write per period rather than per request.
+func (sm *SessionManager) flushUses(s *session) {
+	uses := atomic.SwapUint64(&s.uses, 0)
+	if uses == 0 {
+		return
+	}
+	sm.nb.Tag(backend.SourceMiddleman, backend.ReasonUsed).Modify(s.pxy.IP, func(pxy *proxy.Proxy) error {
+		pxy.Uses += uses
+		return nil
+	})
+}
+
+// reportFailure reduces the score of the proxy, and deletes it if the score drops to 0.
+func (sm *SessionManager) reportFailure(s *session) {
+	sm.bus.Publish(TopicRequestFailure, s.pxy)
+	nb := sm.nb.Tag(backend.SourceMiddleman, backend.ReasonFailed)
+	if _, err := nb.Modify(s.pxy.IP, func(pxy *proxy.Proxy) error {
+		pxy.AddScore(-sm.failurePenalty)
+		return nil
+	}); err == backend.ErrProxyInvalid {
+		nb.Delete(s.pxy)
+	}
+}
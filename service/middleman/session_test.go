@@ -0,0 +1,38 @@
+// Copyright (c) 2019 leosocy, leosocy@gmail.com
+// Use of this source code is governed by a MIT-style license
+// that can be found in the LICENSE file.
+
+package middleman
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Leosocy/IntelliProxy/pkg/loadbalancer"
+	"github.com/Leosocy/IntelliProxy/pkg/proxy"
+	"github.com/Leosocy/IntelliProxy/pkg/pubsub"
+	"github.com/Leosocy/IntelliProxy/pkg/storage/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionManager_FlushUses(t *testing.T) {
+	nb := backend.WithNotifier(backend.NewInMemoryBackend(), &pubsub.BaseNotifier{})
+	ip := net.ParseIP("1.2.3.4")
+	nb.Insert(&proxy.Proxy{IP: ip, Port: 80, Score: 95})
+	sm := NewSessionManager(nb, pubsub.NewBus(), loadbalancer.RoundRobin, FlushUsesEvery(time.Hour))
+	sm.addSession(nb.Search(ip))
+	version := nb.Search(ip).Version
+
+	s, err := sm.pickOne()
+	if assert.Nil(t, err) {
+		for i := 0; i < 5; i++ {
+			sm.markUsed(s)
+		}
+	}
+	assert.Equal(t, uint64(0), nb.Search(ip).Uses)
+	sm.Close()
+	stored := nb.Search(ip)
+	assert.Equal(t, uint64(5), stored.Uses)
+	assert.Equal(t, version+1, stored.Version)
+}